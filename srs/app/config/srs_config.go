@@ -27,6 +27,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"fmt"
+	"strings"
 )
 
 type SrsConfig struct {
@@ -158,6 +159,216 @@ func GetHlsWaitKeyframe(vname string) bool {
 	return vhost.Hls.HlsWaitKeyframe == "on"
 }
 
+const SRS_CONF_HLS_SEGMENT_TYPE_MPEGTS = "mpegts"
+const SRS_CONF_HLS_SEGMENT_TYPE_FMP4 = "fmp4"
+const SRS_CONF_DEFAULT_HLS_SEGMENT_TYPE = SRS_CONF_HLS_SEGMENT_TYPE_MPEGTS
+
+func GetHlsSegmentType(vname string) string {
+	vhost := GetInstance().GetVHost(vname)
+	if vhost == nil || vhost.Hls == nil {
+		return SRS_CONF_DEFAULT_HLS_SEGMENT_TYPE
+	}
+
+	return vhost.Hls.HlsSegmentType
+}
+
+const SRS_CONF_DEFAULT_HLS_INIT_FILE = "[app]/[stream]-init.mp4"
+
+func GetHlsInitFile(vname string) string {
+	vhost := GetInstance().GetVHost(vname)
+	if vhost == nil || vhost.Hls == nil {
+		return SRS_CONF_DEFAULT_HLS_INIT_FILE
+	}
+
+	return vhost.Hls.HlsInitFile
+}
+
+const SRS_CONF_DEFAULT_HLS_LOW_LATENCY = false
+
+func GetHlsLowLatency(vname string) bool {
+	vhost := GetInstance().GetVHost(vname)
+	if vhost == nil || vhost.Hls == nil {
+		return SRS_CONF_DEFAULT_HLS_LOW_LATENCY
+	}
+
+	return vhost.Hls.HlsLowLatency == "on"
+}
+
+const SRS_CONF_DEFAULT_HLS_PART_TARGET = 1.0
+
+func GetHlsPartTarget(vname string) float64 {
+	vhost := GetInstance().GetVHost(vname)
+	if vhost == nil || vhost.Hls == nil {
+		return SRS_CONF_DEFAULT_HLS_PART_TARGET
+	}
+
+	return vhost.Hls.HlsPartTarget
+}
+
+const SRS_CONF_HLS_PROGRAM_DATE_TIME_OFF = "off"
+const SRS_CONF_HLS_PROGRAM_DATE_TIME_ON = "on"
+const SRS_CONF_HLS_PROGRAM_DATE_TIME_DISCONTINUITY = "discontinuity"
+const SRS_CONF_DEFAULT_HLS_PROGRAM_DATE_TIME = SRS_CONF_HLS_PROGRAM_DATE_TIME_ON
+
+/**
+* whether emit the EXT-X-PROGRAM-DATE-TIME, on for each segment,
+* discontinuity for the first segment and segments after discontinuity.
+*/
+func GetHlsProgramDateTime(vname string) string {
+	vhost := GetInstance().GetVHost(vname)
+	if vhost == nil || vhost.Hls == nil {
+		return SRS_CONF_DEFAULT_HLS_PROGRAM_DATE_TIME
+	}
+
+	return vhost.Hls.HlsProgramDateTime
+}
+
+const SRS_CONF_DEFAULT_HLS_DVR_WINDOW = 0
+
+/**
+* the window in seconds of the dvr playlist, 0 to disable it.
+*/
+func GetHlsDvrWindow(vname string) float64 {
+	vhost := GetInstance().GetVHost(vname)
+	if vhost == nil || vhost.Hls == nil {
+		return SRS_CONF_DEFAULT_HLS_DVR_WINDOW
+	}
+
+	return float64(vhost.Hls.HlsDvrWindow)
+}
+
+const SRS_CONF_DEFAULT_HLS_DVR_M3U8_FILE = "[app]/[stream]-dvr.m3u8"
+
+func GetHlsDvrM3u8File(vname string) string {
+	vhost := GetInstance().GetVHost(vname)
+	if vhost == nil || vhost.Hls == nil {
+		return SRS_CONF_DEFAULT_HLS_DVR_M3U8_FILE
+	}
+
+	return vhost.Hls.HlsDvrM3u8File
+}
+
+const SRS_CONF_DEFAULT_HLS_DVR_CLEANUP = true
+
+func GetHlsDvrCleanup(vname string) bool {
+	vhost := GetInstance().GetVHost(vname)
+	if vhost == nil || vhost.Hls == nil {
+		return SRS_CONF_DEFAULT_HLS_DVR_CLEANUP
+	}
+
+	return vhost.Hls.HlsDvrCleanup == "on"
+}
+
+const SRS_CONF_DEFAULT_HLS_KEYS = false
+
+func GetHlsKeys(vname string) bool {
+	vhost := GetInstance().GetVHost(vname)
+	if vhost == nil || vhost.Hls == nil {
+		return SRS_CONF_DEFAULT_HLS_KEYS
+	}
+
+	return vhost.Hls.HlsKeys == "on"
+}
+
+const SRS_CONF_DEFAULT_HLS_FRAGMENTS_PER_KEY = 5
+
+func GetHlsFragmentsPerKey(vname string) int {
+	vhost := GetInstance().GetVHost(vname)
+	if vhost == nil || vhost.Hls == nil {
+		return SRS_CONF_DEFAULT_HLS_FRAGMENTS_PER_KEY
+	}
+
+	return int(vhost.Hls.HlsFragmentsPerKey)
+}
+
+const SRS_CONF_DEFAULT_HLS_KEY_FILE = "[app]/[stream]-[seq].key"
+
+func GetHlsKeyFile(vname string) string {
+	vhost := GetInstance().GetVHost(vname)
+	if vhost == nil || vhost.Hls == nil {
+		return SRS_CONF_DEFAULT_HLS_KEY_FILE
+	}
+
+	return vhost.Hls.HlsKeyFile
+}
+
+/**
+* the path to write the key files, use hls_path when not specified.
+*/
+func GetHlsKeyFilePath(vname string) string {
+	vhost := GetInstance().GetVHost(vname)
+	if vhost == nil || vhost.Hls == nil || vhost.Hls.HlsKeyFilePath == "" {
+		return GetHlsPath(vname)
+	}
+
+	return vhost.Hls.HlsKeyFilePath
+}
+
+func GetHlsKeyUrl(vname string) string {
+	vhost := GetInstance().GetVHost(vname)
+	if vhost == nil || vhost.Hls == nil {
+		return ""
+	}
+
+	return vhost.Hls.HlsKeyUrl
+}
+
+const SRS_CONF_DEFAULT_HLS_NB_NOTIFY = 64
+
+func GetHlsNbNotify(vname string) int {
+	vhost := GetInstance().GetVHost(vname)
+	if vhost == nil || vhost.Hls == nil {
+		return SRS_CONF_DEFAULT_HLS_NB_NOTIFY
+	}
+
+	return int(vhost.Hls.HlsNbNotify)
+}
+
+const SRS_CONF_HLS_ON_ERROR_IGNORE = "ignore"
+const SRS_CONF_HLS_ON_ERROR_CONTINUE = "continue"
+const SRS_CONF_HLS_ON_ERROR_DISCONNECT = "disconnect"
+const SRS_CONF_DEFAULT_HLS_ON_ERROR = SRS_CONF_HLS_ON_ERROR_CONTINUE
+
+/**
+* the strategy when hls error, ignore to disable hls for this publish,
+* continue to reset hls and continue at next keyframe, disconnect to kick the publisher.
+*/
+func GetHlsOnError(vname string) string {
+	vhost := GetInstance().GetVHost(vname)
+	if vhost == nil || vhost.Hls == nil {
+		return SRS_CONF_DEFAULT_HLS_ON_ERROR
+	}
+
+	return vhost.Hls.HlsOnError
+}
+
+const SRS_CONF_DEFAULT_HLS_TS_FLOOR = false
+
+func GetHlsTsFloor(vname string) bool {
+	vhost := GetInstance().GetVHost(vname)
+	if vhost == nil || vhost.Hls == nil {
+		return SRS_CONF_DEFAULT_HLS_TS_FLOOR
+	}
+
+	return vhost.Hls.HlsTsFloor == "on"
+}
+
+/**
+* get the master playlist config of vhost, nil when disabled.
+*/
+func GetHlsMaster(vname string) *HlsMasterConf {
+	vhost := GetInstance().GetVHost(vname)
+	if vhost == nil || vhost.Hls == nil || vhost.Hls.HlsMaster == nil {
+		return nil
+	}
+
+	if vhost.Hls.HlsMaster.Enabled != "on" {
+		return nil
+	}
+
+	return vhost.Hls.HlsMaster
+}
+
 func (this *SrsConfig) GetChunkSize(vhost string) uint32 {
 	h, ok := this.VHosts[vhost]
 	if !ok {
@@ -184,9 +395,158 @@ func GetDvrPath(vhost string) string {
 	return h.Dvr.DvrPath
 }
 
+const SRS_CONF_DEFAULT_DVR_DURATION = 30
+
+/**
+* get the duration in seconds of each piece for the segment plan.
+*/
+func GetDvrDuration(vhost string) uint32 {
+	h := GetInstance().GetVHost(vhost)
+	if h == nil || h.Enabled != "on" || h.Dvr == nil || h.Dvr.Enabled != "on" {
+		return SRS_CONF_DEFAULT_DVR_DURATION
+	}
+
+	return h.Dvr.DvrDuration
+}
+
+/**
+* whether wait for keyframe to reap the piece for the segment plan.
+*/
+func GetDvrWaitKeyframe(vhost string) bool {
+	h := GetInstance().GetVHost(vhost)
+	if h == nil || h.Enabled != "on" || h.Dvr == nil || h.Dvr.Enabled != "on" {
+		return true
+	}
+
+	return h.Dvr.DvrWaitKeyFrame == "on"
+}
+
+/**
+* get the time jitter algorithm of dvr, full, zero or off.
+*/
+func GetDvrTimeJitter(vhost string) string {
+	h := GetInstance().GetVHost(vhost)
+	if h == nil || h.Enabled != "on" || h.Dvr == nil || h.Dvr.Enabled != "on" {
+		return SRS_CONF_DEFAULT_TIME_JITTER
+	}
+
+	return h.Dvr.TimerJitter
+}
+
+const SRS_CONF_DVR_FORMAT_FLV = "flv"
+const SRS_CONF_DVR_FORMAT_MP4 = "mp4"
+const SRS_CONF_DVR_FORMAT_TS = "ts"
+
+/**
+* get the format of dvr file, the dvr_format, or the extension of dvr_path.
+*/
+func GetDvrFormat(vhost string) string {
+	h := GetInstance().GetVHost(vhost)
+	if h == nil || h.Enabled != "on" || h.Dvr == nil || h.Dvr.Enabled != "on" {
+		return SRS_CONF_DVR_FORMAT_FLV
+	}
+
+	if h.Dvr.DvrFormat != "" {
+		return h.Dvr.DvrFormat
+	}
+
+	if strings.HasSuffix(h.Dvr.DvrPath, "." + SRS_CONF_DVR_FORMAT_MP4) {
+		return SRS_CONF_DVR_FORMAT_MP4
+	}
+	if strings.HasSuffix(h.Dvr.DvrPath, "." + SRS_CONF_DVR_FORMAT_TS) {
+		return SRS_CONF_DVR_FORMAT_TS
+	}
+	return SRS_CONF_DVR_FORMAT_FLV
+}
+
+/**
+* whether rewrite the fragmented mp4 to progressive mp4 with moov in front when closed.
+*/
+func GetDvrMp4Faststart(vhost string) bool {
+	h := GetInstance().GetVHost(vhost)
+	if h == nil || h.Enabled != "on" || h.Dvr == nil || h.Dvr.Enabled != "on" {
+		return false
+	}
+
+	return h.Dvr.DvrMp4Faststart == "on"
+}
+
+// never fsync, the file is flushed by system.
+const SRS_CONF_DVR_FSYNC_OFF = "off"
+// fsync when the file is closed, before renamed to the final name.
+const SRS_CONF_DVR_FSYNC_CLOSE = "close"
+// fsync by dvr_fsync_interval when recording, and when closed.
+const SRS_CONF_DVR_FSYNC_INTERVAL = "interval"
+
+const SRS_CONF_DEFAULT_DVR_FSYNC_INTERVAL = 10
+
+/**
+* get the fsync policy of dvr file, off, close or interval.
+*/
+func GetDvrFsync(vhost string) string {
+	h := GetInstance().GetVHost(vhost)
+	if h == nil || h.Enabled != "on" || h.Dvr == nil || h.Dvr.Enabled != "on" {
+		return SRS_CONF_DVR_FSYNC_OFF
+	}
+
+	return h.Dvr.DvrFsync
+}
+
+/**
+* get the interval in seconds to fsync the dvr file, for the interval policy.
+*/
+func GetDvrFsyncInterval(vhost string) uint32 {
+	h := GetInstance().GetVHost(vhost)
+	if h == nil || h.Enabled != "on" || h.Dvr == nil || h.Dvr.Enabled != "on" {
+		return SRS_CONF_DEFAULT_DVR_FSYNC_INTERVAL
+	}
+
+	return h.Dvr.DvrFsyncInterval
+}
+
+/**
+* get the max age in seconds of dvr files, the older files are deleted, 0 to keep all.
+*/
+func GetDvrMaxAge(vhost string) uint32 {
+	h := GetInstance().GetVHost(vhost)
+	if h == nil || h.Enabled != "on" || h.Dvr == nil || h.Dvr.Enabled != "on" {
+		return 0
+	}
+
+	return h.Dvr.DvrMaxAge
+}
+
+/**
+* get the max bytes of dvr files, the oldest files are deleted when exceed, 0 to keep all.
+*/
+func GetDvrMaxBytes(vhost string) int64 {
+	h := GetInstance().GetVHost(vhost)
+	if h == nil || h.Enabled != "on" || h.Dvr == nil || h.Dvr.Enabled != "on" {
+		return 0
+	}
+
+	return h.Dvr.DvrMaxBytes
+}
+
+const SRS_CONF_DEFAULT_DVR_CLEANUP_INTERVAL = 60
+
+/**
+* get the interval in seconds to enforce the dvr_max_age and dvr_max_bytes.
+*/
+func GetDvrCleanupInterval(vhost string) uint32 {
+	h := GetInstance().GetVHost(vhost)
+	if h == nil || h.Enabled != "on" || h.Dvr == nil || h.Dvr.Enabled != "on" {
+		return SRS_CONF_DEFAULT_DVR_CLEANUP_INTERVAL
+	}
+
+	return h.Dvr.DvrCleanupInterval
+}
+
 const SRS_CONF_DEFAULT_DVR_PLAN_SESSION = "session"
 const SRS_CONF_DEFAULT_DVR_PLAN_SEGMENT = "segment"
 const SRS_CONF_DEFAULT_DVR_PLAN_APPEND = "append"
+// the dvr is started and stopped by http api, for specified stream.
+const SRS_CONF_DEFAULT_DVR_PLAN_API = "api"
 
 const SRS_CONF_DEFAULT_DVR_PLAN = SRS_CONF_DEFAULT_DVR_PLAN_SESSION
 
@@ -205,6 +565,24 @@ func GetDvrPlan(vhost string) string {
 	return h.Dvr.DvrPlan
 }
 
+const SRS_CONF_TIME_JITTER_FULL = "full"
+const SRS_CONF_TIME_JITTER_ZERO = "zero"
+const SRS_CONF_TIME_JITTER_OFF = "off"
+
+const SRS_CONF_DEFAULT_TIME_JITTER = SRS_CONF_TIME_JITTER_FULL
+
+/**
+* get the time jitter algorithm of vhost, full, zero or off.
+*/
+func GetTimeJitter(vhost string) string {
+	h := GetInstance().GetVHost(vhost)
+	if h == nil || h.Enabled != "on" {
+		return SRS_CONF_DEFAULT_TIME_JITTER
+	}
+
+	return h.TimerJitter
+}
+
 type HeartBeatConf struct {
 	Enabled   string  `json:"enabled"`
 	Interval  float64 `json:"interval"`
@@ -299,6 +677,13 @@ type DvrConf struct {
 	DvrDuration     uint32 `json:"dvr_duration"`
 	DvrWaitKeyFrame string `json:"dvr_wait_keyframe"`
 	TimerJitter     string `json:"timer_jitter"` //full, zero, off
+	DvrFormat       string `json:"dvr_format"` //flv, mp4, ts, empty to use the extension of dvr_path
+	DvrMp4Faststart string `json:"dvr_mp4_faststart"`
+	DvrFsync        string `json:"dvr_fsync"` //off, close, interval
+	DvrFsyncInterval uint32 `json:"dvr_fsync_interval"`
+	DvrMaxAge       uint32 `json:"dvr_max_age"` //in seconds, 0 to keep all
+	DvrMaxBytes     int64  `json:"dvr_max_bytes"` //0 to keep all
+	DvrCleanupInterval uint32 `json:"dvr_cleanup_interval"` //in seconds
 }
 
 const SRS_CONF_DEFAULT_DVR_PATH = "./html/[app]/[stream].[timestamp].flv"
@@ -316,7 +701,7 @@ func (this *DvrConf) amendDefault() {
 	}
 
 	if this.DvrDuration == 0 {
-		this.DvrDuration = 30
+		this.DvrDuration = SRS_CONF_DEFAULT_DVR_DURATION
 	}
 
 	if this.DvrWaitKeyFrame == "" {
@@ -326,6 +711,22 @@ func (this *DvrConf) amendDefault() {
 	if this.TimerJitter == "" {
 		this.TimerJitter = "full"
 	}
+
+	if this.DvrMp4Faststart == "" {
+		this.DvrMp4Faststart = "off"
+	}
+
+	if this.DvrFsync == "" {
+		this.DvrFsync = SRS_CONF_DVR_FSYNC_OFF
+	}
+
+	if this.DvrFsyncInterval == 0 {
+		this.DvrFsyncInterval = SRS_CONF_DEFAULT_DVR_FSYNC_INTERVAL
+	}
+
+	if this.DvrCleanupInterval == 0 {
+		this.DvrCleanupInterval = SRS_CONF_DEFAULT_DVR_CLEANUP_INTERVAL
+	}
 }
 
 type HttpStaticConf struct {
@@ -387,6 +788,48 @@ type HlsConf struct {
 	HlsDispose      uint32  `json:"hls_dispose"`       //the timeout in seconds to dispose the hls,dispose is to remove all hls files, m3u8 and ts files.
 	HlsNbNotify     uint32  `json:"hls_nb_notify"`     //the max size to notify hls,to read max bytes from ts of specified cdn network,
 	HlsWaitKeyframe string  `json:"hls_wait_keyframe"` //whether wait keyframe to reap segment,
+	HlsSegmentType  string  `json:"hls_segment_type"`  //the segment container, mpegts or fmp4.
+	HlsInitFile     string  `json:"hls_init_file"`     //the fmp4 init segment file name.
+	HlsLowLatency   string  `json:"hls_low_latency"`   //whether enable LL-HLS, the partial segments and blocking playlist reload.
+	HlsPartTarget   float64 `json:"hls_part_target"`   //the LL-HLS part target duration in seconds.
+	HlsProgramDateTime string `json:"hls_program_date_time"` //whether emit EXT-X-PROGRAM-DATE-TIME, on, off or discontinuity.
+	HlsDvrWindow    uint32  `json:"hls_dvr_window"`    //the dvr playlist window in seconds, 0 to disable.
+	HlsDvrM3u8File  string  `json:"hls_dvr_m3u8_file"` //the dvr playlist file name.
+	HlsDvrCleanup   string  `json:"hls_dvr_cleanup"`   //whether cleanup the segments expired from dvr window.
+	HlsKeys         string  `json:"hls_keys"`          //whether encrypt the ts segments by AES-128.
+	HlsFragmentsPerKey uint32 `json:"hls_fragments_per_key"` //the number of segments encrypted by a key, the key is rotated after.
+	HlsKeyFile      string  `json:"hls_key_file"`      //the key file name.
+	HlsKeyFilePath  string  `json:"hls_key_file_path"` //the path to write the key files, default to hls_path.
+	HlsKeyUrl       string  `json:"hls_key_url"`       //the base url of key in m3u8, default to relative to m3u8.
+	HlsMaster       *HlsMasterConf `json:"hls_master"` //the master playlist for the rendition groups.
+}
+
+/**
+* the rendition groups of a vhost, each group is a set of streams in the same app
+* which publish the same event at different bitrates, for example,
+*       "groups": {"show": ["show_720", "show_480"]}
+* the hls generates a master m3u8 for each group, which lists the renditions being published.
+*/
+type HlsMasterConf struct {
+	Enabled  string              `json:"enabled"`
+	M3u8File string              `json:"m3u8_file"` //the master m3u8 file name, variables [vhost], [app] and [group].
+	Groups   map[string][]string `json:"groups"`    //the group name to the streams of renditions.
+}
+
+const SRS_CONF_DEFAULT_HLS_MASTER_M3U8_FILE = "[app]/[group].m3u8"
+
+func (this *HlsMasterConf) amendDefault() {
+	if this.Enabled == "" {
+		this.Enabled = "off"
+	}
+
+	if this.M3u8File == "" {
+		this.M3u8File = SRS_CONF_DEFAULT_HLS_MASTER_M3U8_FILE
+	}
+
+	if this.Groups == nil {
+		this.Groups = make(map[string][]string)
+	}
 }
 
 func (this *HlsConf) amendDefault() {
@@ -411,7 +854,7 @@ func (this *HlsConf) amendDefault() {
 	}
 
 	if this.HlsOnError == "" {
-		this.HlsOnError = "continue"
+		this.HlsOnError = SRS_CONF_DEFAULT_HLS_ON_ERROR
 	}
 
 	if this.HlsPath == "" {
@@ -443,12 +886,179 @@ func (this *HlsConf) amendDefault() {
 	}
 
 	if this.HlsNbNotify == 0 {
-		this.HlsNbNotify = 64
+		this.HlsNbNotify = SRS_CONF_DEFAULT_HLS_NB_NOTIFY
 	}
 
 	if this.HlsWaitKeyframe == "" {
 		this.HlsWaitKeyframe = "on"
 	}
+
+	if this.HlsSegmentType == "" {
+		this.HlsSegmentType = SRS_CONF_DEFAULT_HLS_SEGMENT_TYPE
+	}
+
+	if this.HlsInitFile == "" {
+		this.HlsInitFile = SRS_CONF_DEFAULT_HLS_INIT_FILE
+	}
+
+	if this.HlsLowLatency == "" {
+		this.HlsLowLatency = "off"
+	}
+
+	if this.HlsPartTarget <= 0 {
+		this.HlsPartTarget = SRS_CONF_DEFAULT_HLS_PART_TARGET
+	}
+
+	if this.HlsProgramDateTime == "" {
+		this.HlsProgramDateTime = SRS_CONF_DEFAULT_HLS_PROGRAM_DATE_TIME
+	}
+
+	if this.HlsDvrM3u8File == "" {
+		this.HlsDvrM3u8File = SRS_CONF_DEFAULT_HLS_DVR_M3U8_FILE
+	}
+
+	if this.HlsDvrCleanup == "" {
+		this.HlsDvrCleanup = "on"
+	}
+
+	if this.HlsKeys == "" {
+		this.HlsKeys = "off"
+	}
+
+	if this.HlsFragmentsPerKey == 0 {
+		this.HlsFragmentsPerKey = SRS_CONF_DEFAULT_HLS_FRAGMENTS_PER_KEY
+	}
+
+	if this.HlsKeyFile == "" {
+		this.HlsKeyFile = SRS_CONF_DEFAULT_HLS_KEY_FILE
+	}
+
+	if this.HlsMaster != nil {
+		this.HlsMaster.amendDefault()
+	}
+}
+
+const SRS_CONF_DASH_TEMPLATE_NUMBER = "number"
+const SRS_CONF_DASH_TEMPLATE_TIME = "time"
+
+const SRS_CONF_DEFAULT_DASH_FRAGMENT = 10
+const SRS_CONF_DEFAULT_DASH_UPDATE_PERIOD = 10
+const SRS_CONF_DEFAULT_DASH_TIMESHIFT = 300
+const SRS_CONF_DEFAULT_DASH_PATH = "./html"
+const SRS_CONF_DEFAULT_DASH_MPD_FILE = "[app]/[stream].mpd"
+
+/**
+* the MPEG-DASH output, the fMP4 segments of each track and the dynamic mpd.
+*/
+type DashConf struct {
+	Enabled          string  `json:"enabled"`
+	DashFragment     float64 `json:"dash_fragment"`      //the duration of segment in seconds.
+	DashUpdatePeriod float64 `json:"dash_update_period"` //the minimumUpdatePeriod of mpd in seconds.
+	DashTimeshift    float64 `json:"dash_timeshift"`     //the timeShiftBufferDepth of mpd in seconds, the window of segments.
+	DashPath         string  `json:"dash_path"`          //the dash output path.
+	DashMpdFile      string  `json:"dash_mpd_file"`      //the mpd file name.
+	DashTemplate     string  `json:"dash_template"`      //the SegmentTemplate media name by number or time.
+	DashCleanup      string  `json:"dash_cleanup"`       //whether cleanup the segments out of timeshift.
+}
+
+func (this *DashConf) amendDefault() {
+	if this.Enabled == "" {
+		this.Enabled = "off"
+	}
+
+	if this.DashFragment <= 0 {
+		this.DashFragment = SRS_CONF_DEFAULT_DASH_FRAGMENT
+	}
+
+	if this.DashUpdatePeriod <= 0 {
+		this.DashUpdatePeriod = SRS_CONF_DEFAULT_DASH_UPDATE_PERIOD
+	}
+
+	if this.DashTimeshift <= 0 {
+		this.DashTimeshift = SRS_CONF_DEFAULT_DASH_TIMESHIFT
+	}
+
+	if this.DashPath == "" {
+		this.DashPath = SRS_CONF_DEFAULT_DASH_PATH
+	}
+
+	if this.DashMpdFile == "" {
+		this.DashMpdFile = SRS_CONF_DEFAULT_DASH_MPD_FILE
+	}
+
+	if this.DashTemplate == "" {
+		this.DashTemplate = SRS_CONF_DASH_TEMPLATE_NUMBER
+	}
+
+	if this.DashCleanup == "" {
+		this.DashCleanup = "on"
+	}
+}
+
+/**
+* get the dash config of vhost, nil when disabled.
+*/
+func GetDash(vname string) *DashConf {
+	vhost := GetInstance().GetVHost(vname)
+	if vhost == nil || vhost.Dash == nil || vhost.Dash.Enabled != "on" {
+		return nil
+	}
+
+	return vhost.Dash
+}
+
+const SRS_CONF_STORAGE_LOCAL = "local"
+const SRS_CONF_STORAGE_S3 = "s3"
+
+const SRS_CONF_DEFAULT_STORAGE_REGION = "us-east-1"
+const SRS_CONF_DEFAULT_STORAGE_RETRIES = 3
+const SRS_CONF_DEFAULT_STORAGE_MULTIPART_SIZE = 16 // in MB, the part size of S3 is at least 5MB.
+
+/**
+* the storage backend of hls and dvr files, local disk or S3-compatible object storage.
+* for s3, the path of file is mapped to the object key, for example,
+* ./html/live/livestream-1.ts is the object [prefix]/html/live/livestream-1.ts of bucket.
+*/
+type StorageConf struct {
+	Type          string `json:"type"`           //local or s3.
+	Endpoint      string `json:"endpoint"`       //the s3 endpoint, for example, http://127.0.0.1:9000
+	Bucket        string `json:"bucket"`         //the s3 bucket, the path-style url is used.
+	Region        string `json:"region"`         //the region to sign the request.
+	AccessKey     string `json:"access_key"`     //the access key, anonymous when empty.
+	SecretKey     string `json:"secret_key"`     //the secret key.
+	Prefix        string `json:"prefix"`         //the prefix of object key.
+	Retries       int    `json:"retries"`        //the retries of failed request.
+	MultipartSize int    `json:"multipart_size"` //the part size in MB, the larger file is uploaded by multipart.
+}
+
+func (this *StorageConf) amendDefault() {
+	if this.Type == "" {
+		this.Type = SRS_CONF_STORAGE_LOCAL
+	}
+
+	if this.Region == "" {
+		this.Region = SRS_CONF_DEFAULT_STORAGE_REGION
+	}
+
+	if this.Retries <= 0 {
+		this.Retries = SRS_CONF_DEFAULT_STORAGE_RETRIES
+	}
+
+	if this.MultipartSize < 5 {
+		this.MultipartSize = SRS_CONF_DEFAULT_STORAGE_MULTIPART_SIZE
+	}
+}
+
+/**
+* get the s3 storage config of vhost, nil for local disk.
+*/
+func GetStorage(vname string) *StorageConf {
+	vhost := GetInstance().GetVHost(vname)
+	if vhost == nil || vhost.Storage == nil || vhost.Storage.Type != SRS_CONF_STORAGE_S3 {
+		return nil
+	}
+
+	return vhost.Storage
 }
 
 type HttpHooksConf struct {
@@ -504,6 +1114,8 @@ type VHostConf struct {
 	HttpStatic           *HttpStaticConf `json:"http_static"`
 	HttpRemux            *HttpRemuxConf  `json:"http_remux"`
 	Hls                  *HlsConf        `json:"hls"`
+	Dash                 *DashConf       `json:"dash"`
+	Storage              *StorageConf    `json:"storage"`
 	HttpHooks            *HttpHooksConf  `json:"http_hooks"`
 	Publish              *PublishConf    `json:"publish"`
 }
@@ -535,7 +1147,7 @@ func (this *VHostConf) amendDefault() {
 	}
 
 	if this.TimerJitter == "" {
-		this.TimerJitter = "full"
+		this.TimerJitter = SRS_CONF_DEFAULT_TIME_JITTER
 	}
 
 	if this.MixCorrect == "" {
@@ -586,6 +1198,14 @@ func (this *VHostConf) amendDefault() {
 		this.Hls.amendDefault()
 	}
 
+	if this.Dash != nil {
+		this.Dash.amendDefault()
+	}
+
+	if this.Storage != nil {
+		this.Storage.amendDefault()
+	}
+
 	if this.HttpHooks != nil {
 		this.HttpHooks.amendDefault()
 	}
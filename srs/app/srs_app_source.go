@@ -53,6 +53,9 @@ type SrsSource struct {
 
 	consumersMtx 	sync.Mutex
 	consumers 		[]Consumer
+	// whether the publisher is gone, protected by consumersMtx, for
+	// the consumer appended after it never gets the OnUnpublish.
+	unpublished		bool
 	gopCache		*SrsGopCache
 	cacheSHVideo 	*rtmp.SrsRtmpMessage
 	cacheSHAudio 	*rtmp.SrsRtmpMessage
@@ -103,13 +106,21 @@ func NewSrsSource(c *SrsRtmpConn, r *SrsRequest, h ISrsSourceHandler) *SrsSource
 	}
 
 	hlsConsumer := NewSrsHlsConsumer(source, r)
-	if dvrConsumer != nil {
+	if hlsConsumer != nil {
 		source.AppendConsumer(hlsConsumer)
 		go func(){
 			hlsConsumer.ConsumeCycle()
 		}()
 	}
 
+	dashConsumer := NewSrsDashConsumer(source, r)
+	if dashConsumer != nil {
+		source.AppendConsumer(dashConsumer)
+		go func(){
+			dashConsumer.ConsumeCycle()
+		}()
+	}
+
 	source.recvThread = NewSrsRecvThread(c.rtmp, source, 1000)
 	return source
 }
@@ -485,7 +496,19 @@ func (this *SrsSource) CreateConsumer(conn *SrsRtmpConn, ds bool, dm bool, db bo
 }
 
 func (this *SrsSource) AppendConsumer(consumer Consumer) error {
+	return this.appendConsumer(consumer, true)
+}
+
+/**
+* append the consumer and dumps the metadata and sequence headers,
+* @param dg, whether dumps the gop cache.
+*/
+func (this *SrsSource) appendConsumer(consumer Consumer, dg bool) error {
 	this.consumersMtx.Lock()
+	if this.unpublished {
+		this.consumersMtx.Unlock()
+		return errors.New("source " + this.req.GetStreamUrl() + " is unpublished")
+	}
 	this.consumers = append(this.consumers, consumer)
 	this.consumersMtx.Unlock()
 	//todo set queue size
@@ -506,6 +529,10 @@ func (this *SrsSource) AppendConsumer(consumer Consumer) error {
 		consumer.Enqueue(this.cacheSHAudio, false, this.jitterAlgorithm)
 	}
 
+	if !dg {
+		return nil
+	}
+
 	if err := this.gopCache.dump(consumer, false, this.jitterAlgorithm); err != nil {
 		return err
 	}
@@ -522,6 +549,15 @@ func (this *SrsSource) RemoveConsumer(consumer Consumer) {
 	}
 }
 
+/**
+* disconnect the publisher, the publish cycle will quit.
+*/
+func (this *SrsSource) KickPublisher() {
+	if this.conn != nil {
+		this.conn.Close()
+	}
+}
+
 func (this *SrsSource) CyclePublish() error {
 	this.recvThread.Start()
 	this.recvThread.Join()
@@ -531,8 +567,13 @@ func (this *SrsSource) CyclePublish() error {
 
 func (this *SrsSource) StopPublish() {
 	//this.dvr.Close()
-	for i := 0; i < len(this.consumers); i++ {
-		this.consumers[i].OnUnpublish()
+	this.consumersMtx.Lock()
+	this.unpublished = true
+	consumers := append([]Consumer{}, this.consumers...)
+	this.consumersMtx.Unlock()
+
+	for i := 0; i < len(consumers); i++ {
+		consumers[i].OnUnpublish()
 	}
 	this.recvThread.Stop()
 }
@@ -76,9 +76,37 @@ type SrsAvcAacCodec struct {
 	avcExtraData []byte
 	aacExtraData []byte
 
+	// the info of mp3 parsed from the frame header.
+	mp3Version    int // the version id, 3 for MPEG-1, 2 for MPEG-2, 0 for MPEG-2.5.
+	mp3SampleRate int
+	mp3Channels   int
+
 	avcParseSps bool
 }
 
+/**
+* the aac sample rate of samplingFrequencyIndex,
+* @see: Table 1.16 - Sampling Frequency Index, aac-mp4a-format-ISO_IEC_14496-3+2001.pdf, page 35.
+*/
+var aacSampleRates = []int{
+	96000, 88200, 64000, 48000,
+	44100, 32000, 24000, 22050,
+	16000, 12000, 11025, 8000,
+	7350, 0, 0, 0,
+}
+
+// the mp3 version id of frame header.
+const SRS_MP3_VERSION_MPEG25 = 0
+const SRS_MP3_VERSION_MPEG2 = 2
+const SRS_MP3_VERSION_MPEG1 = 3
+
+/**
+* the mp3 sample rate of MPEG-1 by sampling_frequency index,
+* the MPEG-2 is half of it, and the MPEG-2.5 is quarter.
+* @see: ISO_IEC_11172-3, 2.4.2.3 Header.
+*/
+var mp3SampleRates = []int{44100, 48000, 32000, 0}
+
 func NewSrsAvcAacCodec() *SrsAvcAacCodec {
 	return &SrsAvcAacCodec{
 		avcParseSps:   true,
@@ -97,6 +125,7 @@ func NewSrsAvcAacCodec() *SrsAvcAacCodec {
 		aacObject:          codec.SrsAacObjectTypeReserved,
 		aacSampleRateIndex: codec.SRS_AAC_SAMPLE_RATE_UNSET,
 		aacChannels:        0,
+		mp3Version:         -1,
 
 		sequenceParameterSetLength: 0,
 		pictureParameterSetLength:  0,
@@ -113,6 +142,43 @@ func (this *SrsAvcAacCodec) is_aac_codec_ok() bool {
 	return this.aacExtraData != nil && len(this.aacExtraData) > 0
 }
 
+/**
+* the codecs attribute of avc for playlist, for example, avc1.64001f,
+* @see RFC6381, 3.3. ISO Base Media File Format Name Space.
+*/
+func (this *SrsAvcAacCodec) avc_codecs() string {
+	// AVCDecoderConfigurationRecord: configurationVersion, AVCProfileIndication,
+	// profile_compatibility, AVCLevelIndication.
+	if len(this.avcExtraData) < 4 {
+		return ""
+	}
+	return fmt.Sprintf("avc1.%02x%02x%02x", this.avcExtraData[1], this.avcExtraData[2], this.avcExtraData[3])
+}
+
+/**
+* the codecs attribute of audio for playlist, for example, mp4a.40.2 for aac lc.
+*/
+func (this *SrsAvcAacCodec) audio_codecs() string {
+	if this.audioCodecId == codec.SrsCodecAudioMP3 {
+		return "mp4a.40.34"
+	}
+
+	if this.audioCodecId != codec.SrsCodecAudioAAC || this.aacObject == codec.SrsAacObjectTypeReserved {
+		return ""
+	}
+	return fmt.Sprintf("mp4a.40.%d", this.aacObject)
+}
+
+/**
+* the sample rate in HZ of aac, 0 when sequence header not parsed.
+*/
+func (this *SrsAvcAacCodec) aac_sample_rate() int {
+	if this.aacSampleRateIndex < 0 || this.aacSampleRateIndex >= codec.SRS_AAC_SAMPLE_RATE_UNSET {
+		return 0
+	}
+	return aacSampleRates[this.aacSampleRateIndex]
+}
+
 func (this *SrsAvcAacCodec) audio_aac_demux(data []byte, sample *SrsCodecSample) error {
 	sample.SetIsVideo(false)
 
@@ -134,7 +200,7 @@ func (this *SrsAvcAacCodec) audio_aac_demux(data []byte, sample *SrsCodecSample)
 	sample.SoundSize = codec.SrsCodecAudioSampleSize(soundSize)
 
 	if this.audioCodecId == codec.SrsCodecAudioMP3 {
-		return errors.New("error hls try mp3")
+		return this.audio_mp3_demux(stream.ReadLeftBytes(), sample)
 	}
 
 	if this.audioCodecId != codec.SrsCodecAudioAAC {
@@ -154,7 +220,7 @@ func (this *SrsAvcAacCodec) audio_aac_demux(data []byte, sample *SrsCodecSample)
 		}
 	} else if aacPacketType == codec.SrsCodecAudioTypeRawData {
 		if !this.is_aac_codec_ok() {
-			return fmt.Errorf("aac ignore type=%d for no sequence header. ret=%d", aacPacketType)
+			return fmt.Errorf("aac ignore type=%d for no sequence header", aacPacketType)
 		}
 		// Raw AAC frame data in UI8 []
 		// 6.3 Raw Data, aac-iso-13818-7.pdf, page 28
@@ -165,13 +231,6 @@ func (this *SrsAvcAacCodec) audio_aac_demux(data []byte, sample *SrsCodecSample)
 
 	// reset the sample rate by sequence header
 	if this.aacSampleRateIndex != codec.SRS_AAC_SAMPLE_RATE_UNSET {
-		aacSampleRates := []int{
-			96000, 88200, 64000, 48000,
-			44100, 32000, 24000, 22050,
-			16000, 12000, 11025, 8000,
-			7350, 0, 0, 0,
-		}
-
 		switch aacSampleRates[this.aacSampleRateIndex] {
 		case 11025:
 			sample.SoundRate = codec.SrsCodecAudioSampleRate11025
@@ -192,6 +251,61 @@ func (this *SrsAvcAacCodec) audio_aac_demux(data []byte, sample *SrsCodecSample)
 	return nil
 }
 
+/**
+* demux the mp3 frames of flv audio tag, the data is after the flv audio tag header,
+* the mp3 frames is a sample unit, and the codec info is parsed from the frame header.
+*/
+func (this *SrsAvcAacCodec) audio_mp3_demux(data []byte, sample *SrsCodecSample) error {
+	// the flv audio tag header is parsed, mp3 has no sequence header.
+	sample.AacPacketType = codec.SrsCodecAudioTypeRawData
+
+	if len(data) == 0 {
+		return errors.New("mp3 ignore empty frame")
+	}
+
+	if version, sampleRate, channels, ok := srs_mp3_parse_header(data); ok {
+		this.mp3Version = version
+		this.mp3SampleRate = sampleRate
+		this.mp3Channels = channels
+	}
+
+	if err := sample.AddSampleUnit(data); err != nil {
+		return errors.New("mp3 add sample failed.")
+	}
+	return nil
+}
+
+/**
+* parse the mp3 frame header, 11bits syncword, 2bits version, 2bits layer,
+* 1bit protection, 4bits bitrate, 2bits sampling frequency, 1bit padding,
+* 1bit private, 2bits mode, for mode 3 is mono.
+* @return the version, sample rate, channels, and whether the header is valid.
+*/
+func srs_mp3_parse_header(data []byte) (int, int, int, bool) {
+	if len(data) < 4 || data[0] != 0xff || (data[1] & 0xe0) != 0xe0 {
+		return 0, 0, 0, false
+	}
+
+	version := int((data[1] >> 3) & 0x03)
+	sampleRate := mp3SampleRates[(data[2] >> 2) & 0x03]
+	if version == 1 || sampleRate == 0 {
+		return 0, 0, 0, false
+	}
+
+	switch version {
+	case SRS_MP3_VERSION_MPEG2:
+		sampleRate /= 2
+	case SRS_MP3_VERSION_MPEG25:
+		sampleRate /= 4
+	}
+
+	channels := 2
+	if (data[3] >> 6) & 0x03 == 0x03 {
+		channels = 1
+	}
+	return version, sampleRate, channels, true
+}
+
 func (this *SrsAvcAacCodec) audio_aac_sequence_header_demux(data []byte) error {
 	stream := utils.NewSrsStream(data)
 	// only need to decode the first 2bytes:
@@ -602,8 +716,14 @@ func (this *SrsAvcAacCodec) avc_demux_sps_rbsp(rbsp []byte) error {
 				}
 				seq_scaling_list_present_flag = append(seq_scaling_list_present_flag, b)
 				if seq_scaling_list_present_flag[len(seq_scaling_list_present_flag)-1] == 1 {
+					// 7.3.2.1.1.1 Scaling list syntax
+					// H.264-AVC-ISO_IEC_14496-10-2012.pdf, page 63.
+					sizeOfScalingList := 64
 					if i < 6 {
-						//todo scaling_list
+						sizeOfScalingList = 16
+					}
+					if err := this.avc_skip_scaling_list(bs, sizeOfScalingList); err != nil {
+						return err
 					}
 				}
 			}
@@ -686,9 +806,73 @@ func (this *SrsAvcAacCodec) avc_demux_sps_rbsp(rbsp []byte) error {
 		return err
 	}
 
+	frame_mbs_only_flag, err := bs.ReadBit()
+	if err != nil {
+		return err
+	}
+
+	if frame_mbs_only_flag == 0 {
+		mb_adaptive_frame_field_flag, err := bs.ReadBit()
+		if err != nil {
+			return err
+		}
+		_ = mb_adaptive_frame_field_flag
+	}
+
+	direct_8x8_inference_flag, err := bs.ReadBit()
+	if err != nil {
+		return err
+	}
+	_ = direct_8x8_inference_flag
+
+	frame_cropping_flag, err := bs.ReadBit()
+	if err != nil {
+		return err
+	}
+
+	var frame_crop_left_offset, frame_crop_right_offset int32 = 0, 0
+	var frame_crop_top_offset, frame_crop_bottom_offset int32 = 0, 0
+	if frame_cropping_flag == 1 {
+		if frame_crop_left_offset, err = bs.ReadUEV(); err != nil {
+			return err
+		}
+		if frame_crop_right_offset, err = bs.ReadUEV(); err != nil {
+			return err
+		}
+		if frame_crop_top_offset, err = bs.ReadUEV(); err != nil {
+			return err
+		}
+		if frame_crop_bottom_offset, err = bs.ReadUEV(); err != nil {
+			return err
+		}
+	}
+
+	// the crop unit is 2 pixels for 4:2:0, and the height unit doubles for field coding,
+	// @see 7.4.2.1.1 Sequence parameter set data semantics, H.264-AVC-ISO_IEC_14496-10-2012.pdf, page 87.
 	width := (pic_width_in_mbs_minus1 + 1) * 16
-	height := (pic_height_in_map_units_minus1 + 1) * 16
-	_ = width
-	_ = height
+	height := (2 - int32(frame_mbs_only_flag)) * (pic_height_in_map_units_minus1 + 1) * 16
+	width -= (frame_crop_left_offset + frame_crop_right_offset) * 2
+	height -= (frame_crop_top_offset + frame_crop_bottom_offset) * 2 * (2 - int32(frame_mbs_only_flag))
+
+	this.width = int(width)
+	this.height = int(height)
+	return nil
+}
+
+func (this *SrsAvcAacCodec) avc_skip_scaling_list(bs *utils.SrsBitStream, sizeOfScalingList int) error {
+	var lastScale int32 = 8
+	var nextScale int32 = 8
+	for j := 0; j < sizeOfScalingList; j++ {
+		if nextScale != 0 {
+			delta_scale, err := bs.ReadSEV()
+			if err != nil {
+				return err
+			}
+			nextScale = (lastScale + delta_scale + 256) % 256
+		}
+		if nextScale != 0 {
+			lastScale = nextScale
+		}
+	}
 	return nil
 }
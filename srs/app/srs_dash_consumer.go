@@ -0,0 +1,190 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 GOSRS(gosrs)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package app
+
+import (
+	"fmt"
+	"go_srs/srs/app/config"
+	"go_srs/srs/protocol/rtmp"
+	"go_srs/srs/codec"
+)
+
+/**
+* the dash consumer, demux the rtmp messages to fMP4 samples for dash muxer.
+*/
+type SrsDashConsumer struct {
+	source          *SrsSource
+	req 			*SrsRequest
+	conf 			*config.DashConf
+	queue           *SrsMessageQueue
+	codec    		*SrsAvcAacCodec
+	sample   		*SrsCodecSample
+	muxer    		*SrsDashMuxer
+	jitter			*SrsRtmpJitter
+	jitterAlgorithm	SrsRtmpJitterAlgorithm // the time_jitter of vhost.
+}
+
+/**
+* create the dash consumer, nil when dash is disabled for vhost.
+*/
+func NewSrsDashConsumer(s *SrsSource, req *SrsRequest) *SrsDashConsumer {
+	conf := config.GetDash(req.vhost)
+	if conf == nil {
+		return nil
+	}
+
+	return &SrsDashConsumer{
+		source:s,
+		req:req,
+		conf:conf,
+		queue:NewSrsMessageQueue(),
+		codec:NewSrsAvcAacCodec(),
+		sample:NewSrsCodecSample(),
+		muxer:NewSrsDashMuxer(),
+	}
+}
+
+func (this *SrsDashConsumer) OnPublish() error {
+	this.jitter = NewSrsRtmpJitter()
+	this.jitterAlgorithm = SrsTimeJitterString2Int(config.GetTimeJitter(this.req.vhost))
+	return this.muxer.on_publish(this.req, this.conf)
+}
+
+func (this *SrsDashConsumer) OnUnpublish() error {
+	return this.muxer.on_unpublish()
+}
+
+func (this *SrsDashConsumer) ConsumeCycle() error {
+	for {
+		msg, err := this.queue.Wait()
+		if err != nil {
+			return err
+		}
+
+		if msg != nil {
+			if msg.GetHeader().IsVideo() {
+				if err := this.onVideo(msg); err != nil {
+					fmt.Println("dash: write video failed, stream=", this.req.stream, "err=", err)
+				}
+			} else if msg.GetHeader().IsAudio() {
+				if err := this.onAudio(msg); err != nil {
+					fmt.Println("dash: write audio failed, stream=", this.req.stream, "err=", err)
+				}
+			}
+		}
+	}
+}
+
+func (this *SrsDashConsumer) onVideo(video *rtmp.SrsRtmpMessage) error {
+	this.sample.Clear()
+	err := this.codec.video_avc_demux(video.GetPayload(), this.sample)
+	if err != nil {
+		return err
+	}
+
+	if this.sample.FrameType == codec.SrsCodecVideoAVCFrameVideoInfoFrame {
+		return nil
+	}
+
+	if this.codec.videoCodecId != codec.SrsCodecVideoAVC {
+		return nil
+	}
+
+	if this.sample.FrameType == codec.SrsCodecVideoAVCFrameKeyFrame && this.sample.AvcPacketType == codec.SrsCodecVideoAVCTypeSequenceHeader {
+		return this.muxer.on_sequence_header(this.codec)
+	}
+
+	data := mp4_avcc_sample(this.sample)
+	if len(data) == 0 {
+		return nil
+	}
+
+	dts := this.correctTimestamp(video.GetHeader().GetTimestamp())
+	return this.muxer.on_video(&SrsMp4Sample{
+		dts:      dts,
+		pts:      dts + int64(this.sample.Cts)*90,
+		keyframe: this.sample.FrameType == codec.SrsCodecVideoAVCFrameKeyFrame,
+		data:     data,
+	})
+}
+
+func (this *SrsDashConsumer) onAudio(audio *rtmp.SrsRtmpMessage) error {
+	this.sample.Clear()
+	err := this.codec.audio_aac_demux(audio.GetPayload(), this.sample)
+	if err != nil {
+		return err
+	}
+
+	// only aac is supported by dash.
+	if codec.SrsCodecAudio(this.codec.audioCodecId) != codec.SrsCodecAudioAAC {
+		return nil
+	}
+
+	if this.sample.AacPacketType == codec.SrsCodecAudioTypeSequenceHeader {
+		return this.muxer.on_sequence_header(this.codec)
+	}
+
+	data := make([]byte, 0)
+	for _, frame := range this.sample.SampleUnits {
+		data = append(data, frame...)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	dts := this.correctTimestamp(audio.GetHeader().GetTimestamp())
+	return this.muxer.on_audio(&SrsMp4Sample{
+		dts:      dts,
+		pts:      dts,
+		keyframe: true,
+		data:     data,
+	})
+}
+
+/**
+* correct the timestamp by time_jitter and unwrap the 32bits rollover,
+* for the dts of SegmentTimeline and tfdt must be monotonic.
+* @return the dts in 90khz.
+*/
+func (this *SrsDashConsumer) correctTimestamp(timestamp int64) int64 {
+	if this.jitter == nil {
+		this.jitter = NewSrsRtmpJitter()
+	}
+
+	ts := this.jitter.CorrectTimestamp(timestamp, this.jitterAlgorithm)
+	return int64(ts) * 90
+}
+
+func (this *SrsDashConsumer) StopConsume() error {
+	this.source.RemoveConsumer(this)
+	this.queue.Break()
+	return nil
+}
+
+func (this *SrsDashConsumer) OnRecvError(err error) {
+	this.StopConsume()
+}
+
+func (this *SrsDashConsumer) Enqueue(msg *rtmp.SrsRtmpMessage, atc bool, jitterAlgorithm *SrsRtmpJitterAlgorithm) {
+	this.queue.Enqueue(msg)
+}
@@ -0,0 +1,361 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 GOSRS(gosrs)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package app
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"go_srs/srs/app/config"
+	"go_srs/srs/utils"
+)
+
+const SRS_DASH_TRACK_VIDEO = "video"
+const SRS_DASH_TRACK_AUDIO = "audio"
+
+/**
+* the media segment of a dash track.
+*/
+type SrsDashSegment struct {
+	number   int
+	time     int64 // the start time in timescale.
+	duration int64 // the duration in timescale.
+	size     int64
+	path     string
+}
+
+/**
+* a track of dash, the init segment and media segments of it.
+*/
+type SrsDashTrack struct {
+	name          string
+	track_id      uint32
+	samples       []*SrsMp4Sample
+	segments      []*SrsDashSegment
+	number        int    // the number of next segment.
+	sequence      uint32 // the sequence of moof.
+	last_duration uint32 // the duration of previous sample.
+}
+
+func NewSrsDashTrack(name string, track_id uint32, default_duration uint32) *SrsDashTrack {
+	return &SrsDashTrack{
+		name:          name,
+		track_id:      track_id,
+		number:        1,
+		sequence:      1,
+		last_duration: default_duration,
+	}
+}
+
+func (this *SrsDashTrack) write_sample(sample *SrsMp4Sample) {
+	if n := len(this.samples); n > 0 && sample.dts > this.samples[n-1].dts {
+		this.last_duration = uint32(sample.dts - this.samples[n-1].dts)
+		this.samples[n-1].duration = this.last_duration
+	}
+	sample.duration = this.last_duration
+	this.samples = append(this.samples, sample)
+}
+
+/**
+* the duration in timescale of the gathered samples.
+*/
+func (this *SrsDashTrack) duration() int64 {
+	if len(this.samples) == 0 {
+		return 0
+	}
+	return this.samples[len(this.samples)-1].dts - this.samples[0].dts
+}
+
+/**
+* the bandwidth in bits per second of the segments in window.
+*/
+func (this *SrsDashTrack) bandwidth() int {
+	var size, duration int64
+	for _, s := range this.segments {
+		size += s.size
+		duration += s.duration
+	}
+
+	if duration <= 0 {
+		return 0
+	}
+	return int(size * 8 * SRS_MP4_TIMESCALE / duration)
+}
+
+/**
+* the dash muxer, write the fMP4 segments of each track and the dynamic mpd,
+* @see: ISO_IEC_23009-1, Dynamic adaptive streaming over HTTP (DASH).
+*/
+type SrsDashMuxer struct {
+	req           *SrsRequest
+	fragment      float64
+	update_period float64
+	timeshift     float64
+	template      string
+	cleanup       bool
+	mpd           string // the full path of mpd.
+	home          string // the dir of mpd, where the segments are written.
+	storage       SrsStorage
+	video         *SrsDashTrack
+	audio         *SrsDashTrack
+	codec         *SrsAvcAacCodec
+	// the wall clock of time zero of the tracks.
+	availability_start_time time.Time
+}
+
+func NewSrsDashMuxer() *SrsDashMuxer {
+	return &SrsDashMuxer{}
+}
+
+func (this *SrsDashMuxer) on_publish(req *SrsRequest, conf *config.DashConf) error {
+	this.req = req
+	this.fragment = conf.DashFragment
+	this.update_period = conf.DashUpdatePeriod
+	this.timeshift = conf.DashTimeshift
+	this.template = conf.DashTemplate
+	this.cleanup = conf.DashCleanup == "on"
+
+	mpd := utils.Srs_path_build_stream(conf.DashMpdFile, req.vhost, req.app, req.stream)
+	this.mpd = conf.DashPath + "/" + mpd
+	this.home = path.Dir(this.mpd)
+
+	this.video = NewSrsDashTrack(SRS_DASH_TRACK_VIDEO, SRS_MP4_VIDEO_TRACK_ID, SRS_FMP4_DEFAULT_VIDEO_DURATION)
+	this.audio = NewSrsDashTrack(SRS_DASH_TRACK_AUDIO, SRS_MP4_AUDIO_TRACK_ID, SRS_FMP4_DEFAULT_AUDIO_DURATION)
+	this.availability_start_time = time.Time{}
+	this.storage = NewSrsStorage(req.vhost)
+	return nil
+}
+
+func (this *SrsDashMuxer) on_unpublish() error {
+	if this.video == nil {
+		return nil
+	}
+
+	if err := this.reap(); err != nil {
+		return err
+	}
+	return this.refresh_mpd()
+}
+
+/**
+* the file of track, for example, livestream-video-init.mp4 or livestream-video-$Number$.m4s
+*/
+func (this *SrsDashMuxer) file_name(track *SrsDashTrack, suffix string) string {
+	return this.req.stream + "-" + track.name + "-" + suffix
+}
+
+func (this *SrsDashMuxer) media_template() string {
+	if this.template == config.SRS_CONF_DASH_TEMPLATE_TIME {
+		return "$Time$.m4s"
+	}
+	return "$Number$.m4s"
+}
+
+/**
+* write the init segment of the track with sequence header.
+*/
+func (this *SrsDashMuxer) on_sequence_header(c *SrsAvcAacCodec) error {
+	this.codec = c
+
+	if c.is_avc_codec_ok() {
+		if err := this.write_file(this.file_name(this.video, "init.mp4"), mp4_init_segment(c, true, false)); err != nil {
+			return err
+		}
+	}
+
+	if c.is_aac_codec_ok() {
+		if err := this.write_file(this.file_name(this.audio, "init.mp4"), mp4_init_segment(c, false, true)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *SrsDashMuxer) write_file(file string, data []byte) error {
+	return this.storage.WriteFile(this.home + "/" + file, data)
+}
+
+func (this *SrsDashMuxer) on_first_sample(dts int64) {
+	if this.availability_start_time.IsZero() {
+		offset := time.Duration(dts * int64(time.Millisecond) / 90)
+		this.availability_start_time = time.Now().Add(-offset)
+	}
+}
+
+/**
+* write the video sample, reap the segments at keyframe when fragment is overflow.
+*/
+func (this *SrsDashMuxer) on_video(sample *SrsMp4Sample) error {
+	this.on_first_sample(sample.dts)
+
+	if sample.keyframe && float64(this.video.duration()) / SRS_MP4_TIMESCALE >= this.fragment {
+		if err := this.reap(); err != nil {
+			return err
+		}
+	}
+
+	this.video.write_sample(sample)
+	return nil
+}
+
+/**
+* write the audio sample, reap the segments by audio for pure audio.
+*/
+func (this *SrsDashMuxer) on_audio(sample *SrsMp4Sample) error {
+	this.on_first_sample(sample.dts)
+
+	pure_audio := this.codec == nil || !this.codec.is_avc_codec_ok()
+	if pure_audio && float64(this.audio.duration()) / SRS_MP4_TIMESCALE >= this.fragment {
+		if err := this.reap(); err != nil {
+			return err
+		}
+	}
+
+	this.audio.write_sample(sample)
+	return nil
+}
+
+/**
+* write the gathered samples of tracks as segments, and refresh the mpd.
+*/
+func (this *SrsDashMuxer) reap() error {
+	for _, track := range []*SrsDashTrack{this.video, this.audio} {
+		if err := this.reap_track(track); err != nil {
+			return err
+		}
+	}
+	return this.refresh_mpd()
+}
+
+func (this *SrsDashMuxer) reap_track(track *SrsDashTrack) error {
+	if len(track.samples) == 0 {
+		return nil
+	}
+
+	var video, audio []*SrsMp4Sample
+	if track == this.video {
+		video = track.samples
+	} else {
+		audio = track.samples
+	}
+	data := mp4_fragment(track.sequence, video, audio)
+	track.sequence++
+
+	segment := &SrsDashSegment{
+		number: track.number,
+		time:   track.samples[0].dts,
+		size:   int64(len(data)),
+	}
+	for _, s := range track.samples {
+		segment.duration += int64(s.duration)
+	}
+	track.number++
+	track.samples = nil
+
+	// the name of segment by $Number$ or $Time$.
+	name := strings.Replace(this.media_template(), "$Number$", strconv.Itoa(segment.number), -1)
+	name = strings.Replace(name, "$Time$", strconv.FormatInt(segment.time, 10), -1)
+	segment.path = this.home + "/" + this.file_name(track, name)
+	if err := this.write_file(this.file_name(track, name), data); err != nil {
+		return err
+	}
+	track.segments = append(track.segments, segment)
+
+	// shrink the segments out of timeshift.
+	var duration int64
+	remove := 0
+	for i := len(track.segments) - 1; i >= 0; i-- {
+		duration += track.segments[i].duration
+		if float64(duration) / SRS_MP4_TIMESCALE > this.timeshift {
+			remove = i + 1
+			break
+		}
+	}
+	for _, s := range track.segments[:remove] {
+		if !this.cleanup {
+			continue
+		}
+		if err := this.storage.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			fmt.Println("dash: remove segment failed, err=", err)
+		}
+	}
+	track.segments = track.segments[remove:]
+	return nil
+}
+
+func srs_dash_duration(seconds float64) string {
+	return "PT" + strconv.FormatFloat(seconds, 'f', 3, 64) + "S"
+}
+
+/**
+* write the dynamic mpd, the segments are described by SegmentTimeline.
+*/
+func (this *SrsDashMuxer) refresh_mpd() error {
+	if len(this.video.segments) == 0 && len(this.audio.segments) == 0 {
+		return nil
+	}
+
+	var b strings.Builder
+	b.WriteString("<?xml version=\"1.0\" encoding=\"utf-8\"?>\n")
+	b.WriteString("<MPD xmlns=\"urn:mpeg:dash:schema:mpd:2011\" profiles=\"urn:mpeg:dash:profile:isoff-live:2011\"\n")
+	b.WriteString("    type=\"dynamic\" minimumUpdatePeriod=\"" + srs_dash_duration(this.update_period) + "\"\n")
+	b.WriteString("    timeShiftBufferDepth=\"" + srs_dash_duration(this.timeshift) + "\"\n")
+	b.WriteString("    availabilityStartTime=\"" + this.availability_start_time.UTC().Format(time.RFC3339) + "\"\n")
+	b.WriteString("    publishTime=\"" + time.Now().UTC().Format(time.RFC3339) + "\"\n")
+	b.WriteString("    minBufferTime=\"" + srs_dash_duration(this.fragment) + "\">\n")
+	b.WriteString("    <Period id=\"0\" start=\"PT0S\">\n")
+
+	if len(this.video.segments) > 0 && this.codec != nil {
+		attrs := "codecs=\"" + this.codec.avc_codecs() + "\" width=\"" + strconv.Itoa(this.codec.width) + "\" height=\"" + strconv.Itoa(this.codec.height) + "\""
+		this.write_adaptation_set(&b, this.video, "video/mp4", attrs)
+	}
+	if len(this.audio.segments) > 0 && this.codec != nil {
+		attrs := "codecs=\"" + this.codec.audio_codecs() + "\" audioSamplingRate=\"" + strconv.Itoa(this.codec.aac_sample_rate()) + "\""
+		this.write_adaptation_set(&b, this.audio, "audio/mp4", attrs)
+	}
+
+	b.WriteString("    </Period>\n")
+	b.WriteString("</MPD>\n")
+
+	return this.storage.WriteFile(this.mpd, []byte(b.String()))
+}
+
+func (this *SrsDashMuxer) write_adaptation_set(b *strings.Builder, track *SrsDashTrack, mime string, attrs string) {
+	b.WriteString("        <AdaptationSet mimeType=\"" + mime + "\" segmentAlignment=\"true\" startWithSAP=\"1\">\n")
+	b.WriteString("            <Representation id=\"" + track.name + "\" bandwidth=\"" + strconv.Itoa(track.bandwidth()) + "\" " + attrs + ">\n")
+	b.WriteString("                <SegmentTemplate timescale=\"" + strconv.Itoa(SRS_MP4_TIMESCALE) + "\"")
+	b.WriteString(" initialization=\"" + this.file_name(track, "init.mp4") + "\"")
+	b.WriteString(" media=\"" + this.file_name(track, this.media_template()) + "\"")
+	b.WriteString(" startNumber=\"" + strconv.Itoa(track.segments[0].number) + "\">\n")
+	b.WriteString("                    <SegmentTimeline>\n")
+	for _, s := range track.segments {
+		b.WriteString("                        <S t=\"" + strconv.FormatInt(s.time, 10) + "\" d=\"" + strconv.FormatInt(s.duration, 10) + "\"/>\n")
+	}
+	b.WriteString("                    </SegmentTimeline>\n")
+	b.WriteString("                </SegmentTemplate>\n")
+	b.WriteString("            </Representation>\n")
+	b.WriteString("        </AdaptationSet>\n")
+}
@@ -0,0 +1,362 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 GOSRS(gosrs)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+	"go_srs/srs/app/config"
+	"go_srs/srs/codec/flv"
+	"go_srs/srs/global"
+	"go_srs/srs/protocol/rtmp"
+	"go_srs/srs/utils"
+)
+
+/**
+* the dvr consumer started by http api, when dvr_plan is api,
+* to record the specified stream at runtime.
+*/
+type SrsApiDvrConsumer struct {
+	source			*SrsSource
+	req				*SrsRequest
+	queue			*SrsMessageQueue
+	plan			SrsDvrPlan
+	planName		string
+	startTime		time.Time
+	// protect the plan, which is written by consume cycle and closed by api.
+	mtx				sync.Mutex
+	closed			bool
+	// whether got the keyframe, the recording always starts at keyframe.
+	hasKeyFrame		bool
+	// whether the stream has video, captured when started and updated by the consume cycle.
+	hasVideo		bool
+}
+
+// the active recordings, the key is the stream url.
+var dvrApiPoolMtx sync.Mutex
+var dvrApiPool map[string]*SrsApiDvrConsumer
+
+func init() {
+	dvrApiPool = make(map[string]*SrsApiDvrConsumer)
+}
+
+func NewSrsApiDvrConsumer(s *SrsSource, planName string) (*SrsApiDvrConsumer, error) {
+	var plan SrsDvrPlan
+	if planName == "" || planName == config.SRS_CONF_DEFAULT_DVR_PLAN_SESSION {
+		planName = config.SRS_CONF_DEFAULT_DVR_PLAN_SESSION
+		plan = NewSrsSessionDvrPlan(s.req)
+	} else if planName == config.SRS_CONF_DEFAULT_DVR_PLAN_SEGMENT {
+		plan = NewSrsSegmentDvrPlan(s.req)
+	} else {
+		return nil, errors.New("dvr plan " + planName + " not supported by api")
+	}
+
+	return &SrsApiDvrConsumer{
+		source:s,
+		req:s.req,
+		queue:NewSrsMessageQueue(),
+		plan:plan,
+		planName:planName,
+		hasVideo:s.cacheSHVideo != nil,
+	}, nil
+}
+
+/**
+* start to record the stream.
+* @param preroll, whether dumps the gop cache, the recording begins at the
+*		keyframe of gop cache, otherwise begins at the next keyframe.
+*/
+func StartApiDvr(vhost string, app string, stream string, planName string, preroll bool) (*SrsApiDvrConsumer, error) {
+	if config.GetDvrPlan(vhost) != config.SRS_CONF_DEFAULT_DVR_PLAN_API {
+		return nil, errors.New("dvr plan of vhost " + vhost + " is not api")
+	}
+
+	url := utils.SrsGenerateStreamUrl(vhost, app, stream)
+	sourcePoolMtx.Lock()
+	source, ok := sourcePool[url]
+	sourcePoolMtx.Unlock()
+	if !ok {
+		return nil, errors.New("stream " + url + " not found")
+	}
+
+	dvrApiPoolMtx.Lock()
+	defer dvrApiPoolMtx.Unlock()
+	if _, ok := dvrApiPool[url]; ok {
+		return nil, errors.New("stream " + url + " is recording")
+	}
+
+	consumer, err := NewSrsApiDvrConsumer(source, planName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := consumer.OnPublish(); err != nil {
+		return nil, err
+	}
+
+	// the publisher may leave after the source found, the plan is closed
+	// here for the source never calls OnUnpublish of the consumer.
+	if err := source.appendConsumer(consumer, preroll); err != nil {
+		consumer.stop(true)
+		return nil, err
+	}
+
+	dvrApiPool[url] = consumer
+	go func() {
+		consumer.ConsumeCycle()
+	}()
+	fmt.Println("dvr: api start url=", url, "plan=", consumer.planName, "preroll=", preroll, "file=", consumer.plan.Path())
+	return consumer, nil
+}
+
+/**
+* stop to record the stream, the file is closed and the on_dvr is called.
+*/
+func StopApiDvr(vhost string, app string, stream string) error {
+	url := utils.SrsGenerateStreamUrl(vhost, app, stream)
+
+	dvrApiPoolMtx.Lock()
+	consumer, ok := dvrApiPool[url]
+	delete(dvrApiPool, url)
+	dvrApiPoolMtx.Unlock()
+	if !ok {
+		return errors.New("stream " + url + " is not recording")
+	}
+
+	fmt.Println("dvr: api stop url=", url, "file=", consumer.plan.Path())
+	return consumer.stop(true)
+}
+
+type SrsApiDvrInfo struct {
+	Vhost		string	`json:"vhost"`
+	App			string	`json:"app"`
+	Stream		string	`json:"stream"`
+	Plan		string	`json:"plan"`
+	File		string	`json:"file"`
+	StartTime	int64	`json:"start_time"` // in ms.
+	Duration	float64	`json:"duration"` // in seconds.
+}
+
+/**
+* list the active recordings.
+*/
+func ListApiDvr() []SrsApiDvrInfo {
+	dvrApiPoolMtx.Lock()
+	defer dvrApiPoolMtx.Unlock()
+
+	infos := make([]SrsApiDvrInfo, 0, len(dvrApiPool))
+	for _, c := range dvrApiPool {
+		c.mtx.Lock()
+		infos = append(infos, SrsApiDvrInfo{
+			Vhost:c.req.vhost,
+			App:c.req.app,
+			Stream:c.req.stream,
+			Plan:c.planName,
+			File:c.plan.Path(),
+			StartTime:c.startTime.UnixNano() / int64(time.Millisecond),
+			Duration:time.Since(c.startTime).Seconds(),
+		})
+		c.mtx.Unlock()
+	}
+	return infos
+}
+
+func (this *SrsApiDvrConsumer) OnPublish() error {
+	this.startTime = time.Now()
+	return this.plan.OnPublish()
+}
+
+/**
+* when the stream unpublished, the recording is done.
+*/
+func (this *SrsApiDvrConsumer) OnUnpublish() error {
+	url := this.req.GetStreamUrl()
+	dvrApiPoolMtx.Lock()
+	if c, ok := dvrApiPool[url]; ok && c == this {
+		delete(dvrApiPool, url)
+	}
+	dvrApiPoolMtx.Unlock()
+
+	// the source is unpublishing, it will drop all consumers.
+	return this.stop(false)
+}
+
+/**
+* close the plan and break the consume cycle.
+* @param remove, whether remove from the source.
+*/
+func (this *SrsApiDvrConsumer) stop(remove bool) error {
+	if remove {
+		this.source.RemoveConsumer(this)
+	}
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	if this.closed {
+		return nil
+	}
+	this.closed = true
+	this.queue.Break()
+	return this.plan.OnUnpublish()
+}
+
+func (this *SrsApiDvrConsumer) ConsumeCycle() error {
+	for {
+		msg, err := this.queue.Wait()
+		if err != nil {
+			return err
+		}
+
+		if msg == nil {
+			continue
+		}
+
+		if err := this.write(msg); err != nil {
+			fmt.Println("dvr: api write failed, url=", this.req.GetStreamUrl(), "err=", err)
+			StopApiDvr(this.req.vhost, this.req.app, this.req.stream)
+			return err
+		}
+	}
+}
+
+func (this *SrsApiDvrConsumer) write(msg *rtmp.SrsRtmpMessage) error {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	if this.closed {
+		return nil
+	}
+
+	if msg.GetHeader().IsVideo() {
+		if flvcodec.VideoIsSequenceHeader(msg.GetPayload()) {
+			this.hasVideo = true
+			return this.plan.OnVideo(msg)
+		}
+		// drop the frames before the first keyframe.
+		if !this.hasKeyFrame {
+			if !flvcodec.VideoIsKeyFrame(msg.GetPayload()) {
+				return nil
+			}
+			this.hasKeyFrame = true
+		}
+		return this.plan.OnVideo(msg)
+	} else if msg.GetHeader().IsAudio() {
+		// for stream with video, drop the audio before the first keyframe.
+		if !this.hasKeyFrame && this.hasVideo && !flvcodec.AudioIsSequenceHeader(msg.GetPayload()) {
+			return nil
+		}
+		return this.plan.OnAudio(msg)
+	}
+	return this.plan.OnMetaData(msg)
+}
+
+func (this *SrsApiDvrConsumer) StopConsume() error {
+	return this.stop(true)
+}
+
+func (this *SrsApiDvrConsumer) OnRecvError(err error) {
+	this.StopConsume()
+}
+
+func (this *SrsApiDvrConsumer) Enqueue(msg *rtmp.SrsRtmpMessage, atc bool, jitterAlgorithm *SrsRtmpJitterAlgorithm) {
+	this.queue.Enqueue(msg)
+}
+
+/**
+* the http api of dvr, mount at /api/v1/dvr
+*		GET, list the active recordings.
+*		POST ?action=start&app=live&stream=livestream[&vhost=][&plan=session|segment][&preroll=on]
+*		POST ?action=stop&app=live&stream=livestream[&vhost=]
+*/
+type SrsDvrApiServer struct {
+}
+
+func NewSrsDvrApiServer() *SrsDvrApiServer {
+	return &SrsDvrApiServer{}
+}
+
+type SrsDvrApiResponse struct {
+	Code	int				`json:"code"`
+	Error	string			`json:"error,omitempty"`
+	Dvrs	[]SrsApiDvrInfo	`json:"dvrs,omitempty"`
+}
+
+func (this *SrsDvrApiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		this.response(w, http.StatusOK, &SrsDvrApiResponse{Dvrs:ListApiDvr()})
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		this.response(w, http.StatusMethodNotAllowed, &SrsDvrApiResponse{Code:http.StatusMethodNotAllowed, Error:"method not allowed"})
+		return
+	}
+
+	q := r.URL.Query()
+	vhost := q.Get("vhost")
+	if vhost == "" {
+		vhost = global.SRS_CONSTS_RTMP_DEFAULT_VHOST
+	}
+	app, stream := q.Get("app"), q.Get("stream")
+	if app == "" || stream == "" {
+		this.response(w, http.StatusBadRequest, &SrsDvrApiResponse{Code:http.StatusBadRequest, Error:"app and stream required"})
+		return
+	}
+
+	var err error
+	switch q.Get("action") {
+	case "start":
+		var c *SrsApiDvrConsumer
+		if c, err = StartApiDvr(vhost, app, stream, q.Get("plan"), q.Get("preroll") == "on"); err == nil {
+			this.response(w, http.StatusOK, &SrsDvrApiResponse{Dvrs:[]SrsApiDvrInfo{{
+				Vhost:vhost, App:app, Stream:stream, Plan:c.planName, File:c.plan.Path(),
+				StartTime:c.startTime.UnixNano() / int64(time.Millisecond),
+			}}})
+			return
+		}
+	case "stop":
+		if err = StopApiDvr(vhost, app, stream); err == nil {
+			this.response(w, http.StatusOK, &SrsDvrApiResponse{})
+			return
+		}
+	default:
+		err = errors.New("invalid action, should be start or stop")
+	}
+
+	this.response(w, http.StatusBadRequest, &SrsDvrApiResponse{Code:http.StatusBadRequest, Error:err.Error()})
+}
+
+func (this *SrsDvrApiServer) response(w http.ResponseWriter, status int, res *SrsDvrApiResponse) {
+	body, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
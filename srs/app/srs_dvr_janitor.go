@@ -0,0 +1,283 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 GOSRS(gosrs)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"go_srs/srs/app/config"
+)
+
+/**
+* the files being written by dvr, never deleted by janitor.
+*/
+var dvrWritingFiles = make(map[string]int)
+var dvrWritingFilesMtx sync.Mutex
+
+/**
+* mark the file is being written, when the segment opened.
+*/
+func srs_dvr_writing_add(file string) {
+	dvrWritingFilesMtx.Lock()
+	defer dvrWritingFilesMtx.Unlock()
+	dvrWritingFiles[filepath.Clean(file)]++
+}
+
+/**
+* mark the file is finalised, when the segment closed.
+*/
+func srs_dvr_writing_remove(file string) {
+	dvrWritingFilesMtx.Lock()
+	defer dvrWritingFilesMtx.Unlock()
+
+	file = filepath.Clean(file)
+	if dvrWritingFiles[file]--; dvrWritingFiles[file] <= 0 {
+		delete(dvrWritingFiles, file)
+	}
+}
+
+func srs_dvr_is_writing(file string) bool {
+	dvrWritingFilesMtx.Lock()
+	defer dvrWritingFilesMtx.Unlock()
+	return dvrWritingFiles[file] > 0
+}
+
+/**
+* start the janitor for each vhost which dvr to local disk,
+* and dvr_max_age or dvr_max_bytes is configured.
+*/
+func SrsDvrJanitorStart() {
+	for vhost, conf := range config.GetInstance().VHosts {
+		if conf.Enabled != "on" || conf.Dvr == nil || conf.Dvr.Enabled != "on" {
+			continue
+		}
+		if config.GetStorage(vhost) != nil {
+			continue
+		}
+
+		janitor := NewSrsDvrJanitor(vhost)
+		if janitor.maxAge <= 0 && janitor.maxBytes <= 0 {
+			continue
+		}
+		if dir := janitor.overlaps(); dir != "" {
+			fmt.Println("dvr: janitor disabled, vhost=", vhost, "the dvr dir overlaps the hls or dash dir=", dir)
+			continue
+		}
+		go janitor.Cycle()
+	}
+}
+
+/**
+* the recorded file of dvr, to delete by janitor.
+*/
+type SrsDvrJanitorFile struct {
+	path	string
+	size	int64
+	modTime	time.Time
+	writing	bool
+}
+
+/**
+* the janitor of vhost, delete the oldest finalised dvr files,
+* when older than dvr_max_age, or the total size exceed dvr_max_bytes.
+*/
+type SrsDvrJanitor struct {
+	vhost		string
+	maxAge		time.Duration
+	maxBytes	int64
+	interval	time.Duration
+}
+
+func NewSrsDvrJanitor(vhost string) *SrsDvrJanitor {
+	return &SrsDvrJanitor{
+		vhost:vhost,
+		maxAge:time.Duration(config.GetDvrMaxAge(vhost)) * time.Second,
+		maxBytes:config.GetDvrMaxBytes(vhost),
+		interval:time.Duration(config.GetDvrCleanupInterval(vhost)) * time.Second,
+	}
+}
+
+func (this *SrsDvrJanitor) Cycle() {
+	fmt.Println("dvr: janitor start, vhost=", this.vhost, "max_age=", this.maxAge, "max_bytes=", this.maxBytes, "interval=", this.interval)
+	GetSrsStatistic().OnDvrQuota(this.vhost, this.maxAge, this.maxBytes)
+	for {
+		if err := this.Cleanup(); err != nil {
+			fmt.Println("dvr: janitor failed, vhost=", this.vhost, "err=", err)
+		}
+		time.Sleep(this.interval)
+	}
+}
+
+/**
+* scan the dvr tree of vhost, delete the expired files, then the oldest files
+* until the usage not exceed the quota, and update the usage to statistic.
+*/
+func (this *SrsDvrJanitor) Cleanup() error {
+	files, root, err := this.scan()
+	if err != nil {
+		return err
+	}
+
+	var usage int64
+	for _, f := range files {
+		usage += f.size
+	}
+
+	var deleted int
+	var deletedBytes int64
+	now := time.Now()
+	for _, f := range files {
+		if f.writing {
+			continue
+		}
+
+		var reason string
+		if this.maxAge > 0 && now.Sub(f.modTime) > this.maxAge {
+			reason = "expired"
+		} else if this.maxBytes > 0 && usage > this.maxBytes {
+			reason = "quota"
+		} else {
+			continue
+		}
+
+		if err := os.Remove(f.path); err != nil {
+			fmt.Println("dvr: janitor remove failed, file=", f.path, "err=", err)
+			continue
+		}
+		fmt.Println("dvr: janitor remove", reason, "file=", f.path, "size=", f.size, "modified=", f.modTime.Format(time.RFC3339), "usage=", usage - f.size)
+		this.removeEmptyDirs(filepath.Dir(f.path), root)
+
+		usage -= f.size
+		deleted++
+		deletedBytes += f.size
+	}
+
+	GetSrsStatistic().OnDvrUsage(this.vhost, len(files) - deleted, usage, deleted, deletedBytes)
+	return nil
+}
+
+/**
+* the hls or dash path of any vhost which overlaps the dvr dir, whose files
+* maybe deleted by janitor, empty if no overlap.
+*/
+func (this *SrsDvrJanitor) overlaps() string {
+	_, root := srs_dvr_path_patterns(this.vhost)
+
+	dirs := make([]string, 0)
+	for _, conf := range config.GetInstance().VHosts {
+		if conf.Enabled != "on" {
+			continue
+		}
+		if conf.Hls != nil && conf.Hls.Enabled == "on" {
+			dirs = append(dirs, conf.Hls.HlsPath)
+		}
+		if conf.Dash != nil && conf.Dash.Enabled == "on" {
+			dirs = append(dirs, conf.Dash.DashPath)
+		}
+	}
+
+	for _, dir := range dirs {
+		if srs_path_overlaps(root, dir) {
+			return dir
+		}
+	}
+	return ""
+}
+
+/**
+* whether the dir is the same as or in the other.
+*/
+func srs_path_overlaps(a string, b string) bool {
+	a, erra := filepath.Abs(a)
+	b, errb := filepath.Abs(b)
+	if erra != nil || errb != nil {
+		return true
+	}
+
+	inside := func(from string, to string) bool {
+		rel, err := filepath.Rel(from, to)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".." + string(filepath.Separator))
+	}
+	return inside(a, b) || inside(b, a)
+}
+
+/**
+* list the dvr files of vhost, the oldest first, the tmp files are counted
+* in usage but never deleted while being written.
+*/
+func (this *SrsDvrJanitor) scan() ([]*SrsDvrJanitorFile, string, error) {
+	// only the files of dvr_format generated by dvr_path.
+	patterns, root := srs_dvr_path_patterns(this.vhost)
+	match := func(file string) bool {
+		return srs_dvr_match_path(patterns, file) != nil
+	}
+
+	files := make([]*SrsDvrJanitorFile, 0)
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+
+		f := &SrsDvrJanitorFile{path:file, size:info.Size(), modTime:info.ModTime()}
+		if target := strings.TrimSuffix(strings.TrimSuffix(file, ".meta"), ".tmp"); target != file {
+			if !match(target) {
+				return nil
+			}
+			// the orphaned tmp file is recovered when server started, or deleted as others.
+			f.writing = srs_dvr_is_writing(target)
+		} else if !match(file) {
+			return nil
+		} else {
+			f.writing = srs_dvr_is_writing(file)
+		}
+
+		files = append(files, f)
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, root, err
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	return files, root, nil
+}
+
+/**
+* remove the empty dirs of file to the root, for the date dirs of dvr_path.
+*/
+func (this *SrsDvrJanitor) removeEmptyDirs(dir string, root string) {
+	for dir != root && strings.HasPrefix(dir, root) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		fmt.Println("dvr: janitor remove empty dir=", dir)
+		dir = filepath.Dir(dir)
+	}
+}
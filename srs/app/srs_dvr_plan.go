@@ -25,6 +25,7 @@ package app
 import (
 	"go_srs/srs/app/config"
 	"go_srs/srs/protocol/rtmp"
+	"go_srs/srs/codec/flv"
 	"fmt"
 )
 
@@ -34,28 +35,45 @@ type SrsDvrPlan interface {
 	OnMetaData(metaData *rtmp.SrsRtmpMessage) error
 	OnVideo(video *rtmp.SrsRtmpMessage) error
 	OnAudio(audio *rtmp.SrsRtmpMessage) error
+	// the path of the file being written.
+	Path() string
 }
 
 func NewSrsDvrPlan(req *SrsRequest) SrsDvrPlan {
 	dvrPlan := config.GetDvrPlan(req.vhost)
-	fmt.Println("dvrplan=", dvrPlan)
+	fmt.Println("dvr: plan=", dvrPlan, "url=", req.GetStreamUrl())
 	if dvrPlan == "session" {
 		return NewSrsSessionDvrPlan(req)
 	} else if dvrPlan == "append" {
-		fmt.Println("****************append dvr********************")
 		return NewSrsAppendDvrPlan(req)
+	} else if dvrPlan == config.SRS_CONF_DEFAULT_DVR_PLAN_SEGMENT {
+		return NewSrsSegmentDvrPlan(req)
+	} else if dvrPlan == config.SRS_CONF_DEFAULT_DVR_PLAN_API {
+		// never dvr when publish, the recording is started by http api.
+		return nil
 	}
 	return nil
 }
 
 type SrsAppendDvrPlan struct {
 	lastUpdateTime 	int64
-	segment 		*SrsFlvSegment
+	segment 		SrsDvrSegmenter
 }
 
 func NewSrsAppendDvrPlan(req *SrsRequest) *SrsAppendDvrPlan {
+	// only flv and ts can be appended, the mp4 is not supported.
+	if config.GetDvrFormat(req.vhost) == config.SRS_CONF_DVR_FORMAT_TS {
+		segment := NewSrsTsSegment(req)
+		segment.appendable = true
+		return &SrsAppendDvrPlan{
+			segment:segment,
+		}
+	}
+
+	segment := NewSrsFlvSegment(req)
+	segment.appendable = true
 	return &SrsAppendDvrPlan{
-		segment:NewSrsFlvSegment(req),
+		segment:segment,
 	}
 }
 
@@ -79,20 +97,24 @@ func (this *SrsAppendDvrPlan) OnAudio(audio *rtmp.SrsRtmpMessage) error {
 	return this.segment.WriteAudio(audio)
 }
 
+func (this *SrsAppendDvrPlan) Path() string {
+	return this.segment.Path()
+}
+
 
 type SrsSessionDvrPlan struct {
-	segment *SrsFlvSegment
+	segment SrsDvrSegmenter
 }
 
 func NewSrsSessionDvrPlan(req *SrsRequest) *SrsSessionDvrPlan {
 	return &SrsSessionDvrPlan{
-		segment:NewSrsFlvSegment(req),
+		segment:NewSrsDvrSegmenter(req),
 	}
 }
 
 func (this *SrsSessionDvrPlan) OnPublish() error {
 	if err := this.segment.Open(true); err != nil {
-		fmt.Println("open error =", err)
+		fmt.Println("dvr: open failed, err=", err)
 		return err
 	}
 	return nil
@@ -117,6 +139,126 @@ func (this *SrsSessionDvrPlan) OnAudio(audio *rtmp.SrsRtmpMessage) error {
 	return this.segment.WriteAudio(audio)
 }
 
+func (this *SrsSessionDvrPlan) Path() string {
+	return this.segment.Path()
+}
+
+/**
+* the segment plan, reap the flv to pieces by dvr_duration, and each piece
+* starts with the metadata and sequence headers, so it's independently playable.
+*/
+type SrsSegmentDvrPlan struct {
+	req				*SrsRequest
+	segment			SrsDvrSegmenter
+	duration		int64 // the dvr_duration in ms.
+	waitKeyframe	bool
+	// the cached metadata and sequence headers, to write at the start of each piece.
+	metaData		*rtmp.SrsRtmpMessage
+	videoSH			*rtmp.SrsRtmpMessage
+	audioSH			*rtmp.SrsRtmpMessage
+}
+
+func NewSrsSegmentDvrPlan(req *SrsRequest) *SrsSegmentDvrPlan {
+	return &SrsSegmentDvrPlan{
+		req:req,
+		duration:int64(config.GetDvrDuration(req.vhost)) * 1000,
+		waitKeyframe:config.GetDvrWaitKeyframe(req.vhost),
+	}
+}
+
+func (this *SrsSegmentDvrPlan) OnPublish() error {
+	this.segment = NewSrsDvrSegmenter(this.req)
+	if err := this.segment.Open(true); err != nil {
+		fmt.Println("dvr: open failed, err=", err)
+		return err
+	}
+	return nil
+}
+
+func (this *SrsSegmentDvrPlan) OnUnpublish() error {
+	return this.segment.Close()
+}
+
+func (this *SrsSegmentDvrPlan) OnMetaData(metaData *rtmp.SrsRtmpMessage) error {
+	this.metaData = metaData
+	return this.segment.WriteMetaData(metaData)
+}
+
+func (this *SrsSegmentDvrPlan) OnVideo(video *rtmp.SrsRtmpMessage) error {
+	if flvcodec.VideoIsSequenceHeader(video.GetPayload()) {
+		this.videoSH = video
+	} else if err := this.reap(video); err != nil {
+		return err
+	}
+	return this.segment.WriteVideo(video)
+}
+
+func (this *SrsSegmentDvrPlan) OnAudio(audio *rtmp.SrsRtmpMessage) error {
+	if flvcodec.AudioIsSequenceHeader(audio.GetPayload()) {
+		this.audioSH = audio
+	} else if err := this.reap(audio); err != nil {
+		return err
+	}
+	return this.segment.WriteAudio(audio)
+}
+
+func (this *SrsSegmentDvrPlan) Path() string {
+	if this.segment == nil {
+		return ""
+	}
+	return this.segment.Path()
+}
+
+/**
+* close the current piece and open a new one when overflow,
+* at the keyframe when dvr_wait_keyframe and the stream has video.
+*/
+func (this *SrsSegmentDvrPlan) reap(msg *rtmp.SrsRtmpMessage) error {
+	if !this.segment.IsOverflow(this.duration) {
+		return nil
+	}
+
+	if this.waitKeyframe && this.videoSH != nil {
+		if !msg.GetHeader().IsVideo() || !flvcodec.VideoIsKeyFrame(msg.GetPayload()) {
+			return nil
+		}
+	}
+
+	if err := this.segment.Close(); err != nil {
+		return err
+	}
+
+	if err := this.OnPublish(); err != nil {
+		return err
+	}
+
+	// the cached headers are written at the timestamp of msg, for their timestamp
+	// is the start of stream, which jumps the duration of the new piece.
+	timestamp := msg.GetHeader().GetTimestamp()
+	if this.metaData != nil {
+		if err := this.segment.WriteMetaData(srs_dvr_copy_at(this.metaData, timestamp)); err != nil {
+			return err
+		}
+	}
+	if this.videoSH != nil {
+		if err := this.segment.WriteVideo(srs_dvr_copy_at(this.videoSH, timestamp)); err != nil {
+			return err
+		}
+	}
+	if this.audioSH != nil {
+		if err := this.segment.WriteAudio(srs_dvr_copy_at(this.audioSH, timestamp)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func srs_dvr_copy_at(msg *rtmp.SrsRtmpMessage, timestamp int64) *rtmp.SrsRtmpMessage {
+	copy := msg.DeepCopy()
+	copy.GetHeader().SetTimestamp(timestamp)
+	return copy
+}
+
 //
 //type SrsDvrPlan struct {
 //	segment *SrsFlvSegment
@@ -0,0 +1,148 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 GOSRS(gosrs)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+	"go_srs/srs/app/config"
+	"go_srs/srs/global"
+	"go_srs/srs/protocol/rtmp"
+)
+
+func testDvrPlanMessage(messageType int8, timestamp int64, payload []byte) *rtmp.SrsRtmpMessage {
+	msg := rtmp.NewSrsRtmpMessage()
+	msg.SetHeader(rtmp.SrsMessageHeader{})
+	msg.GetHeader().SetMessageType(messageType)
+	msg.GetHeader().SetTimestamp(timestamp)
+	msg.SetPayload(payload)
+	return msg
+}
+
+/**
+* parse the timestamps of audio and video tags in flv.
+*/
+func testDvrPlanTimestamps(t *testing.T, file string) []int64 {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var timestamps []int64
+	for offset := 13; offset + 11 <= len(data); {
+		th := data[offset:]
+		size := int(th[1]) << 16 | int(th[2]) << 8 | int(th[3])
+		if th[0] == 8 || th[0] == 9 {
+			timestamps = append(timestamps, int64(th[7]) << 24 | int64(th[4]) << 16 | int64(th[5]) << 8 | int64(th[6]))
+		}
+		offset += 11 + size + 4
+	}
+	return timestamps
+}
+
+func testDvrPlanSegment(t *testing.T, jitter string) {
+	dir, err := ioutil.TempDir("", "srs-dvr-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vhosts := config.GetInstance().VHosts
+	t.Cleanup(func() {
+		config.GetInstance().VHosts = vhosts
+		os.RemoveAll(dir)
+	})
+
+	config.GetInstance().VHosts = map[string]*config.VHostConf{
+		"__defaultVhost__": {
+			Enabled: "on",
+			Dvr: &config.DvrConf{
+				Enabled:         "on",
+				DvrPlan:         "segment",
+				DvrPath:         dir + "/[app]/[stream].[timestamp].flv",
+				DvrDuration:     3,
+				DvrWaitKeyFrame: "on",
+				TimerJitter:     jitter,
+			},
+		},
+	}
+
+	req := NewSrsRequest()
+	req.vhost, req.app, req.stream = "__defaultVhost__", "live", "livestream"
+	plan := NewSrsSegmentDvrPlan(req)
+	if err := plan.OnPublish(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the timestamp of encoder starts at 1000, 10s with keyframe every 1s.
+	if err := plan.OnVideo(testDvrPlanMessage(global.RTMP_MSG_VideoMessage, 1000, []byte{0x17, 0, 0, 0, 0, 1, 0x64, 0, 0x1f})); err != nil {
+		t.Fatal(err)
+	}
+	if err := plan.OnAudio(testDvrPlanMessage(global.RTMP_MSG_AudioMessage, 1000, []byte{0xaf, 0, 0x12, 0x10})); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 250; i++ {
+		frame := []byte{0x27, 1, 0, 0, 0, 1, 2, 3, 4}
+		if i % 25 == 0 {
+			frame[0] = 0x17
+			// the piece is named by the ms when reaped.
+			time.Sleep(2 * time.Millisecond)
+		}
+		if err := plan.OnVideo(testDvrPlanMessage(global.RTMP_MSG_VideoMessage, 1000 + int64(i) * 40, frame)); err != nil {
+			t.Fatal(err)
+		}
+		if err := plan.OnAudio(testDvrPlanMessage(global.RTMP_MSG_AudioMessage, 1000 + int64(i) * 40 + 20, []byte{0xaf, 1, 1, 2, 3})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := plan.OnUnpublish(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(dir + "/live/*.flv")
+	sort.Strings(files)
+	if len(files) < 3 {
+		t.Fatal("expect 3 pieces at least, actual", files)
+	}
+
+	// the second piece is reaped by dvr_duration, not a gop, and no jump in timeline.
+	timestamps := testDvrPlanTimestamps(t, files[1])
+	for i := 1; i < len(timestamps); i++ {
+		if diff := timestamps[i] - timestamps[i - 1]; diff < 0 || diff > 40 {
+			t.Fatal("timestamp jumps at", i, timestamps[i - 1], "to", timestamps[i])
+		}
+	}
+	if duration := timestamps[len(timestamps) - 1] - timestamps[0]; duration < 3000 || duration > 4000 {
+		t.Error("expect the second piece about 3s, actual", duration)
+	}
+}
+
+func TestDvrPlanSegmentDuration(t *testing.T) {
+	for _, jitter := range []string{config.SRS_CONF_TIME_JITTER_FULL, config.SRS_CONF_TIME_JITTER_ZERO, config.SRS_CONF_TIME_JITTER_OFF} {
+		t.Run(jitter, func(t *testing.T) {
+			testDvrPlanSegment(t, jitter)
+		})
+	}
+}
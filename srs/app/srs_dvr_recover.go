@@ -0,0 +1,398 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 GOSRS(gosrs)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package app
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"go_srs/srs/app/config"
+)
+
+// the suffix of the tmp file of segment, and the file to rewrite the metadata of flv,
+// for example, livestream.flv.tmp.meta, or livestream.flv.meta to append.
+const SRS_DVR_TMP_SUFFIX = ".tmp"
+const SRS_DVR_META_SUFFIX = ".meta"
+
+/**
+* recover the orphaned tmp files of dvr_format left by the killed server, for each
+* vhost which dvr to local disk. it must be called before accept any stream,
+* so all tmp files are orphaned.
+*/
+func SrsDvrRecover() {
+	seen := make(map[string]bool)
+	for vhost, conf := range config.GetInstance().VHosts {
+		if conf.Enabled != "on" || conf.Dvr == nil || conf.Dvr.Enabled != "on" {
+			continue
+		}
+		if config.GetStorage(vhost) != nil {
+			continue
+		}
+
+		ext := "." + config.GetDvrFormat(vhost)
+		patterns, root := srs_dvr_path_patterns(vhost)
+
+		filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || seen[file] {
+				return nil
+			}
+
+			var target string
+			if strings.HasSuffix(file, ext + SRS_DVR_MP4_FASTSTART_SUFFIX) {
+				// the tmp mp4 is kept until the rewrite done, so it's recovered instead.
+				fmt.Println("dvr: recover remove partial faststart file=", file)
+				os.Remove(file)
+				return nil
+			} else if strings.HasSuffix(file, ext + SRS_DVR_TMP_SUFFIX) {
+				target = strings.TrimSuffix(file, SRS_DVR_TMP_SUFFIX)
+			} else if strings.HasSuffix(file, ext + SRS_DVR_META_SUFFIX) {
+				// the meta file is renamed over the file to append when done, so the
+				// file to append is complete, and recovered in place.
+				target = strings.TrimSuffix(file, SRS_DVR_META_SUFFIX)
+				if srs_dvr_match_path(patterns, target) == nil {
+					return nil
+				}
+				fmt.Println("dvr: recover remove partial rewrite file=", file)
+				os.Remove(file)
+
+				if info, err = os.Stat(target); err != nil {
+					return nil
+				}
+				file = target
+			} else if strings.HasSuffix(file, ext + SRS_DVR_TMP_SUFFIX + SRS_DVR_META_SUFFIX) {
+				// the meta file is renamed over the path when done, the tmp file is
+				// complete, and recovered as others.
+				if srs_dvr_match_path(patterns, strings.TrimSuffix(file, SRS_DVR_TMP_SUFFIX + SRS_DVR_META_SUFFIX)) == nil {
+					return nil
+				}
+				fmt.Println("dvr: recover remove partial rewrite file=", file)
+				os.Remove(file)
+				return nil
+			} else {
+				return nil
+			}
+
+			pattern := srs_dvr_match_path(patterns, target)
+			if pattern == nil {
+				return nil
+			}
+			seen[file] = true
+
+			req := NewSrsRequest()
+			req.vhost = vhost
+			m := pattern.FindStringSubmatch(target)
+			for i, name := range pattern.SubexpNames() {
+				switch name {
+					case "app": req.app = m[i]
+					case "stream": req.stream = m[i]
+				}
+			}
+
+			switch ext {
+				case "." + config.SRS_CONF_DVR_FORMAT_MP4: err = srs_dvr_recover_mp4(req, file, target, info)
+				case "." + config.SRS_CONF_DVR_FORMAT_TS: err = srs_dvr_recover_ts(req, file, target, info)
+				default: err = srs_dvr_recover_flv(req, file, target, info)
+			}
+			if err != nil {
+				fmt.Println("dvr: recover failed, file=", file, "err=", err)
+			}
+			return nil
+		})
+	}
+}
+
+/**
+* the regexps to match the files generated by the dvr of vhost, with the extension
+* of dvr_format, and the file to append without the [timestamp] and [seq] for append plan.
+* @return the patterns, and the dir to scan.
+*/
+func srs_dvr_path_patterns(vhost string) ([]*regexp.Regexp, string) {
+	ext := "." + config.GetDvrFormat(vhost)
+	template := filepath.Clean(strings.Replace(srs_dvr_path_template(vhost, ext), "[vhost]", vhost, -1))
+	patterns := []*regexp.Regexp{srs_dvr_path_pattern(template, ext)}
+
+	if config.GetDvrPlan(vhost) == config.SRS_CONF_DEFAULT_DVR_PLAN_APPEND {
+		appendTemplate := filepath.Clean(dvrAppendVariable.ReplaceAllString(template, ""))
+		patterns = append(patterns, srs_dvr_path_pattern(appendTemplate, ext))
+	}
+	return patterns, srs_dvr_path_root(template)
+}
+
+/**
+* the pattern which matches the file, nil if no one.
+*/
+func srs_dvr_match_path(patterns []*regexp.Regexp, file string) *regexp.Regexp {
+	for _, pattern := range patterns {
+		if pattern.MatchString(file) {
+			return pattern
+		}
+	}
+	return nil
+}
+
+var dvrPathVariable = regexp.MustCompile(`\[[^\]]*\]`)
+
+/**
+* the regexp to match the file generated by the template, to parse the app and stream,
+* the date, [timestamp] and [seq] are numbers, and the -1, -2 and so on before the ext
+* is the suffix of the exists path.
+* @param ext the extension of file, for example, .flv
+*/
+func srs_dvr_path_pattern(template string, ext string) *regexp.Regexp {
+	suffix := ""
+	if strings.HasSuffix(template, ext) {
+		template, suffix = strings.TrimSuffix(template, ext), `(-\d+)?` + regexp.QuoteMeta(ext)
+	}
+
+	expr := ""
+	last := 0
+	for _, loc := range dvrPathVariable.FindAllStringIndex(template, -1) {
+		expr += regexp.QuoteMeta(template[last:loc[0]])
+		switch template[loc[0]:loc[1]] {
+			case "[app]": expr += `(?P<app>[^/]+)`
+			case "[stream]": expr += `(?P<stream>[^/]+)`
+			case "[2006]", "[01]", "[02]", "[15]", "[04]", "[05]", "[999]", "[timestamp]", "[seq]": expr += `\d+`
+			default: expr += `[^/]*`
+		}
+		last = loc[1]
+	}
+	expr += regexp.QuoteMeta(template[last:])
+	return regexp.MustCompile("^" + expr + suffix + "$")
+}
+
+/**
+* the dir of template before any variable, to scan the files.
+*/
+func srs_dvr_path_root(template string) string {
+	if i := strings.Index(template, "["); i >= 0 {
+		template = template[:i]
+		if !strings.HasSuffix(template, "/") {
+			return filepath.Dir(template)
+		}
+		return filepath.Clean(template)
+	}
+	return filepath.Dir(template)
+}
+
+/**
+* recover the tmp flv, truncate the partial last tag, fix the metadata,
+* rename to the target and call the on_dvr hook.
+*/
+func srs_dvr_recover_flv(req *SrsRequest, file string, target string, info os.FileInfo) error {
+	// nothing recorded, the header is not complete.
+	if info.Size() < 13 {
+		fmt.Println("dvr: recover remove empty file=", file)
+		return os.Remove(file)
+	}
+
+	f, err := os.OpenFile(file, os.O_RDWR, 0755)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 13)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		f.Close()
+		return err
+	}
+	if string(header[:3]) != "FLV" {
+		f.Close()
+		return fmt.Errorf("invalid flv header")
+	}
+
+	segment := NewSrsFlvSegment(req)
+	segment.path, segment.tmpFlvFile, segment.file = target, file, f
+
+	size := info.Size()
+	offset, _ := segment.scan(size)
+	if offset < size {
+		fmt.Println("dvr: recover truncate file=", file, "from", size, "to", offset)
+		if err := f.Truncate(offset); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	segment.openTime = info.ModTime().Add(-time.Duration(segment.duration) * time.Millisecond)
+
+	fmt.Println("dvr: recover file=", file, "to", target, "duration=", segment.duration, "keyframes=", len(segment.keyframeTimes))
+	return segment.Close()
+}
+
+/**
+* recover the tmp fragmented mp4, truncate the partial fragment at the end, and
+* rename to the target, the fragmented mp4 is playable without faststart.
+*/
+func srs_dvr_recover_mp4(req *SrsRequest, file string, target string, info os.FileInfo) error {
+	// the faststart mp4 is in place, the tmp is not removed.
+	if _, err := os.Stat(target); err == nil {
+		fmt.Println("dvr: recover remove rewritten file=", file)
+		return os.Remove(file)
+	}
+
+	f, err := os.OpenFile(file, os.O_RDWR, 0755)
+	if err != nil {
+		return err
+	}
+
+	size := info.Size()
+	offset, duration := srs_mp4_scan_fragments(f, size)
+	// nothing recorded, the moov is not complete.
+	if offset == 0 {
+		f.Close()
+		fmt.Println("dvr: recover remove empty file=", file)
+		return os.Remove(file)
+	}
+
+	if offset < size {
+		fmt.Println("dvr: recover truncate file=", file, "from", size, "to", offset)
+		if err := f.Truncate(offset); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(file, target); err != nil {
+		return err
+	}
+
+	fmt.Println("dvr: recover file=", file, "to", target, "duration=", duration)
+	openTime := info.ModTime().Add(-time.Duration(duration) * time.Millisecond)
+	srs_dvr_on_dvr(req, target, duration, offset, openTime)
+	return nil
+}
+
+/**
+* scan the top level boxes of fragmented mp4, stop at the partial box or the
+* moof without mdat.
+* @return the end of the last complete fragment, 0 if no moov, and the duration in ms.
+*/
+func srs_mp4_scan_fragments(f io.ReaderAt, size int64) (int64, int64) {
+	var end, offset int64
+	var moov bool
+	var moof []byte
+	start, last := int64(-1), int64(-1)
+	header := make([]byte, 16)
+	for offset + 8 <= size {
+		if _, err := f.ReadAt(header[:8], offset); err != nil {
+			break
+		}
+
+		box_size, box_header := int64(binary.BigEndian.Uint32(header)), int64(8)
+		typ := string(header[4:8])
+		if box_size == 1 {
+			if _, err := f.ReadAt(header[8:], offset + 8); err != nil {
+				break
+			}
+			box_size, box_header = int64(binary.BigEndian.Uint64(header[8:])), 16
+		}
+		if box_size < box_header || offset + box_size > size {
+			break
+		}
+
+		switch typ {
+			case "moov":
+				moov = true
+				end = offset + box_size
+			case "moof":
+				moof = make([]byte, box_size - box_header)
+				if _, err := f.ReadAt(moof, offset + box_header); err != nil {
+					moof = nil
+				}
+			case "mdat":
+				// the fragment is complete with the mdat.
+				if moov && moof != nil {
+					for _, traf := range srs_mp4_children(moof, "traf") {
+						if from, to, ok := srs_mp4_traf_time(traf); ok {
+							if start < 0 || from < start {
+								start = from
+							}
+							if to > last {
+								last = to
+							}
+						}
+					}
+					end = offset + box_size
+				}
+				moof = nil
+		}
+		offset += box_size
+	}
+
+	if !moov {
+		return 0, 0
+	}
+
+	var duration int64
+	if start >= 0 {
+		duration = (last - start) * 1000 / SRS_MP4_TIMESCALE
+	}
+	return end, duration
+}
+
+/**
+* recover the tmp ts, truncate the partial packet at the end,
+* rename to the target and call the on_dvr hook.
+*/
+func srs_dvr_recover_ts(req *SrsRequest, file string, target string, info os.FileInfo) error {
+	size := info.Size()
+	end := size - size % SRS_TS_PACKET_SIZE
+	// nothing recorded, not a packet.
+	if end == 0 {
+		fmt.Println("dvr: recover remove empty file=", file)
+		return os.Remove(file)
+	}
+
+	f, err := os.OpenFile(file, os.O_RDWR, 0755)
+	if err != nil {
+		return err
+	}
+
+	if end < size {
+		fmt.Println("dvr: recover truncate file=", file, "from", size, "to", end)
+		if err := f.Truncate(end); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	segment := NewSrsTsSegment(req)
+	segment.path, segment.tmpFile, segment.file = target, file, f
+
+	// the duration from the first to the last pes.
+	if start, last := segment.scanFirst(end), segment.scan(end); start >= 0 && last > start {
+		segment.duration = last - start
+	}
+	segment.openTime = info.ModTime().Add(-time.Duration(segment.duration) * time.Millisecond)
+
+	fmt.Println("dvr: recover file=", file, "to", target, "duration=", segment.duration)
+	return segment.Close()
+}
@@ -0,0 +1,245 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 GOSRS(gosrs)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package app
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"go_srs/srs/app/config"
+	"go_srs/srs/protocol/rtmp"
+	"go_srs/srs/utils"
+)
+
+/**
+* the segmenter of dvr plan, write the stream to a file, flv, mp4 or ts.
+*/
+type SrsDvrSegmenter interface {
+	// open the file, use the tmp file and rename when closed if useTmpFile.
+	Open(useTmpFile bool) error
+	// close the file and call the on_dvr hook.
+	Close() error
+	WriteMetaData(msg *rtmp.SrsRtmpMessage) error
+	WriteVideo(msg *rtmp.SrsRtmpMessage) error
+	WriteAudio(msg *rtmp.SrsRtmpMessage) error
+	// whether the duration in ms of file exceed the max.
+	IsOverflow(maxDuration int64) bool
+	// the path of file.
+	Path() string
+}
+
+/**
+* create the segmenter by the dvr_format of vhost.
+*/
+func NewSrsDvrSegmenter(req *SrsRequest) SrsDvrSegmenter {
+	switch config.GetDvrFormat(req.vhost) {
+	case config.SRS_CONF_DVR_FORMAT_MP4:
+		return NewSrsMp4Segment(req)
+	case config.SRS_CONF_DVR_FORMAT_TS:
+		return NewSrsTsSegment(req)
+	}
+	return NewSrsFlvSegment(req)
+}
+
+// the extensions of dvr file, the dvr_path may use any of them.
+var dvrExtensions = []string{"." + config.SRS_CONF_DVR_FORMAT_FLV, "." + config.SRS_CONF_DVR_FORMAT_MP4, "." + config.SRS_CONF_DVR_FORMAT_TS}
+
+/**
+* get the template of dvr file by dvr_path, with the extension of format.
+* @param ext the extension of file, for example, .flv
+*/
+func srs_dvr_path_template(vhost string, ext string) string {
+	dvrPath := config.GetDvrPath(vhost)
+
+	if !strings.Contains(dvrPath, ext) {
+		found := false
+		for _, e := range dvrExtensions {
+			if strings.HasSuffix(dvrPath, e) {
+				dvrPath = strings.TrimSuffix(dvrPath, e) + ext
+				found = true
+				break
+			}
+		}
+		if !found {
+			dvrPath += "/[app]/[stream].[timestamp]" + ext
+		}
+	}
+	return dvrPath
+}
+
+/**
+* build the variables of client in path, the [ip] of client and the
+* [param:key] of query string, for example, [param:token] of ?token=xxx.
+* the value is sanitized, not to escape the dir of dvr.
+*/
+var dvrParamVariable = regexp.MustCompile(`\[param:([^\]]+)\]`)
+var dvrPathSanitizer = strings.NewReplacer("/", "_", "\\", "_", "..", "_")
+
+func srs_dvr_build_client(template string, req *SrsRequest) string {
+	template = strings.Replace(template, "[ip]", dvrPathSanitizer.Replace(req.ip), -1)
+	if !strings.Contains(template, "[param:") {
+		return template
+	}
+
+	params, _ := url.ParseQuery(strings.TrimPrefix(req.param, "?"))
+	return dvrParamVariable.ReplaceAllStringFunc(template, func(v string) string {
+		key := dvrParamVariable.FindStringSubmatch(v)[1]
+		return dvrPathSanitizer.Replace(params.Get(key))
+	})
+}
+
+/**
+* the [seq] of dvr file for each stream, increase when file created.
+*/
+var dvrSequences = make(map[string]int)
+var dvrSequencesMtx sync.Mutex
+
+/**
+* generate the path of dvr file by dvr_path, the variables are:
+*		[vhost], [app], [stream] of request,
+*		[2006], [01], [02], [15], [04], [05], [999] of date and time,
+*		[timestamp] in ms, [ip] of client, [param:key] of query string,
+*		[seq] of file for the stream.
+* the path is never the same as an exists file, the [seq] is increased,
+* or a suffix -1, -2 and so on is added before the extension.
+* the dir is created by storage when file created.
+* @param ext the extension of file, for example, .flv
+*/
+func srs_dvr_generate_path(storage SrsStorage, req *SrsRequest, ext string) string {
+	flvPath := srs_dvr_path_template(req.vhost, ext)
+	flvPath = utils.Srs_path_build_stream(flvPath, req.vhost, req.app, req.stream)
+	flvPath = utils.Srs_path_build_timestamp(flvPath, time.Now())
+	flvPath = srs_dvr_build_client(flvPath, req)
+
+	exists := func(file string) bool {
+		if _, err := storage.Stat(file); err == nil {
+			return true
+		}
+		_, err := storage.Stat(file + ".tmp")
+		return err == nil
+	}
+
+	if strings.Contains(flvPath, "[seq]") {
+		dvrSequencesMtx.Lock()
+		defer dvrSequencesMtx.Unlock()
+
+		streamUrl := req.GetStreamUrl()
+		seq := dvrSequences[streamUrl]
+		for exists(strings.Replace(flvPath, "[seq]", strconv.Itoa(seq), -1)) {
+			seq++
+		}
+		dvrSequences[streamUrl] = seq + 1
+		return strings.Replace(flvPath, "[seq]", strconv.Itoa(seq), -1)
+	}
+
+	if !exists(flvPath) {
+		return flvPath
+	}
+
+	base := strings.TrimSuffix(flvPath, ext)
+	for i := 1; ; i++ {
+		if file := fmt.Sprintf("%s-%d%s", base, i, ext); !exists(file) {
+			fmt.Println("dvr: path exists, use file=", file)
+			return file
+		}
+	}
+}
+
+// the [timestamp] or [seq] and the separator before it, removed from the path to append.
+var dvrAppendVariable = regexp.MustCompile(`[._-]?\[(timestamp|seq)\]`)
+
+/**
+* generate the path of dvr file to append, the [timestamp] and [seq] are removed,
+* so the same file is reopened for each publish, the date and client
+* variables are kept, for example, a file for each day.
+*/
+func srs_dvr_generate_append_path(req *SrsRequest, ext string) string {
+	flvPath := dvrAppendVariable.ReplaceAllString(srs_dvr_path_template(req.vhost, ext), "")
+	flvPath = utils.Srs_path_build_stream(flvPath, req.vhost, req.app, req.stream)
+	flvPath = utils.Srs_path_build_timestamp(flvPath, time.Now())
+	return srs_dvr_build_client(flvPath, req)
+}
+
+/**
+* call the on_dvr hook when the file is closed and in place,
+* the hook is called async with retries, not to block the dvr.
+* @param duration the duration in ms of file.
+*/
+func srs_dvr_on_dvr(r *SrsRequest, file string, duration int64, size int64, openTime time.Time) {
+	vhost := config.GetInstance().GetVHost(r.vhost)
+	if vhost == nil || vhost.HttpHooks == nil || vhost.HttpHooks.Enabled != "on" || vhost.HttpHooks.OnDvr == "" {
+		return
+	}
+
+	req := *r
+	url := vhost.HttpHooks.OnDvr
+	start_time, end_time := openTime.UnixNano() / int64(time.Millisecond), utils.GetCurrentMs()
+	go func() {
+		if err := OnDvr(url, &req, file, float64(duration) / 1000, size, start_time, end_time); err != nil {
+			fmt.Println("dvr: http hook failed, err=", err)
+		}
+	}()
+}
+
+/**
+* the fsync policy of dvr file, to bound the loss when the server is killed.
+*/
+type SrsDvrSyncer struct {
+	policy		string
+	interval	time.Duration
+	lastSync	time.Time
+}
+
+func NewSrsDvrSyncer(vhost string) *SrsDvrSyncer {
+	return &SrsDvrSyncer{
+		policy:config.GetDvrFsync(vhost),
+		interval:time.Duration(config.GetDvrFsyncInterval(vhost)) * time.Second,
+		lastSync:time.Now(),
+	}
+}
+
+/**
+* fsync the file when the interval elapsed, for interval policy.
+*/
+func (this *SrsDvrSyncer) on_write(f SrsStorageFile) error {
+	if this.policy != config.SRS_CONF_DVR_FSYNC_INTERVAL || time.Since(this.lastSync) < this.interval {
+		return nil
+	}
+
+	this.lastSync = time.Now()
+	return f.Sync()
+}
+
+/**
+* fsync the file before closed, for close and interval policy.
+*/
+func (this *SrsDvrSyncer) on_close(f SrsStorageFile) error {
+	if this.policy == config.SRS_CONF_DVR_FSYNC_OFF {
+		return nil
+	}
+	return f.Sync()
+}
@@ -24,39 +24,64 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 package app
 
 import (
-	"os"
-	"errors"
 	"encoding/binary"
+	"io"
+	"strings"
+	"errors"
 	"go_srs/srs/protocol/amf0"
 	"go_srs/srs/protocol/rtmp"
 	"go_srs/srs/global"
 	"go_srs/srs/utils"
 	"go_srs/srs/codec/flv"
 	"go_srs/srs/app/config"
-	"strings"
-	"strconv"
+	"time"
 	"fmt"
+	"os"
 )
 
+// the keyframes reserved in metadata, the file is rewritten when exceed.
+const SRS_DVR_FLV_KEYFRAMES_RESERVE = 1024
+// the property of metadata to pad the reserved space.
+const SRS_DVR_FLV_PADDING = "padding"
+
 type SrsFlvSegment struct {
 	path 			string
 	req 			*SrsRequest
 	flvEncoder		*flvcodec.SrsFlvEncoder
-	durationOffset	int64
-	filesizeOffset	int64
+	// the metadata to update when closed, the object or ecma array.
+	metaName		amf0.SrsAmf0String
+	metaData		amf0.SrsAmf0Any
+	metaOffset		int64 // the offset of metadata tag.
+	metaSize		int // the size of metadata tag data, with the padding reserved for keyframes.
+	// the index of keyframes, the time in seconds and the offset of tag.
+	keyframeTimes		[]float64
+	keyframePositions	[]float64
 	startTime		int64
 	previousPktTime int64
 	duration		int64
 	streamDuration	int64
 	tmpFlvFile		string
+	metaFile		string // the file rewritten with larger metadata, renamed to path when closed.
 	hasKeyFrame		bool
 	jitter 			*SrsRtmpJitter
-	file			*os.File
+	jitterAlgorithm	SrsRtmpJitterAlgorithm // the time_jitter of dvr.
+	file			SrsStorageFile
+	storage			SrsStorage // the storage of flv, local disk or s3.
+	openTime		time.Time // the wall clock when file opened.
+	fileSize		int64 // the size of file, set when closed.
+	syncer			*SrsDvrSyncer
+	// whether reopen the exists file to append, for the append plan.
+	appendable		bool
+	// whether the file is reopened, the metadata of file is kept.
+	reopened		bool
 }
 
 func NewSrsFlvSegment(r *SrsRequest) *SrsFlvSegment {
 	return &SrsFlvSegment{
 		req:r,
+		storage:NewSrsStorage(r.vhost),
+		syncer:NewSrsDvrSyncer(r.vhost),
+		jitterAlgorithm:SrsTimeJitterString2Int(config.GetDvrTimeJitter(r.vhost)),
 		startTime:-1,
 		previousPktTime:-1,
 		duration:0,
@@ -71,11 +96,9 @@ func (this *SrsFlvSegment) Open(useTmpFile bool) error {
 
 	this.path = this.generatePath()
 		fmt.Println("*******************dvr file=", this.path, "******************")
-	var freshFlvFile bool = false
-	if _, err := os.Stat(this.path); os.IsExist(err) {
+	var freshFlvFile bool = true
+	if _, err := this.storage.Stat(this.path); err == nil && this.appendable {
 		freshFlvFile = false
-	} else {
-		freshFlvFile = true
 	}
 
 	if err := this.createJitter(!freshFlvFile); err != nil {
@@ -88,16 +111,27 @@ func (this *SrsFlvSegment) Open(useTmpFile bool) error {
 		this.tmpFlvFile = this.path + ".tmp"
 	}
 
+	this.openTime = time.Now()
+	this.metaData, this.fileSize, this.reopened, this.metaFile = nil, 0, false, ""
+	this.keyframeTimes, this.keyframePositions = nil, nil
+
 	var err error
 	if !freshFlvFile {
-		if this.file, err = os.OpenFile(this.tmpFlvFile, os.O_APPEND, 0755); err != nil {
+		if this.file, err = this.storage.Append(this.tmpFlvFile); err != nil {
+			return err
+		}
+		if err = this.reopen(); err != nil {
+			this.file.Close()
+			this.file = nil
 			return err
 		}
 	} else {
-		if this.file, err = os.OpenFile(this.tmpFlvFile, os.O_CREATE | os.O_RDWR, 0755); err != nil {
+		if this.file, err = this.storage.Create(this.tmpFlvFile); err != nil {
 			return err
 		}
 	}
+	// never deleted by the janitor until closed.
+	srs_dvr_writing_add(this.path)
 
 	this.flvEncoder = flvcodec.NewSrsFlvEncoder(this.file)
 	if freshFlvFile {
@@ -108,39 +142,63 @@ func (this *SrsFlvSegment) Open(useTmpFile bool) error {
 	return nil
 }
 
-func (this *SrsFlvSegment) generatePath() string {
-	dvrPath := config.GetDvrPath(this.req.vhost)
+/**
+* load the exists flv to append, drop the partial tag at the end, and
+* continue the timestamp and duration from the last tag.
+*/
+func (this *SrsFlvSegment) reopen() error {
+	size, err := this.file.Seek(0, 2)//SEEK_END
+	if err != nil {
+		return err
+	}
 
-	if !strings.Contains(dvrPath, ".flv") {
-		dvrPath += "/[app]/[stream].[timestamp].flv"
+	header := make([]byte, 13)
+	if _, err := this.file.ReadAt(header, 0); err != nil || string(header[:3]) != "FLV" {
+		return errors.New("invalid flv to append " + this.path)
 	}
 
-	flvPath := dvrPath
-	flvPath = utils.Srs_path_build_stream(flvPath, this.req.vhost, this.req.app, this.req.stream)
-	//todo build timestamp path
-	flvPath = strings.Replace(flvPath, "[timestamp]", strconv.Itoa(int(utils.GetCurrentMs())), -1)
+	end, lastTime := this.scan(size)
+	if end < size {
+		fmt.Println("dvr: append truncate file=", this.path, "from", size, "to", end)
+		if err := this.file.Truncate(end); err != nil {
+			return err
+		}
+		if _, err := this.file.Seek(end, 0); err != nil {
+			return err
+		}
+	}
+
+	if lastTime >= 0 {
+		this.jitter.Continue(lastTime)
+		this.previousPktTime = lastTime
+	}
+	this.reopened = true
+	fmt.Println("dvr: append file=", this.path, "size=", end, "duration=", this.duration, "keyframes=", len(this.keyframeTimes))
+	return nil
+}
 
-	return flvPath
+func (this *SrsFlvSegment) generatePath() string {
+	if this.appendable {
+		return srs_dvr_generate_append_path(this.req, ".flv")
+	}
+	return srs_dvr_generate_path(this.storage, this.req, ".flv")
+}
+
+func (this *SrsFlvSegment) Path() string {
+	return this.path
 }
 
 func (this *SrsFlvSegment) createJitter(loadFromFlv bool) error {
-	if !loadFromFlv {
-		this.jitter = NewSrsRtmpJitter()
+	this.jitter = NewSrsRtmpJitter()
+	this.startTime = -1
+	this.previousPktTime = -1
+	this.hasKeyFrame = false
+	this.duration = 0
 
-		this.startTime = -1
-		this.previousPktTime = -1
+	// the stream duration is kept for append, the others are loaded from flv.
+	if !loadFromFlv {
 		this.streamDuration = 0
-
-		this.hasKeyFrame = false
-		this.duration = 0
-		return nil
-	}
-	// when jitter ok, do nothing.
-	if this.jitter != nil {
-		return nil
 	}
-
-	this.jitter = NewSrsRtmpJitter()
 	return nil
 }
 
@@ -148,26 +206,57 @@ func (this *SrsFlvSegment) Close() error {
 	if this.file == nil {
 		return nil
 	}
+	defer srs_dvr_writing_remove(this.path)
 
 	var err error
 	if err = this.updateFlvMetaData(); err != nil {
 		return err
 	}
 
+	if err = this.syncer.on_close(this.file); err != nil {
+		return err
+	}
+
 	if err = this.file.Close(); err != nil {
 		return err
 	}
 
-	if this.tmpFlvFile != this.path {
-		if err = os.Rename(this.tmpFlvFile, this.path); err != nil {
+	this.file = nil
+
+	if this.metaFile != "" {
+		// replace the path atomically, the file to append is never removed before.
+		if err = this.storage.Rename(this.metaFile, this.path); err != nil {
+			return err
+		}
+		if this.tmpFlvFile != this.path {
+			if err = this.storage.Remove(this.tmpFlvFile); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	} else if this.tmpFlvFile != this.path {
+		if err = this.storage.Rename(this.tmpFlvFile, this.path); err != nil {
 			return err
 		}
 	}
 
+	this.on_dvr()
 	return nil
 }
 
+func (this *SrsFlvSegment) on_dvr() {
+	srs_dvr_on_dvr(this.req, this.path, this.duration, this.fileSize, this.openTime)
+}
+
 func (this *SrsFlvSegment) WriteMetaData(msg *rtmp.SrsRtmpMessage) error {
+	if this.file == nil {
+		return errors.New("dvr: flv file is not opened")
+	}
+
+	// the metadata of the reopened file is updated when closed.
+	if this.reopened && this.metaData != nil {
+		return nil
+	}
+
 	stream := utils.NewSrsStream(msg.GetPayload())
 
 	var command amf0.SrsAmf0String
@@ -230,77 +319,263 @@ func (this *SrsFlvSegment) WriteMetaData(msg *rtmp.SrsRtmpMessage) error {
 		}
 	}
 	
-	writeStream := utils.NewSrsStream([]byte{})
-	if err = name.Encode(writeStream); err != nil {
-		fmt.Println("777777777777777777777777")
-		return err
-	}
-
-	if err = metaData.Encode(writeStream); err != nil {
-		fmt.Println("888888888888888888888888")
-		return err
-	}
-
-	size := len(writeStream.Data())
 	off, err := this.file.Seek(0, 1)//SEEK_CUR
 	if err != nil {
 		return err
 	}
+
+	this.metaName, this.metaData, this.metaOffset = name, metaData, off
+	// reserve the space for keyframes, each is two numbers of 9B.
+	data := this.encodeMetaData(SRS_DVR_FLV_KEYFRAMES_RESERVE * 18)
+	this.metaSize = len(data)
 	fmt.Println("******************88write metadata done*****************")
-	// 11B flv tag header, 3B object EOF, 8B number value, 1B number flag.
-	//todo fix me, write readable code
-	this.durationOffset = off + int64(size) + 11 - 3 - 8
-	this.filesizeOffset = this.durationOffset - 1 - (2 + int64(len("duration"))) - 8
-	_, err = this.flvEncoder.WriteMetaData(writeStream.Data())
+	_, err = this.flvEncoder.WriteMetaData(data)
 	return err
 }
 
-func (this *SrsFlvSegment) onUpdateDuration(msg *rtmp.SrsRtmpMessage) error {
+/**
+* encode the metadata with filesize, duration and keyframes.
+* @param padding the size of padding string, no padding if negative.
+*/
+func (this *SrsFlvSegment) encodeMetaData(padding int) []byte {
+	times, positions := amf0.NewSrsAmf0StrictArray(), amf0.NewSrsAmf0StrictArray()
+	for i := 0; i < len(this.keyframeTimes); i++ {
+		times.Append(amf0.NewSrsAmf0Number(this.keyframeTimes[i]))
+		positions.Append(amf0.NewSrsAmf0Number(this.keyframePositions[i]))
+	}
+	keyframes := amf0.NewSrsAmf0Object()
+	keyframes.Set("filepositions", positions)
+	keyframes.Set("times", times)
+
+	switch v := this.metaData.(type) {
+		case *amf0.SrsAmf0Object: {
+			v.Set("filesize", float64(this.fileSize))
+			v.Set("duration", float64(this.duration) / 1000)
+			v.Set("keyframes", keyframes)
+			v.Remove(SRS_DVR_FLV_PADDING)
+			if padding >= 0 {
+				v.Set(SRS_DVR_FLV_PADDING, strings.Repeat(" ", padding))
+			}
+		}
+		case *amf0.SrsAmf0EcmaArray: {
+			v.Set("filesize", float64(this.fileSize))
+			v.Set("duration", float64(this.duration) / 1000)
+			v.Set("keyframes", keyframes)
+			v.Remove(SRS_DVR_FLV_PADDING)
+			if padding >= 0 {
+				v.Set(SRS_DVR_FLV_PADDING, strings.Repeat(" ", padding))
+			}
+		}
+	}
+
+	writeStream := utils.NewSrsStream([]byte{})
+	this.metaName.Encode(writeStream)
+	this.metaData.Encode(writeStream)
+	return writeStream.Data()
+}
+
+/**
+* update the duration by the corrected timestamp of message.
+*/
+func (this *SrsFlvSegment) onUpdateDuration(timestamp int64) error {
 	if this.startTime < 0 {
-		this.startTime = msg.GetHeader().GetTimestamp()
+		this.startTime = timestamp
 	}
 
-	if this.previousPktTime < 0 || this.previousPktTime > msg.GetHeader().GetTimestamp() {
-		this.previousPktTime = msg.GetHeader().GetTimestamp()
+	if this.previousPktTime < 0 || this.previousPktTime > timestamp {
+		this.previousPktTime = timestamp
 	}
-	this.duration += msg.GetHeader().GetTimestamp() - this.previousPktTime
-	this.streamDuration += msg.GetHeader().GetTimestamp() - this.previousPktTime
-	this.previousPktTime = msg.GetHeader().GetTimestamp()
+	this.duration += timestamp - this.previousPktTime
+	this.streamDuration += timestamp - this.previousPktTime
+	this.previousPktTime = timestamp
 	return nil
 }
 
 func (this *SrsFlvSegment) WriteAudio(msg *rtmp.SrsRtmpMessage) error {
-	this.flvEncoder.WriteAudio(uint32(msg.GetHeader().GetTimestamp()), msg.GetPayload())
-	this.onUpdateDuration(msg)
-	return nil
+	if this.file == nil {
+		return errors.New("dvr: flv file is not opened")
+	}
+
+	timestamp := this.jitter.CorrectTimestamp(msg.GetHeader().GetTimestamp(), this.jitterAlgorithm)
+	this.flvEncoder.WriteAudio(uint32(timestamp), msg.GetPayload())
+	this.onUpdateDuration(timestamp)
+	return this.syncer.on_write(this.file)
 }
 
 func (this *SrsFlvSegment) WriteVideo(msg *rtmp.SrsRtmpMessage) error {
-	this.flvEncoder.WriteVideo(uint32(msg.GetHeader().GetTimestamp()), msg.GetPayload())
-	this.onUpdateDuration(msg)
-	return nil
+	if this.file == nil {
+		return errors.New("dvr: flv file is not opened")
+	}
+
+	timestamp := this.jitter.CorrectTimestamp(msg.GetHeader().GetTimestamp(), this.jitterAlgorithm)
+	if flvcodec.VideoIsKeyFrame(msg.GetPayload()) && !flvcodec.VideoIsSequenceHeader(msg.GetPayload()) {
+		off, err := this.file.Seek(0, 1)//SEEK_CUR
+		if err != nil {
+			return err
+		}
+		this.keyframeTimes = append(this.keyframeTimes, float64(timestamp) / 1000)
+		this.keyframePositions = append(this.keyframePositions, float64(off))
+	}
+	this.flvEncoder.WriteVideo(uint32(timestamp), msg.GetPayload())
+	this.onUpdateDuration(timestamp)
+	return this.syncer.on_write(this.file)
 }
 
 func (this *SrsFlvSegment) IsOverflow(maxDuration int64) bool {
 	return this.duration > maxDuration
 }
 
+/**
+* update the filesize, duration and keyframes of metadata, in the reserved space,
+* or rewrite the file when the keyframes exceed the reserved space.
+*/
 func (this *SrsFlvSegment) updateFlvMetaData() error {
-	off, err1 := this.file.Seek(0, 2)
-	if err1 != nil {
-		return err1
+	off, err := this.file.Seek(0, 2)//SEEK_END
+	if err != nil {
+		return err
+	}
+	this.fileSize = off
+
+	if this.metaData == nil {
+		return nil
+	}
+
+	data := this.encodeMetaData(-1)
+	overhead := len(this.encodeMetaData(0)) - len(data)
+	if len(data) + overhead > this.metaSize {
+		return this.rewriteFlvMetaData()
 	}
-	c := utils.Float64ToBytes(float64(off), binary.BigEndian)
 
-	_, err2 := this.file.WriteAt(c, this.filesizeOffset)
-	if err2 != nil {
-		return err2
+	// the tag data is after the 11B tag header.
+	data = this.encodeMetaData(this.metaSize - len(data) - overhead)
+	_, err = this.file.WriteAt(data, this.metaOffset + 11)
+	return err
+}
+
+/**
+* rewrite the file with the larger metadata to the meta file, which is switched
+* to and renamed to the path when closed, the padding is reserved again, so the
+* next append is updated in place.
+*/
+func (this *SrsFlvSegment) rewriteFlvMetaData() error {
+	padding := SRS_DVR_FLV_KEYFRAMES_RESERVE * 18
+	// the tags after metadata are moved by the delta, the size of numbers never changes.
+	delta := int64(len(this.encodeMetaData(padding)) - this.metaSize)
+	for i := 0; i < len(this.keyframePositions); i++ {
+		if int64(this.keyframePositions[i]) > this.metaOffset {
+			this.keyframePositions[i] += float64(delta)
+		}
 	}
+	oldSize := this.fileSize
+	this.fileSize += delta
+	data := this.encodeMetaData(padding)
 
-	b := utils.Float64ToBytes(float64(this.duration)/1000, binary.BigEndian)
-	_, err3 := this.file.WriteAt(b, this.durationOffset)
-	if err3 != nil {
-		return err3
+	metaFile := this.tmpFlvFile + ".meta"
+	fmt.Println("dvr: rewrite flv for keyframes=", len(this.keyframeTimes), "file=", metaFile)
+	f, err := this.storage.Create(metaFile)
+	if err != nil {
+		return err
 	}
+
+	if _, err = io.Copy(f, io.NewSectionReader(this.file, 0, this.metaOffset)); err == nil {
+		if _, err = flvcodec.NewSrsFlvEncoder(f).WriteMetaData(data); err == nil {
+			// skip the 11B tag header, data and 4B previous tag size.
+			from := this.metaOffset + 11 + int64(this.metaSize) + 4
+			_, err = io.Copy(f, io.NewSectionReader(this.file, from, oldSize - from))
+		}
+	}
+	if err != nil {
+		f.Close()
+		this.storage.Remove(metaFile)
+		return err
+	}
+
+	this.file.Close()
+	this.file, this.metaFile, this.metaSize = f, metaFile, len(data)
 	return nil
-}
\ No newline at end of file
+}
+
+/**
+* scan the tags of flv, to load the metadata, keyframes and duration,
+* stop at the partial or corrupt tag.
+* @param size the size of file.
+* @return the end of the last complete tag, and the timestamp of last audio or video.
+*/
+func (this *SrsFlvSegment) scan(size int64) (int64, int64) {
+	offset := int64(13)
+	startTime, lastTime := int64(-1), int64(-1)
+	th := make([]byte, 11)
+	for offset + 11 <= size {
+		if _, err := this.file.ReadAt(th, offset); err != nil {
+			break
+		}
+
+		dataSize := int64(th[1]) << 16 | int64(th[2]) << 8 | int64(th[3])
+		timestamp := int64(th[7]) << 24 | int64(th[4]) << 16 | int64(th[5]) << 8 | int64(th[6])
+		if offset + 11 + dataSize + 4 > size {
+			break
+		}
+
+		pts := make([]byte, 4)
+		if _, err := this.file.ReadAt(pts, offset + 11 + dataSize); err != nil || int64(binary.BigEndian.Uint32(pts)) != 11 + dataSize {
+			break
+		}
+
+		switch th[0] & 0x1f {
+			case flvcodec.MetaDataTagType: {
+				data := make([]byte, dataSize)
+				if _, err := this.file.ReadAt(data, offset + 11); err != nil {
+					break
+				}
+				if this.metaData == nil {
+					this.metaData, this.metaName = srs_flv_decode_metadata(data)
+					this.metaOffset, this.metaSize = offset, int(dataSize)
+				}
+			}
+			case flvcodec.VideoTagType, flvcodec.AudioTagType: {
+				if startTime < 0 {
+					startTime = timestamp
+				}
+				lastTime = timestamp
+
+				if th[0] & 0x1f == flvcodec.VideoTagType && dataSize >= 2 {
+					v := make([]byte, 2)
+					if _, err := this.file.ReadAt(v, offset + 11); err == nil && flvcodec.VideoIsKeyFrame(v) && !flvcodec.VideoIsSequenceHeader(v) {
+						this.keyframeTimes = append(this.keyframeTimes, float64(timestamp) / 1000)
+						this.keyframePositions = append(this.keyframePositions, float64(offset))
+					}
+				}
+			}
+		}
+		offset += 11 + dataSize + 4
+	}
+
+	if startTime >= 0 {
+		this.startTime = startTime
+		this.duration = lastTime - startTime
+	}
+	return offset, lastTime
+}
+
+/**
+* decode the metadata of tag, the name and the object or ecma array.
+*/
+func srs_flv_decode_metadata(data []byte) (amf0.SrsAmf0Any, amf0.SrsAmf0String) {
+	stream := utils.NewSrsStream(data)
+
+	var name amf0.SrsAmf0String
+	if err := name.Decode(stream); err != nil {
+		return nil, name
+	}
+
+	marker, err := stream.PeekByte()
+	if err != nil || (marker != amf0.RTMP_AMF0_Object && marker != amf0.RTMP_AMF0_EcmaArray) {
+		return nil, name
+	}
+
+	metaData := amf0.GenerateSrsAmf0Any(marker)
+	if err := metaData.Decode(stream); err != nil && err != io.EOF {
+		return nil, name
+	}
+	return metaData, name
+}
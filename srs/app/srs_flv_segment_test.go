@@ -0,0 +1,270 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 GOSRS(gosrs)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package app
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"go_srs/srs/app/config"
+	"go_srs/srs/protocol/amf0"
+	"go_srs/srs/protocol/rtmp"
+	"go_srs/srs/utils"
+)
+
+func testFlvMessage(timestamp int64, payload []byte) *rtmp.SrsRtmpMessage {
+	msg := rtmp.NewSrsRtmpMessage()
+	msg.SetHeader(rtmp.SrsMessageHeader{})
+	msg.GetHeader().SetTimestamp(timestamp)
+	msg.SetPayload(payload)
+	return msg
+}
+
+func testFlvMetaData() *rtmp.SrsRtmpMessage {
+	stream := utils.NewSrsStream([]byte{})
+	amf0.NewSrsAmf0String("@setDataFrame").Encode(stream)
+	amf0.NewSrsAmf0String("onMetaData").Encode(stream)
+	obj := amf0.NewSrsAmf0Object()
+	obj.Set("width", float64(1280))
+	obj.Set("height", float64(720))
+	obj.Encode(stream)
+	return testFlvMessage(0, stream.Data())
+}
+
+func testFlvSetup(t *testing.T, jitter string) (*SrsRequest, string) {
+	dir, err := ioutil.TempDir("", "srs-flv-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vhosts := config.GetInstance().VHosts
+	t.Cleanup(func() {
+		config.GetInstance().VHosts = vhosts
+		os.RemoveAll(dir)
+	})
+
+	config.GetInstance().VHosts = map[string]*config.VHostConf{
+		"__defaultVhost__": {
+			Enabled: "on",
+			Dvr: &config.DvrConf{
+				Enabled:     "on",
+				DvrPlan:     "append",
+				DvrPath:     dir + "/[app]/[stream].[timestamp].flv",
+				TimerJitter: jitter,
+			},
+		},
+	}
+
+	req := NewSrsRequest()
+	req.vhost, req.app, req.stream = "__defaultVhost__", "live", "livestream"
+	return req, dir + "/live/livestream.flv"
+}
+
+/**
+* record a session to the appendable flv, the keyframe every gop frames,
+* the timestamp of encoder starts at start.
+*/
+func testFlvRecord(t *testing.T, req *SrsRequest, start int64, frames int, gop int) {
+	segment := NewSrsFlvSegment(req)
+	segment.appendable = true
+	if err := segment.Open(true); err != nil {
+		t.Fatal("open failed, err=", err)
+	}
+
+	if err := segment.WriteMetaData(testFlvMetaData()); err != nil {
+		t.Fatal(err)
+	}
+	if err := segment.WriteVideo(testFlvMessage(start, []byte{0x17, 0, 0, 0, 0, 1, 0x64, 0, 0x1f})); err != nil {
+		t.Fatal(err)
+	}
+	if err := segment.WriteAudio(testFlvMessage(start, []byte{0xaf, 0, 0x12, 0x10})); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < frames; i++ {
+		frame := []byte{0x27, 1, 0, 0, 0, 1, 2, 3, 4}
+		if i % gop == 0 {
+			frame[0] = 0x17
+		}
+		if err := segment.WriteVideo(testFlvMessage(start + int64(i) * 40, frame)); err != nil {
+			t.Fatal(err)
+		}
+		if err := segment.WriteAudio(testFlvMessage(start + int64(i) * 40 + 20, []byte{0xaf, 1, 1, 2, 3})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := segment.Close(); err != nil {
+		t.Fatal("close failed, err=", err)
+	}
+}
+
+type testFlvFile struct {
+	size       int64
+	timestamps []int64 // the timestamp of audio and video tags.
+	keyframes  int
+	duration   float64 // the duration of metadata in seconds.
+	filesize   float64 // the filesize of metadata.
+	positions  int     // the keyframes of metadata.
+}
+
+/**
+* parse the flv, all tags must be complete.
+*/
+func testFlvParse(t *testing.T, file string) *testFlvFile {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 13 || string(data[:3]) != "FLV" {
+		t.Fatal("invalid flv header")
+	}
+
+	f := &testFlvFile{size: int64(len(data))}
+	offset := 13
+	for offset < len(data) {
+		if offset + 11 > len(data) {
+			t.Fatal("partial tag header at", offset)
+		}
+		th := data[offset:]
+		size := int(th[1]) << 16 | int(th[2]) << 8 | int(th[3])
+		timestamp := int64(th[7]) << 24 | int64(th[4]) << 16 | int64(th[5]) << 8 | int64(th[6])
+		if offset + 11 + size + 4 > len(data) {
+			t.Fatal("partial tag at", offset)
+		}
+		if pts := binary.BigEndian.Uint32(data[offset + 11 + size:]); int(pts) != 11 + size {
+			t.Fatal("invalid previous tag size at", offset)
+		}
+
+		payload := data[offset + 11:offset + 11 + size]
+		switch th[0] {
+			case 18: {
+				meta, _ := srs_flv_decode_metadata(payload)
+				obj, ok := meta.(*amf0.SrsAmf0Object)
+				if !ok {
+					t.Fatal("invalid metadata")
+				}
+				obj.Get("duration", &f.duration)
+				obj.Get("filesize", &f.filesize)
+				for _, p := range obj.Properties {
+					if p.Name.Value != "keyframes" {
+						continue
+					}
+					for _, kp := range p.Value.(*amf0.SrsAmf0Object).Properties {
+						if kp.Name.Value == "filepositions" {
+							f.positions = len(kp.Value.(*amf0.SrsAmf0StrictArray).GetValue().([]amf0.SrsAmf0Any))
+						}
+					}
+				}
+			}
+			case 8, 9: {
+				f.timestamps = append(f.timestamps, timestamp)
+				if th[0] == 9 && payload[0] == 0x17 && payload[1] == 1 {
+					f.keyframes++
+				}
+			}
+		}
+		offset += 11 + size + 4
+	}
+	return f
+}
+
+func testFlvAppend(t *testing.T, jitter string) {
+	req, file := testFlvSetup(t, jitter)
+
+	testFlvRecord(t, req, 1000, 100, 25)
+	first := testFlvParse(t, file)
+
+	// the partial tag when the server killed.
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{9, 0, 0, 100, 0, 0, 0, 0, 0, 0, 0, 0x27, 1})
+	f.Close()
+
+	// the encoder restarts the timestamp when republish.
+	testFlvRecord(t, req, 0, 50, 25)
+	combined := testFlvParse(t, file)
+
+	// the sequence headers and 50 frames of audio and video are appended.
+	if expect := len(first.timestamps) + 2 + 50 * 2; len(combined.timestamps) != expect {
+		t.Error("expect tags", expect, "actual", len(combined.timestamps))
+	}
+	for i := 1; i < len(combined.timestamps); i++ {
+		if combined.timestamps[i] < combined.timestamps[i - 1] {
+			t.Fatal("timestamp not monotonic at", i, combined.timestamps[i - 1], "to", combined.timestamps[i])
+		}
+	}
+
+	last := combined.timestamps[len(combined.timestamps) - 1]
+	if last < first.timestamps[len(first.timestamps) - 1] + 49 * 40 {
+		t.Error("timestamp restarts after append, last", last)
+	}
+	if combined.duration * 1000 < float64(last - combined.timestamps[0]) - 40 {
+		t.Error("duration not cover the combined file", combined.duration)
+	}
+	if int64(combined.filesize) != combined.size {
+		t.Error("expect filesize", combined.size, "actual", combined.filesize)
+	}
+	if combined.keyframes != 6 || combined.positions != 6 {
+		t.Error("expect 6 keyframes, actual", combined.keyframes, combined.positions)
+	}
+}
+
+func TestFlvSegmentAppend(t *testing.T) {
+	for _, jitter := range []string{config.SRS_CONF_TIME_JITTER_FULL, config.SRS_CONF_TIME_JITTER_ZERO, config.SRS_CONF_TIME_JITTER_OFF} {
+		t.Run(jitter, func(t *testing.T) {
+			testFlvAppend(t, jitter)
+		})
+	}
+}
+
+func TestFlvSegmentRewriteMetaData(t *testing.T) {
+	req, file := testFlvSetup(t, config.SRS_CONF_TIME_JITTER_FULL)
+
+	// the keyframes exceed the reserved space, the file is rewritten.
+	testFlvRecord(t, req, 0, SRS_DVR_FLV_KEYFRAMES_RESERVE + 10, 1)
+	first := testFlvParse(t, file)
+	if first.positions != SRS_DVR_FLV_KEYFRAMES_RESERVE + 10 || int64(first.filesize) != first.size {
+		t.Fatal("invalid rewritten metadata, keyframes", first.positions, "filesize", first.filesize, "size", first.size)
+	}
+	if matches, _ := filepath.Glob(file + "*"); len(matches) != 1 {
+		t.Fatal("expect no tmp files, actual", matches)
+	}
+
+	// the padding is reserved again, the append is updated in place.
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFlvRecord(t, req, 0, 10, 1)
+	if ninfo, err := os.Stat(file); err != nil || !os.SameFile(info, ninfo) {
+		t.Error("the file is rewritten again")
+	}
+
+	combined := testFlvParse(t, file)
+	if combined.positions != first.positions + 10 || int64(combined.filesize) != combined.size {
+		t.Error("invalid appended metadata, keyframes", combined.positions, "filesize", combined.filesize, "size", combined.size)
+	}
+}
@@ -0,0 +1,231 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 GOSRS(gosrs)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package app
+
+import (
+	"errors"
+	"io"
+	"go_srs/srs/codec"
+)
+
+// the default duration of the last sample of fragment, when no previous sample.
+const SRS_FMP4_DEFAULT_VIDEO_DURATION = 3000 // 30fps in 90khz
+const SRS_FMP4_DEFAULT_AUDIO_DURATION = 1920 // 1024 samples of 48khz in 90khz
+
+/**
+* the context of fMP4 muxer, shared by all segments of a stream,
+* like the SrsTsContext for ts, to keep the fragment sequence monotonically.
+*/
+type SrsFmp4Context struct {
+	sequence      uint32
+	videoDuration uint32
+	audioDuration uint32
+}
+
+func NewSrsFmp4Context() *SrsFmp4Context {
+	return &SrsFmp4Context{
+		sequence:      1,
+		videoDuration: SRS_FMP4_DEFAULT_VIDEO_DURATION,
+		audioDuration: SRS_FMP4_DEFAULT_AUDIO_DURATION,
+	}
+}
+
+/**
+* the fMP4(CMAF) muxer, gather the ts messages of hls cache to samples,
+* and write them as a moof/mdat fragment when flush.
+* the video payload of ts message is annexb, which is converted to avcc,
+* and the adts header of aac is removed.
+*/
+type SrsFmp4Muxer struct {
+	writer  io.Writer
+	context *SrsFmp4Context
+	acodec  codec.SrsCodecAudio
+	video   []*SrsMp4Sample
+	audio   []*SrsMp4Sample
+}
+
+func NewSrsFmp4Muxer(w io.Writer, c *SrsFmp4Context, ac codec.SrsCodecAudio) *SrsFmp4Muxer {
+	return &SrsFmp4Muxer{
+		writer:  w,
+		context: c,
+		acodec:  ac,
+		video:   make([]*SrsMp4Sample, 0),
+		audio:   make([]*SrsMp4Sample, 0),
+	}
+}
+
+func (this *SrsFmp4Muxer) UpdateACodec(ac codec.SrsCodecAudio) error {
+	this.acodec = ac
+	return nil
+}
+
+func (this *SrsFmp4Muxer) WriteVideo(video *SrsTsMessage) error {
+	data, keyframe := fmp4_annexb_to_avcc(video.payload)
+	if len(data) == 0 {
+		return errors.New("fmp4: no video nalu")
+	}
+
+	sample := &SrsMp4Sample{
+		dts:      video.dts,
+		pts:      video.pts,
+		keyframe: keyframe,
+		data:     data,
+	}
+
+	if n := len(this.video); n > 0 && sample.dts > this.video[n-1].dts {
+		this.context.videoDuration = uint32(sample.dts - this.video[n-1].dts)
+		this.video[n-1].duration = this.context.videoDuration
+	}
+	sample.duration = this.context.videoDuration
+	this.video = append(this.video, sample)
+	return nil
+}
+
+func (this *SrsFmp4Muxer) WriteAudio(audio *SrsTsMessage) error {
+	data := audio.payload
+	if this.acodec == codec.SrsCodecAudioAAC {
+		data = fmp4_adts_to_raw(audio.payload)
+	}
+	if len(data) == 0 {
+		return errors.New("fmp4: no audio frame")
+	}
+
+	sample := &SrsMp4Sample{
+		dts:      audio.dts,
+		pts:      audio.dts,
+		keyframe: true,
+		data:     data,
+	}
+
+	if n := len(this.audio); n > 0 && sample.dts > this.audio[n-1].dts {
+		this.context.audioDuration = uint32(sample.dts - this.audio[n-1].dts)
+		this.audio[n-1].duration = this.context.audioDuration
+	}
+	sample.duration = this.context.audioDuration
+	this.audio = append(this.audio, sample)
+	return nil
+}
+
+/**
+* write the gathered samples as a fragment.
+*/
+func (this *SrsFmp4Muxer) Flush() error {
+	if len(this.video) == 0 && len(this.audio) == 0 {
+		return nil
+	}
+
+	fragment := mp4_fragment(this.context.sequence, this.video, this.audio)
+	this.context.sequence++
+	this.video = this.video[0:0]
+	this.audio = this.audio[0:0]
+
+	_, err := this.writer.Write(fragment)
+	return err
+}
+
+/**
+* convert the annexb of ts cache to avcc, the sps/pps/aud is ignored for
+* they are in the avcC of init segment.
+* @return the avcc data and whether it's a keyframe.
+*/
+func fmp4_annexb_to_avcc(payload []byte) ([]byte, bool) {
+	data := make([]byte, 0, len(payload))
+	keyframe := false
+
+	nalus := fmp4_split_annexb(payload)
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+
+		naluType := codec.SrsAvcNaluType(nalu[0] & 0x1f)
+		if naluType == codec.SrsAvcNaluTypeAccessUnitDelimiter || naluType == codec.SrsAvcNaluTypeSPS || naluType == codec.SrsAvcNaluTypePPS {
+			continue
+		}
+
+		if naluType == codec.SrsAvcNaluTypeIDR {
+			keyframe = true
+		}
+		data = append(data, mp4_u32(uint32(len(nalu)))...)
+		data = append(data, nalu...)
+	}
+	return data, keyframe
+}
+
+/**
+* split the annexb by the start code 00 00 01 or 00 00 00 01.
+*/
+func fmp4_split_annexb(payload []byte) [][]byte {
+	nalus := make([][]byte, 0)
+	start := -1
+	for i := 0; i+2 < len(payload); {
+		if payload[i] == 0x00 && payload[i+1] == 0x00 && payload[i+2] == 0x01 {
+			if start >= 0 {
+				end := i
+				// the 4bytes start code, 00 00 00 01.
+				if end > start && payload[end-1] == 0x00 {
+					end--
+				}
+				nalus = append(nalus, payload[start:end])
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+
+	if start >= 0 && start < len(payload) {
+		nalus = append(nalus, payload[start:])
+	}
+	return nalus
+}
+
+/**
+* remove the adts header of aac frames.
+* @see: 6.2 Audio Data Transport Stream, ADTS, aac-iso-13818-7.pdf, page 26.
+*/
+func fmp4_adts_to_raw(payload []byte) []byte {
+	data := make([]byte, 0, len(payload))
+	for p := payload; len(p) >= 7; {
+		if p[0] != 0xff || (p[1]&0xf0) != 0xf0 {
+			break
+		}
+
+		protectionAbsent := p[1] & 0x01
+		headerSize := 7
+		if protectionAbsent == 0 {
+			headerSize = 9
+		}
+
+		frameLength := (int(p[3]&0x03) << 11) | (int(p[4]) << 3) | (int(p[5]>>5) & 0x07)
+		if frameLength < headerSize || frameLength > len(p) {
+			break
+		}
+
+		data = append(data, p[headerSize:frameLength]...)
+		p = p[frameLength:]
+	}
+	return data
+}
@@ -0,0 +1,204 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 GOSRS(gosrs)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"go_srs/srs/codec"
+)
+
+var testFmp4Sps = []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60}
+var testFmp4Pps = []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+
+/**
+* the codec with the avc and aac sequence headers.
+*/
+func testFmp4Codec(t *testing.T) *SrsAvcAacCodec {
+	c := NewSrsAvcAacCodec()
+
+	avc := []byte{0x17, 0, 0, 0, 0, 1, 0x64, 0, 0x1f, 0xff, 0xe1, 0, byte(len(testFmp4Sps))}
+	avc = append(avc, testFmp4Sps...)
+	avc = append(avc, 1, 0, byte(len(testFmp4Pps)))
+	avc = append(avc, testFmp4Pps...)
+	if err := c.video_avc_demux(avc, NewSrsCodecSample()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.audio_aac_demux([]byte{0xaf, 0, 0x12, 0x10}, NewSrsCodecSample()); err != nil {
+		t.Fatal(err)
+	}
+	if !c.is_avc_codec_ok() || !c.is_aac_codec_ok() {
+		t.Fatal("invalid sequence headers")
+	}
+	return c
+}
+
+func testFmp4Message(dts int64, pts int64, payload []byte) *SrsTsMessage {
+	msg := NewSrsTsMessage()
+	msg.dts, msg.pts, msg.payload = dts, pts, payload
+	return msg
+}
+
+/**
+* the adts frame of aac lc, 44100hz, stereo, without crc.
+*/
+func testFmp4Adts(raw []byte) []byte {
+	size := 7 + len(raw)
+	header := []byte{0xff, 0xf1, 0x50, 0x80 | byte(size >> 11), byte(size >> 3), byte(size << 5) | 0x1f, 0xfc}
+	return append(header, raw...)
+}
+
+/**
+* the sample data of trun in moof, by the data_offset from the moof.
+*/
+func testFmp4TrunData(t *testing.T, fragment []byte, traf []byte) [][]byte {
+	truns := srs_mp4_children(traf, "trun")
+	if len(truns) != 1 {
+		t.Fatal("expect 1 trun, actual", len(truns))
+	}
+
+	trun := truns[0]
+	count := int(binary.BigEndian.Uint32(trun[4:]))
+	offset := int(binary.BigEndian.Uint32(trun[8:]))
+	samples := make([][]byte, 0, count)
+	for i, p := 0, trun[12:]; i < count; i, p = i + 1, p[16:] {
+		size := int(binary.BigEndian.Uint32(p[4:]))
+		if offset + size > len(fragment) {
+			t.Fatal("sample out of fragment, offset", offset, "size", size)
+		}
+		samples = append(samples, fragment[offset:offset + size])
+		offset += size
+	}
+	return samples
+}
+
+func TestFmp4InitSegment(t *testing.T) {
+	init := mp4_init_segment(testFmp4Codec(t), true, true)
+
+	if ftyp := srs_mp4_children(init, "ftyp"); len(ftyp) != 1 {
+		t.Fatal("expect ftyp")
+	}
+	moov := srs_mp4_children(init, "moov")
+	if len(moov) != 1 {
+		t.Fatal("expect moov")
+	}
+	if traks := srs_mp4_children(moov[0], "trak"); len(traks) != 2 {
+		t.Error("expect 2 traks, actual", len(traks))
+	}
+	mvex := srs_mp4_children(moov[0], "mvex")
+	if len(mvex) != 1 || len(srs_mp4_children(mvex[0], "trex")) != 2 {
+		t.Error("expect 2 trex in mvex")
+	}
+
+	// the track without sequence header is ignored.
+	moov = srs_mp4_children(mp4_init_segment(NewSrsAvcAacCodec(), true, true), "moov")
+	if len(moov) != 1 || len(srs_mp4_children(moov[0], "trak")) != 0 {
+		t.Error("expect no trak without sequence header")
+	}
+}
+
+func TestFmp4Fragment(t *testing.T) {
+	idr, p := []byte{0x65, 0x88, 0x84, 0x00}, []byte{0x41, 0x9a, 0x02}
+	aac := [][]byte{{0x21, 0x10, 0x04}, {0x21, 0x10, 0x05, 0x06}}
+
+	var w bytes.Buffer
+	context := NewSrsFmp4Context()
+	muxer := NewSrsFmp4Muxer(&w, context, codec.SrsCodecAudioAAC)
+
+	// the annexb with aud, sps and pps, in 3bytes and 4bytes start code.
+	keyframe := []byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 0, 1}
+	keyframe = append(keyframe, testFmp4Sps...)
+	keyframe = append(keyframe, 0, 0, 1)
+	keyframe = append(keyframe, testFmp4Pps...)
+	keyframe = append(keyframe, 0, 0, 0, 1)
+	keyframe = append(keyframe, idr...)
+	if err := muxer.WriteVideo(testFmp4Message(90000, 93600, keyframe)); err != nil {
+		t.Fatal(err)
+	}
+	if err := muxer.WriteVideo(testFmp4Message(93600, 93600, append([]byte{0, 0, 1}, p...))); err != nil {
+		t.Fatal(err)
+	}
+	// the two adts frames in a pes.
+	if err := muxer.WriteAudio(testFmp4Message(90000, 90000, append(testFmp4Adts(aac[0]), testFmp4Adts(aac[1])...))); err != nil {
+		t.Fatal(err)
+	}
+	if err := muxer.WriteAudio(testFmp4Message(91920, 91920, testFmp4Adts(aac[0]))); err != nil {
+		t.Fatal(err)
+	}
+	if err := muxer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	fragment := w.Bytes()
+	moof, mdat := srs_mp4_children(fragment, "moof"), srs_mp4_children(fragment, "mdat")
+	if len(moof) != 1 || len(mdat) != 1 {
+		t.Fatal("expect a moof and a mdat")
+	}
+	if mfhd := srs_mp4_children(moof[0], "mfhd"); len(mfhd) != 1 || binary.BigEndian.Uint32(mfhd[0][4:]) != 1 || context.sequence != 2 {
+		t.Error("invalid sequence of mfhd")
+	}
+
+	trafs := srs_mp4_children(moof[0], "traf")
+	if len(trafs) != 2 {
+		t.Fatal("expect 2 trafs, actual", len(trafs))
+	}
+
+	// the video samples, the duration of last sample is the previous one.
+	if from, to, ok := srs_mp4_traf_time(trafs[0]); !ok || from != 90000 || to != 90000 + 3600 * 2 {
+		t.Error("invalid video time", from, to, ok)
+	}
+	video := testFmp4TrunData(t, fragment, trafs[0])
+	if len(video) != 2 {
+		t.Fatal("expect 2 video samples, actual", len(video))
+	}
+	if expect := append([]byte{0, 0, 0, byte(len(idr))}, idr...); !bytes.Equal(video[0], expect) {
+		t.Error("expect avcc idr only, actual", video[0])
+	}
+	if expect := append([]byte{0, 0, 0, byte(len(p))}, p...); !bytes.Equal(video[1], expect) {
+		t.Error("expect avcc p frame, actual", video[1])
+	}
+
+	// the audio samples, the adts header is removed.
+	if from, to, ok := srs_mp4_traf_time(trafs[1]); !ok || from != 90000 || to != 90000 + 1920 * 2 {
+		t.Error("invalid audio time", from, to, ok)
+	}
+	audio := testFmp4TrunData(t, fragment, trafs[1])
+	if len(audio) != 2 || !bytes.Equal(audio[0], append(append([]byte{}, aac[0]...), aac[1]...)) || !bytes.Equal(audio[1], aac[0]) {
+		t.Error("expect raw aac, actual", audio)
+	}
+
+	// the samples are all in the mdat, video then audio.
+	if len(mdat[0]) != len(video[0]) + len(video[1]) + len(audio[0]) + len(audio[1]) {
+		t.Error("invalid mdat size", len(mdat[0]))
+	}
+
+	// the cts of keyframe.
+	trun := srs_mp4_children(trafs[0], "trun")[0]
+	if flags := binary.BigEndian.Uint32(trun[12 + 8:]); flags != SRS_MP4_SAMPLE_FLAGS_SYNC {
+		t.Error("expect sync sample, actual", flags)
+	}
+	if cts := int32(binary.BigEndian.Uint32(trun[12 + 12:])); cts != 3600 {
+		t.Error("expect cts 3600, actual", cts)
+	}
+}
@@ -170,7 +170,7 @@ func (this *SrsHls) on_video(video *rtmp.SrsRtmpMessage) error {
 	}
 	
 	if this.sample.FrameType == codec.SrsCodecVideoAVCFrameKeyFrame && this.sample.AvcPacketType == codec.SrsCodecVideoAVCTypeSequenceHeader {
-		return this.hlsCache.on_sequence_header(this.muxer)
+		return this.hlsCache.on_sequence_header(this.codec, this.muxer)
 	}
 	//todo add jitter
 	dts := video.GetHeader().GetTimestamp()*90
@@ -202,7 +202,7 @@ func (this *SrsHls) on_audio(audio *rtmp.SrsRtmpMessage) error {
 	}
 
 	if acodec == codec.SrsCodecAudioAAC && this.sample.AacPacketType == codec.SrsCodecAudioTypeSequenceHeader {
-		return this.hlsCache.on_sequence_header(this.muxer)
+		return this.hlsCache.on_sequence_header(this.codec, this.muxer)
 	}
 	//todo config jitter
 	dts := int64(audio.GetHeader().GetTimestamp()*90)
@@ -67,9 +67,24 @@ func (this *SrsHlsCache) onPublish(muxer *SrsHlsMuxer, req *SrsRequest, segment_
 	tsFile := config.GetHlsTsFile(vhostName)
 	cleanUp := config.GetHlsCleanup(vhostName)
 	hlsWaitKeyframe := config.GetHlsWaitKeyframe(vhostName)
+	tsFloor := config.GetHlsTsFloor(vhostName)
 	// this.muxer
 	fmt.Println("**************m3u8File=", m3u8File, "***************")
-	muxer.UpdateConfig(req, entryPrefix, hlsPath, m3u8File, tsFile, float64(hlsFragment), float64(hlsWindow), false, 0.0, cleanUp, hlsWaitKeyframe)
+	muxer.UpdateConfig(req, entryPrefix, hlsPath, m3u8File, tsFile, float64(hlsFragment), float64(hlsWindow), tsFloor, 0.0, cleanUp, hlsWaitKeyframe)
+	muxer.UpdateSegmentType(config.GetHlsSegmentType(vhostName), config.GetHlsInitFile(vhostName))
+	muxer.UpdateLowLatency(config.GetHlsLowLatency(vhostName), config.GetHlsPartTarget(vhostName))
+	muxer.UpdateProgramDateTime(config.GetHlsProgramDateTime(vhostName))
+	muxer.UpdateKeys(config.GetHlsKeys(vhostName), config.GetHlsFragmentsPerKey(vhostName))
+	muxer.UpdateDvrWindow(config.GetHlsDvrWindow(vhostName), config.GetHlsDvrM3u8File(vhostName), config.GetHlsDvrCleanup(vhostName))
+
+	// continue the hls state of the previous publish in process, whatever the storage
+	// and segment type, or recover from the m3u8 before restart.
+	if muxer.restore_publish_state() {
+		// the timestamp and codec may change when republish.
+		muxer.mark_discontinuity("republish")
+	} else if err := muxer.recover(); err != nil {
+		fmt.Println("hls: recover failed, err=", err)
+	}
 
 	muxer.SegmentOpen(segment_start_dts)
 	return nil
@@ -81,9 +96,18 @@ func (this *SrsHlsCache) onPublish(muxer *SrsHlsMuxer, req *SrsRequest, segment_
 * @see: hls-m3u8-draft-pantos-http-live-streaming-12.txt
 * @see: 3.4.11.  EXT-X-DISCONTINUITY
  */
-func (this *SrsHlsCache) on_sequence_header(muxer *SrsHlsMuxer) error {
+func (this *SrsHlsCache) on_sequence_header(c *SrsAvcAacCodec, muxer *SrsHlsMuxer) error {
+
+	return muxer.on_sequence_header(c)
+}
 
-	return muxer.on_sequence_header()
+/**
+* when unpublish, reap the current segment and refresh the m3u8.
+ */
+func (this *SrsHlsCache) on_unpublish(muxer *SrsHlsMuxer) error {
+	err := muxer.segment_close()
+	muxer.on_unpublish()
+	return err
 }
 
 /**
@@ -94,6 +118,16 @@ func (this *SrsHlsCache) write_audio(c *SrsAvcAacCodec, muxer *SrsHlsMuxer, dts
 		return err
 	}
 
+	// for pure audio, reap the segment for discontinuity at any frame.
+	if muxer.discontinuity && !c.is_avc_codec_ok() {
+		if err := muxer.segment_close(); err != nil {
+			return err
+		}
+		if err := muxer.SegmentOpen(dts); err != nil {
+			return err
+		}
+	}
+
 	if err := muxer.flush_audio(this.cache); err != nil {
 		return err
 	}
@@ -105,7 +139,7 @@ func (this *SrsHlsCache) WriteVideo(c *SrsAvcAacCodec, muxer *SrsHlsMuxer, dts i
 		return err
 	}
 
-	if muxer.is_segment_overflow() {
+	if muxer.is_segment_overflow() || muxer.discontinuity {
 		if !muxer.hls_wait_keyframe || sample.FrameType == codec.SrsCodecVideoAVCFrameKeyFrame {
 			if err := this.reap_segment("video", muxer, this.cache.video.dts); err != nil {
 				return err
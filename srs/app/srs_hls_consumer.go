@@ -23,11 +23,16 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 package app
 
 import (
+	"fmt"
+	"go_srs/srs/app/config"
 	"go_srs/srs/protocol/rtmp"
 	"go_srs/srs/utils"
 	"go_srs/srs/codec"
 )
 
+// the max positive delta of timestamp, the larger is a jump of encoder.
+const SRS_HLS_TIMESTAMP_JUMP_MS = 3000
+
 type SrsHlsConsumer struct {
 	source          *SrsSource
 	req 			*SrsRequest
@@ -40,6 +45,11 @@ type SrsHlsConsumer struct {
 
 	lastUpdateTime	int64
 	streamDts 		int64
+	disabled		bool // whether hls is disabled for this publish, by hls_on_error.
+	waitKeyframe	bool // whether wait for keyframe to continue, by hls_on_error.
+	unpublished		bool // whether the muxer is unpublished by hls_on_error.
+	jitter			*SrsRtmpJitter
+	jitterAlgorithm	SrsRtmpJitterAlgorithm // the time_jitter of vhost.
 }
 
 func NewSrsHlsConsumer(s *SrsSource, req *SrsRequest) *SrsHlsConsumer {
@@ -57,6 +67,8 @@ func NewSrsHlsConsumer(s *SrsSource, req *SrsRequest) *SrsHlsConsumer {
 
 func (this *SrsHlsConsumer) OnPublish() error {
 	this.muxer.initialize()
+	this.jitter = NewSrsRtmpJitter()
+	this.jitterAlgorithm = SrsTimeJitterString2Int(config.GetTimeJitter(this.req.vhost))
 
 	this.lastUpdateTime = utils.GetCurrentMs()
 	err := this.hlsCache.onPublish(this.muxer, this.req, this.streamDts)
@@ -68,8 +80,11 @@ func (this *SrsHlsConsumer) OnPublish() error {
 }
 
 func (this *SrsHlsConsumer) OnUnpublish() error {
-
-	return nil
+	// the segments are reaped when error, never unpublish again.
+	if this.unpublished {
+		return nil
+	}
+	return this.hlsCache.on_unpublish(this.muxer)
 }
 
 func (this *SrsHlsConsumer) ConsumeCycle() error {
@@ -80,13 +95,17 @@ func (this *SrsHlsConsumer) ConsumeCycle() error {
 		}
 
 		if msg != nil {
+			if this.disabled {
+				continue
+			}
+
 			if msg.GetHeader().IsVideo() {
 				if err := this.onVideo(msg); err != nil {
-					return err
+					this.onError(err)
 				}
 			} else if msg.GetHeader().IsAudio() {
 				if err := this.onAudio(msg); err != nil {
-					return err
+					this.onError(err)
 				}
 			} else {
 			}
@@ -95,6 +114,28 @@ func (this *SrsHlsConsumer) ConsumeCycle() error {
 	return nil
 }
 
+/**
+* process the hls error by hls_on_error.
+*/
+func (this *SrsHlsConsumer) onError(err error) {
+	strategy := config.GetHlsOnError(this.req.vhost)
+	fmt.Println("hls: error, strategy=", strategy, "stream=", this.req.stream, "err=", err)
+
+	switch strategy {
+	case config.SRS_CONF_HLS_ON_ERROR_IGNORE:
+		// reap the segments, and ignore the messages of this publish.
+		this.disabled, this.unpublished = true, true
+		this.hlsCache.on_unpublish(this.muxer)
+	case config.SRS_CONF_HLS_ON_ERROR_DISCONNECT:
+		this.disabled = true
+		this.source.KickPublisher()
+	default:
+		// drop the current segment, and continue at next keyframe.
+		this.muxer.reset()
+		this.waitKeyframe = true
+	}
+}
+
 func (this *SrsHlsConsumer) onVideo(video *rtmp.SrsRtmpMessage) error {
 	this.lastUpdateTime = utils.GetCurrentMs()
 
@@ -113,12 +154,22 @@ func (this *SrsHlsConsumer) onVideo(video *rtmp.SrsRtmpMessage) error {
 	}
 
 	if this.sample.FrameType == codec.SrsCodecVideoAVCFrameKeyFrame && this.sample.AvcPacketType == codec.SrsCodecVideoAVCTypeSequenceHeader {
-		return this.hlsCache.on_sequence_header(this.muxer)
+		return this.hlsCache.on_sequence_header(this.codec, this.muxer)
 	}
-	//todo add jitter
-	dts := video.GetHeader().GetTimestamp()*90
+	dts := this.correctTimestamp(video.GetHeader().GetTimestamp())
 	this.streamDts = dts
 
+	// continue at the keyframe after reset.
+	if this.waitKeyframe {
+		if this.sample.FrameType != codec.SrsCodecVideoAVCFrameKeyFrame {
+			return nil
+		}
+		if err := this.muxer.SegmentOpen(dts); err != nil {
+			return err
+		}
+		this.waitKeyframe = false
+	}
+
 	if err := this.hlsCache.WriteVideo(this.codec, this.muxer, dts, this.sample); err != nil {
 		return err
 	}
@@ -145,19 +196,49 @@ func (this *SrsHlsConsumer) onAudio(audio *rtmp.SrsRtmpMessage) error {
 	}
 
 	if acodec == codec.SrsCodecAudioAAC && this.sample.AacPacketType == codec.SrsCodecAudioTypeSequenceHeader {
-		return this.hlsCache.on_sequence_header(this.muxer)
+		return this.hlsCache.on_sequence_header(this.codec, this.muxer)
 	}
-	//todo config jitter
-	dts := int64(audio.GetHeader().GetTimestamp()*90)
+	dts := this.correctTimestamp(audio.GetHeader().GetTimestamp())
 	// for pure audio, we need to update the stream dts also.
 	this.streamDts = dts
 
+	if this.waitKeyframe {
+		// for pure audio, continue at any frame.
+		if this.codec.is_avc_codec_ok() {
+			return nil
+		}
+		if err := this.muxer.SegmentOpen(dts); err != nil {
+			return err
+		}
+		this.waitKeyframe = false
+	}
+
 	if err := this.hlsCache.write_audio(this.codec, this.muxer, dts, this.sample); err != nil {
 		return err
 	}
 	return nil
 }
 
+/**
+* correct the timestamp by time_jitter, and start a new segment with discontinuity
+* when the timestamp of encoder jumps, for example, the encoder restarts.
+* @return the dts in 90khz.
+*/
+func (this *SrsHlsConsumer) correctTimestamp(timestamp int64) int64 {
+	if this.jitter == nil {
+		this.jitter = NewSrsRtmpJitter()
+	}
+
+	ts := this.jitter.CorrectTimestamp(timestamp, this.jitterAlgorithm)
+	if delta := this.jitter.Delta(); delta < CONST_MAX_JITTER_MS_NEG || delta > SRS_HLS_TIMESTAMP_JUMP_MS {
+		fmt.Println("hls: timestamp jump, delta=", delta, "stream=", this.req.stream)
+		if !this.muxer.discontinuity {
+			this.muxer.mark_discontinuity("jump")
+		}
+	}
+	return ts * 90
+}
+
 func (this *SrsHlsConsumer) onMetadata(metaData *rtmp.SrsRtmpMessage) error {
 	return nil
 }
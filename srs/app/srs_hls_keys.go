@@ -0,0 +1,181 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 GOSRS(gosrs)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package app
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"go_srs/srs/app/config"
+	"go_srs/srs/utils"
+)
+
+const SRS_HLS_AES_KEY_SIZE = 16
+
+/**
+* the AES-128 key to encrypt the segments,
+* @see: 4.3.2.4. EXT-X-KEY, RFC8216.
+*/
+type SrsHlsKey struct {
+	key  []byte // the 16 bytes key.
+	uri  string // the uri of key in m3u8.
+	path string // the full path of key file, empty if not in file.
+}
+
+/**
+* the provider of keys, the file provider is used by default,
+* use SetHlsKeyProvider to get keys from others, for example, the KMS.
+*/
+type SrsHlsKeyProvider interface {
+	// generate the key of stream for the segments from sequence_no,
+	// which is rotated every hls_fragments_per_key segments.
+	GenerateKey(req *SrsRequest, sequence_no int) (*SrsHlsKey, error)
+}
+
+var hlsKeyProvider SrsHlsKeyProvider = &SrsHlsFileKeyProvider{}
+
+func SetHlsKeyProvider(p SrsHlsKeyProvider) {
+	hlsKeyProvider = p
+}
+
+/**
+* the provider which generates random keys and writes to hls_key_file_path.
+*/
+type SrsHlsFileKeyProvider struct {
+}
+
+func (this *SrsHlsFileKeyProvider) GenerateKey(req *SrsRequest, sequence_no int) (*SrsHlsKey, error) {
+	key := make([]byte, SRS_HLS_AES_KEY_SIZE)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	file := utils.Srs_path_build_stream(config.GetHlsKeyFile(req.vhost), req.vhost, req.app, req.stream)
+	file = strings.Replace(file, "[seq]", strconv.Itoa(sequence_no), -1)
+	full_path := config.GetHlsKeyFilePath(req.vhost) + "/" + file
+	if err := NewSrsStorage(req.vhost).WriteFile(full_path, key); err != nil {
+		return nil, err
+	}
+
+	// use the key url when specified, otherwise relative to m3u8.
+	uri := file
+	if url := config.GetHlsKeyUrl(req.vhost); url != "" {
+		uri = strings.TrimSuffix(url, "/") + "/" + file
+	} else {
+		m3u8 := utils.Srs_path_build_stream(config.GetHlsM3u8File(req.vhost), req.vhost, req.app, req.stream)
+		m3u8_dir := path.Dir(config.GetHlsPath(req.vhost) + "/" + m3u8)
+		if rel, err := filepath.Rel(m3u8_dir, full_path); err == nil {
+			uri = filepath.ToSlash(rel)
+		}
+	}
+
+	return &SrsHlsKey{
+		key:  key,
+		uri:  uri,
+		path: full_path,
+	}, nil
+}
+
+/**
+* the IV of segment, the big-endian binary of sequence number,
+* @see: 5.2. IV for AES-128, RFC8216.
+*/
+func srs_hls_segment_iv(sequence_no int) []byte {
+	iv := make([]byte, aes.BlockSize)
+	v := uint64(sequence_no)
+	for i := 0; i < 8; i++ {
+		iv[aes.BlockSize - 1 - i] = byte(v >> uint(8 * i))
+	}
+	return iv
+}
+
+func srs_hls_iv_hex(iv []byte) string {
+	return "0x" + strings.ToUpper(hex.EncodeToString(iv))
+}
+
+/**
+* the writer which encrypts by AES-128-CBC with PKCS7 padding,
+* the left bytes are padded and written when close.
+*/
+type SrsHlsAesWriter struct {
+	writer  io.Writer
+	mode    cipher.BlockMode
+	pending []byte
+}
+
+func NewSrsHlsAesWriter(w io.Writer, key []byte, iv []byte) (*SrsHlsAesWriter, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid aes iv")
+	}
+
+	return &SrsHlsAesWriter{
+		writer: w,
+		mode:   cipher.NewCBCEncrypter(block, iv),
+	}, nil
+}
+
+func (this *SrsHlsAesWriter) Write(p []byte) (int, error) {
+	this.pending = append(this.pending, p...)
+
+	n := len(this.pending) - len(this.pending) % aes.BlockSize
+	if n == 0 {
+		return len(p), nil
+	}
+
+	out := make([]byte, n)
+	this.mode.CryptBlocks(out, this.pending[:n])
+	this.pending = this.pending[n:]
+	if _, err := this.writer.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+/**
+* write the last block with PKCS7 padding.
+*/
+func (this *SrsHlsAesWriter) Close() error {
+	padding := aes.BlockSize - len(this.pending)
+	for i := 0; i < padding; i++ {
+		this.pending = append(this.pending, byte(padding))
+	}
+
+	out := make([]byte, len(this.pending))
+	this.mode.CryptBlocks(out, this.pending)
+	this.pending = nil
+	_, err := this.writer.Write(out)
+	return err
+}
@@ -0,0 +1,288 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 GOSRS(gosrs)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package app
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+* the live state of a LL-HLS stream, the media playlist and partial segments
+* are served from memory, and the playlist reload can be blocked until the
+* requested part is available.
+* @see: 6.2.5.2. Blocking Playlist Reload, draft-pantos-hls-rfc8216bis.
+*/
+type SrsHlsLive struct {
+	mtx         sync.Mutex
+	m3u8_url    string  // the m3u8 relative to hls_path, the key to serve it.
+	playlist    []byte
+	msn         int     // the media sequence number of the segment being written.
+	part        int     // the number of parts of the segment being written.
+	preload     string  // the file of the next part, relative to hls_path.
+	parts       map[string][]byte
+	timeout     time.Duration // the max time to block a request.
+	// closed and renewed when state changed, to wakeup the blocking requests.
+	notify      chan struct{}
+	alive       bool
+}
+
+var hlsLivePoolMtx sync.Mutex
+var hlsLivePool map[string]*SrsHlsLive
+
+func init() {
+	hlsLivePool = make(map[string]*SrsHlsLive)
+}
+
+/**
+* fetch the live state of the m3u8, which is relative to hls_path.
+*/
+func FetchOrCreateHlsLive(m3u8_url string) *SrsHlsLive {
+	hlsLivePoolMtx.Lock()
+	defer hlsLivePoolMtx.Unlock()
+
+	if l, ok := hlsLivePool[m3u8_url]; ok {
+		return l
+	}
+
+	l := &SrsHlsLive{
+		m3u8_url: m3u8_url,
+		parts:    make(map[string][]byte),
+		notify:   make(chan struct{}),
+	}
+	hlsLivePool[m3u8_url] = l
+	return l
+}
+
+/**
+* find the live state which serve the file, nil if none.
+*/
+func find_hls_live(file string) (*SrsHlsLive, bool) {
+	hlsLivePoolMtx.Lock()
+	defer hlsLivePoolMtx.Unlock()
+
+	if l, ok := hlsLivePool[file]; ok {
+		return l, true
+	}
+
+	for _, l := range hlsLivePool {
+		if l.has_part(file) {
+			return l, false
+		}
+	}
+	return nil, false
+}
+
+func (this *SrsHlsLive) on_publish(timeout time.Duration) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	this.timeout = timeout
+	this.alive = true
+}
+
+/**
+* when unpublish, wakeup all blocking requests and remove from pool,
+* the requests then fallback to the files.
+*/
+func (this *SrsHlsLive) on_unpublish() {
+	hlsLivePoolMtx.Lock()
+	if hlsLivePool[this.m3u8_url] == this {
+		delete(hlsLivePool, this.m3u8_url)
+	}
+	hlsLivePoolMtx.Unlock()
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	this.alive = false
+	this.playlist = nil
+	this.parts = make(map[string][]byte)
+	this.preload = ""
+	close(this.notify)
+	this.notify = make(chan struct{})
+}
+
+/**
+* update the live state, and wakeup the blocking requests.
+*/
+func (this *SrsHlsLive) update(playlist string, msn int, part int, preload string, parts map[string][]byte) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	this.playlist = []byte(playlist)
+	this.msn = msn
+	this.part = part
+	this.preload = preload
+	this.parts = parts
+	close(this.notify)
+	this.notify = make(chan struct{})
+}
+
+func (this *SrsHlsLive) has_part(file string) bool {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	if _, ok := this.parts[file]; ok {
+		return true
+	}
+	return this.preload != "" && this.preload == file
+}
+
+/**
+* wait until ready returns true, return false when timeout or unpublished.
+*/
+func (this *SrsHlsLive) wait(ready func() bool) bool {
+	deadline := time.After(this.timeout)
+	for {
+		this.mtx.Lock()
+		if !this.alive {
+			this.mtx.Unlock()
+			return false
+		}
+		if ready() {
+			this.mtx.Unlock()
+			return true
+		}
+		notify := this.notify
+		this.mtx.Unlock()
+
+		select {
+		case <-notify:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+/**
+* serve the media playlist, block when _HLS_msn specified,
+* @see: 6.2.5.2. Blocking Playlist Reload, draft-pantos-hls-rfc8216bis.
+*/
+func (this *SrsHlsLive) serve_playlist(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if v := q.Get("_HLS_msn"); v != "" {
+		msn, err := strconv.Atoi(v)
+		if err != nil || msn < 0 {
+			http.Error(w, "invalid _HLS_msn", http.StatusBadRequest)
+			return
+		}
+
+		// the _HLS_part is the index of part in msn, wait for the whole segment when not specified.
+		part := -1
+		if v := q.Get("_HLS_part"); v != "" {
+			if part, err = strconv.Atoi(v); err != nil || part < 0 {
+				http.Error(w, "invalid _HLS_part", http.StatusBadRequest)
+				return
+			}
+		}
+
+		this.mtx.Lock()
+		current := this.msn
+		this.mtx.Unlock()
+		// the server MUST respond 400 when the msn is more than two segments in the future.
+		if msn > current + 2 {
+			http.Error(w, "_HLS_msn too far in the future", http.StatusBadRequest)
+			return
+		}
+
+		ok := this.wait(func() bool {
+			if part < 0 {
+				return this.msn > msn
+			}
+			return this.msn > msn || (this.msn == msn && this.part > part)
+		})
+		if !ok {
+			http.Error(w, "playlist not available", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	this.mtx.Lock()
+	playlist := this.playlist
+	this.mtx.Unlock()
+	if playlist == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(playlist)
+}
+
+/**
+* serve the partial segment, block when it's the preload hint.
+*/
+func (this *SrsHlsLive) serve_part(w http.ResponseWriter, r *http.Request, file string) {
+	var data []byte
+	ok := this.wait(func() bool {
+		var found bool
+		data, found = this.parts[file]
+		return found
+	})
+	if !ok {
+		http.Error(w, "part not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	if strings.HasSuffix(file, ".ts") {
+		w.Header().Set("Content-Type", "video/mp2t")
+	} else {
+		w.Header().Set("Content-Type", "video/iso.segment")
+	}
+	w.Write(data)
+}
+
+/**
+* the http handler for hls, serve the LL-HLS from live state,
+* others are served by the next handler, generally the file server.
+*/
+type SrsHlsLiveServer struct {
+	next http.Handler
+}
+
+func NewSrsHlsLiveServer(next http.Handler) *SrsHlsLiveServer {
+	return &SrsHlsLiveServer{
+		next: next,
+	}
+}
+
+func (this *SrsHlsLiveServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	file := strings.TrimPrefix(path.Clean("/" + r.URL.Path), "/")
+	if l, is_playlist := find_hls_live(file); l != nil {
+		if is_playlist {
+			l.serve_playlist(w, r)
+		} else {
+			l.serve_part(w, r, file)
+		}
+		return
+	}
+
+	this.next.ServeHTTP(w, r)
+}
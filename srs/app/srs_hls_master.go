@@ -0,0 +1,257 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 GOSRS(gosrs)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package app
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"go_srs/srs/app/config"
+	"go_srs/srs/utils"
+)
+
+/**
+* the rendition of a master playlist, a stream which is publishing
+* the same event at a specified bitrate.
+*/
+type SrsHlsRendition struct {
+	stream    string
+	m3u8      string // the full path of the media playlist.
+	bandwidth int    // the peak segment bitrate in bits per second.
+	average   int    // the average segment bitrate in bits per second.
+	width     int
+	height    int
+	vcodecs   string
+	acodecs   string
+}
+
+/**
+* the master playlist of a rendition group,
+* @see: 4.3.4.2. EXT-X-STREAM-INF, RFC8216.
+*/
+type SrsHlsMaster struct {
+	mtx        sync.Mutex
+	key        string // the key in pool, removed when no rendition.
+	group      string
+	streams    []string // the streams in the configured order.
+	m3u8       string   // the full path of the master playlist.
+	storage    SrsStorage
+	renditions map[string]*SrsHlsRendition
+}
+
+var hlsMasterPoolMtx sync.Mutex
+var hlsMasterPool map[string]*SrsHlsMaster
+
+func init() {
+	hlsMasterPool = make(map[string]*SrsHlsMaster)
+}
+
+/**
+* fetch the master playlist of the group which contains the stream, and add
+* the stream as rendition, nil when the stream is not in any rendition group.
+* @param m3u8 the full path of the media playlist of stream.
+*/
+func FetchOrCreateHlsMaster(req *SrsRequest, hls_path string, m3u8_file string) *SrsHlsMaster {
+	conf := config.GetHlsMaster(req.vhost)
+	if conf == nil {
+		return nil
+	}
+
+	for group, streams := range conf.Groups {
+		found := false
+		for _, s := range streams {
+			if s == req.stream {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			continue
+		}
+
+		key := utils.SrsGenerateStreamUrl(req.vhost, req.app, group)
+		hlsMasterPoolMtx.Lock()
+		defer hlsMasterPoolMtx.Unlock()
+		if m, ok := hlsMasterPool[key]; ok {
+			m.on_publish(req.stream, m3u8_file)
+			return m
+		}
+
+		m3u8 := strings.Replace(conf.M3u8File, "[group]", group, -1)
+		m3u8 = utils.Srs_path_build_stream(m3u8, req.vhost, req.app, req.stream)
+		m := &SrsHlsMaster{
+			key:        key,
+			group:      group,
+			streams:    streams,
+			m3u8:       hls_path + "/" + m3u8,
+			storage:    NewSrsStorage(req.vhost),
+			renditions: make(map[string]*SrsHlsRendition),
+		}
+		hlsMasterPool[key] = m
+		m.on_publish(req.stream, m3u8_file)
+		return m
+	}
+	return nil
+}
+
+func (this *SrsHlsMaster) on_publish(stream string, m3u8 string) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	// the rendition is listed when the first segment is reaped,
+	// for the bandwidth is unknown until then.
+	this.renditions[stream] = &SrsHlsRendition{
+		stream: stream,
+		m3u8:   m3u8,
+	}
+}
+
+/**
+* remove the rendition, and the master from pool when it's the last one,
+* the pool is locked before the master, the same as when fetched.
+*/
+func (this *SrsHlsMaster) on_unpublish(stream string) {
+	hlsMasterPoolMtx.Lock()
+	defer hlsMasterPoolMtx.Unlock()
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	delete(this.renditions, stream)
+	this.refresh()
+
+	if len(this.renditions) == 0 && hlsMasterPool[this.key] == this {
+		delete(hlsMasterPool, this.key)
+	}
+}
+
+/**
+* update the codec info of rendition, when got the sequence header.
+*/
+func (this *SrsHlsMaster) on_sequence_header(stream string, c *SrsAvcAacCodec) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	r, ok := this.renditions[stream]
+	if !ok {
+		return
+	}
+
+	if vcodecs := c.avc_codecs(); vcodecs != "" {
+		r.vcodecs = vcodecs
+		r.width = c.width
+		r.height = c.height
+	}
+
+	if acodecs := c.audio_codecs(); acodecs != "" {
+		r.acodecs = acodecs
+	}
+
+	if r.bandwidth > 0 {
+		this.refresh()
+	}
+}
+
+/**
+* update the measured bitrate of rendition, when segment reaped.
+*/
+func (this *SrsHlsMaster) on_segment(stream string, bandwidth int, average int) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	r, ok := this.renditions[stream]
+	if !ok {
+		return
+	}
+
+	if r.bandwidth == bandwidth && r.average == average {
+		return
+	}
+
+	r.bandwidth = bandwidth
+	r.average = average
+	this.refresh()
+}
+
+func (this *SrsHlsMaster) refresh() {
+	renditions := make([]*SrsHlsRendition, 0)
+	for _, s := range this.streams {
+		if r, ok := this.renditions[s]; ok && r.bandwidth > 0 {
+			renditions = append(renditions, r)
+		}
+	}
+
+	// no rendition is publishing, remove the master playlist.
+	if len(renditions) == 0 {
+		if err := this.storage.Remove(this.m3u8); err != nil && !os.IsNotExist(err) {
+			fmt.Println("hls: remove master playlist failed, err=", err)
+		}
+		return
+	}
+
+	if err := this.storage.WriteFile(this.m3u8, []byte(this._refresh(renditions))); err != nil {
+		fmt.Println("hls: refresh master playlist failed, err=", err)
+	}
+}
+
+func (this *SrsHlsMaster) _refresh(renditions []*SrsHlsRendition) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+
+	for _, r := range renditions {
+		attrs := "BANDWIDTH=" + strconv.Itoa(r.bandwidth)
+		if r.average > 0 {
+			attrs += ",AVERAGE-BANDWIDTH=" + strconv.Itoa(r.average)
+		}
+
+		if r.width > 0 && r.height > 0 {
+			attrs += ",RESOLUTION=" + strconv.Itoa(r.width) + "x" + strconv.Itoa(r.height)
+		}
+
+		codecs := make([]string, 0)
+		if r.vcodecs != "" {
+			codecs = append(codecs, r.vcodecs)
+		}
+		if r.acodecs != "" {
+			codecs = append(codecs, r.acodecs)
+		}
+		if len(codecs) > 0 {
+			attrs += ",CODECS=\"" + strings.Join(codecs, ",") + "\""
+		}
+
+		// the uri of media playlist is relative to the master playlist.
+		uri, err := filepath.Rel(path.Dir(this.m3u8), r.m3u8)
+		if err != nil {
+			uri = r.m3u8
+		}
+
+		b.WriteString("#EXT-X-STREAM-INF:" + attrs + "\n" + filepath.ToSlash(uri) + "\n")
+	}
+	return b.String()
+}
@@ -24,17 +24,23 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 package app
 
 import (
+	"bytes"
 	"os"
 	"path"
-	"time"
+	"path/filepath"
+	"go_srs/srs/app/config"
 	"go_srs/srs/codec"
 	"go_srs/srs/utils"
 	"strconv"
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 )
 
+// the number of latest segments which list the parts in LL-HLS playlist.
+const SRS_HLS_LIVE_PART_SEGMENTS = 3
+
 type SrsHlsMuxer struct {
 	req *SrsRequest
 	hls_entry_prefix   string
@@ -61,6 +67,35 @@ type SrsHlsMuxer struct {
 	current            *SrsHlsSegment
 	acodec             codec.SrsCodecAudio
 	context            *SrsTsContext
+	master             *SrsHlsMaster // the master playlist of rendition group, nil if not in group.
+	hls_segment_type   string
+	init_path          string // the full path of fMP4 init segment.
+	init_uri           string // the uri of fMP4 init segment in m3u8.
+	init_file          string // the fMP4 init file relative to hls_path, of version 0.
+	init_version       int    // increased when codec changed, the segments in playlist use the previous one.
+	init_data          []byte // the content of current init segment.
+	fmp4_context       *SrsFmp4Context
+	hls_low_latency    bool
+	hls_part_target    float64
+	live               *SrsHlsLive // the live state for LL-HLS, nil if disabled.
+	hls_keys           bool
+	hls_fragments_per_key int
+	key                *SrsHlsKey // the key to encrypt the current segment.
+	key_segments       int        // the number of segments encrypted by current key.
+	hls_program_date_time string
+	publish_time       time.Time // the wall clock when publish.
+	publish_dts        int64     // the dts of first frame after publish, -1 if no frame yet.
+	avc_extra_data     []byte // the previous sps/pps, to detect the codec change.
+	aac_extra_data     []byte // the previous AudioSpecificConfig.
+	discontinuity      bool   // whether the next segment is a discontinuity.
+	discontinuity_sequence int // the number of discontinuities removed from window.
+	// the dvr playlist, which keeps the segments of a longer window.
+	dvr_m3u8           string // the full path of dvr m3u8, empty if disabled.
+	hls_dvr_window     float64
+	hls_dvr_cleanup    bool
+	dvr_segments       []*SrsHlsSegment
+	dvr_discontinuity_sequence int
+	storage            SrsStorage // the storage of segments and playlists.
 }
 
 func NewSrsHlsMuxer() *SrsHlsMuxer {
@@ -74,6 +109,10 @@ func (this *SrsHlsMuxer) initialize() error {
 }
 
 func (this *SrsHlsMuxer) is_segment_overflow() bool {
+	if this.current == nil {
+		return false
+	}
+
 	if this.current.duration * 1000 < 2 * 100 {
 		return false
 	}
@@ -107,6 +146,25 @@ func (this *SrsHlsMuxer) dispose() {
 	//todo unlink m3u8
 }
 
+/**
+* drop the current segment for error, the next segment is a discontinuity.
+*/
+func (this *SrsHlsMuxer) reset() {
+	if this.current == nil {
+		return
+	}
+
+	this.current.Close()
+	if err := this.storage.Remove(this.current.tmp_path); err != nil && !os.IsNotExist(err) {
+		fmt.Println("hls: remove segment failed, err=", err)
+	}
+	this.current = nil
+	this._sequence_no--
+
+	this.refresh_live()
+	this.mark_discontinuity("reset")
+}
+
 func (this *SrsHlsMuxer) sequence_no() int {
 	return this._sequence_no
 }
@@ -156,17 +214,267 @@ func (this *SrsHlsMuxer) UpdateConfig(req *SrsRequest, entry_prefix string, hls_
 	fmt.Println("??????????????????????mu38=", this.m3u8, "********************, app=", req.app)
 	this.max_td = 10000
 	this.m3u8_dir = path.Dir(this.m3u8)
-	err := os.MkdirAll(this.m3u8_dir, os.ModePerm)
-	return err
+	this.storage = NewSrsStorage(req.vhost)
+	this.master = FetchOrCreateHlsMaster(req, hls_path, this.m3u8)
+	return nil
+}
+
+/**
+* update the segment container, for fMP4 the init segment is generated
+* from sequence header, and the segments are muxed by SrsFmp4Muxer.
+*/
+func (this *SrsHlsMuxer) UpdateSegmentType(segment_type string, init_file string) {
+	this.hls_segment_type = segment_type
+	this.fmp4_context = nil
+	if !this.is_fmp4() {
+		return
+	}
+
+	this.fmp4_context = NewSrsFmp4Context()
+	this.init_file = utils.Srs_path_build_stream(init_file, this.req.vhost, this.req.app, this.req.stream)
+	this.init_data = nil
+	this.update_init_file(0)
+}
+
+/**
+* use the init file of version, the version 0 is the configured file, others
+* are suffixed by version, for example, livestream-init-1.mp4
+*/
+func (this *SrsHlsMuxer) update_init_file(version int) {
+	initFile := this.init_file
+	if version > 0 {
+		ext := path.Ext(initFile)
+		initFile = strings.TrimSuffix(initFile, ext) + "-" + strconv.Itoa(version) + ext
+	}
+	this.init_version = version
+	this.init_path = this.hls_path + "/" + initFile
+	this.init_uri = this.segment_uri(initFile)
+}
+
+/**
+* update the LL-HLS, the segment is cut to parts of part_target seconds,
+* and the playlist is served from live state.
+*/
+func (this *SrsHlsMuxer) UpdateLowLatency(enabled bool, part_target float64) {
+	this.hls_low_latency = enabled
+	this.hls_part_target = part_target
+	this.live = nil
+	if !enabled {
+		return
+	}
+
+	this.live = FetchOrCreateHlsLive(this.m3u8_url)
+	// the blocking request should be responded in 3 times of target duration.
+	this.live.on_publish(time.Duration(3 * this.hls_fragment * float64(time.Second)))
+}
+
+/**
+* update the AES-128 encryption, the key is rotated every fragments_per_key segments.
+*/
+func (this *SrsHlsMuxer) UpdateKeys(enabled bool, fragments_per_key int) {
+	this.hls_keys = enabled
+	this.hls_fragments_per_key = fragments_per_key
+	this.key = nil
+	if !enabled {
+		return
+	}
+
+	// the AES-128 encrypts the whole segment, which can not be cut to parts,
+	// and the fMP4 should use SAMPLE-AES.
+	if this.is_fmp4() || this.hls_low_latency {
+		fmt.Println("hls: ignore hls_keys for fmp4 or low latency, stream=", this.req.stream)
+		this.hls_keys = false
+	}
+}
+
+/**
+* rotate the key when the current key is used for hls_fragments_per_key segments.
+*/
+func (this *SrsHlsMuxer) fetch_key(sequence_no int) (*SrsHlsKey, error) {
+	if this.key == nil || this.key_segments >= this.hls_fragments_per_key {
+		key, err := hlsKeyProvider.GenerateKey(this.req, sequence_no)
+		if err != nil {
+			return nil, err
+		}
+		this.key = key
+		this.key_segments = 0
+	}
+
+	this.key_segments++
+	return this.key, nil
+}
+
+/**
+* update the EXT-X-PROGRAM-DATE-TIME, the wall clock of segment is
+* the publish time plus the dts offset from the first frame.
+*/
+func (this *SrsHlsMuxer) UpdateProgramDateTime(mode string) {
+	this.hls_program_date_time = mode
+	this.publish_time = time.Now()
+	this.publish_dts = -1
+}
+
+/**
+* the wall clock of the frame at dts.
+*/
+func (this *SrsHlsMuxer) program_date_time(dts int64) time.Time {
+	if this.publish_dts < 0 {
+		return this.publish_time
+	}
+	return this.publish_time.Add(time.Duration((dts - this.publish_dts) * int64(time.Millisecond) / 90))
+}
+
+/**
+* anchor the publish time to the first frame.
+*/
+func (this *SrsHlsMuxer) on_frame(dts int64) {
+	if this.publish_dts < 0 {
+		this.publish_dts = dts
+	}
+}
+
+/**
+* update the dvr playlist, which covers the dvr window with EVENT type,
+* so the viewers can seek back in the live event.
+*/
+func (this *SrsHlsMuxer) UpdateDvrWindow(window float64, m3u8_file string, cleanup bool) {
+	this.hls_dvr_window = window
+	this.hls_dvr_cleanup = cleanup
+	this.dvr_m3u8 = ""
+	if window <= 0 {
+		return
+	}
+
+	m3u8_url := utils.Srs_path_build_stream(m3u8_file, this.req.vhost, this.req.app, this.req.stream)
+	this.dvr_m3u8 = this.hls_path + "/" + m3u8_url
+}
+
+func (this *SrsHlsMuxer) is_fmp4() bool {
+	return this.hls_segment_type == config.SRS_CONF_HLS_SEGMENT_TYPE_FMP4
+}
+
+/**
+* the uri in m3u8 of file under hls_path, use the entry prefix when specified,
+* otherwise relative to the m3u8.
+*/
+func (this *SrsHlsMuxer) segment_uri(file string) string {
+	if this.hls_entry_prefix != "" {
+		return this.hls_entry_prefix + "/" + file
+	}
+
+	uri, err := filepath.Rel(this.m3u8_dir, this.hls_path + "/" + file)
+	if err != nil {
+		return file
+	}
+	return filepath.ToSlash(uri)
+}
+
+/**
+* write the fMP4 init segment, with the tracks which got sequence header.
+*/
+func (this *SrsHlsMuxer) write_init_segment(c *SrsAvcAacCodec) error {
+	data := mp4_init_segment(c, true, true)
+	if bytes.Equal(data, this.init_data) {
+		return nil
+	}
+
+	// the segments in playlist still use the previous init segment, so write the
+	// new one to the next version, which is in a new EXT-X-MAP after discontinuity.
+	if this.is_init_used() {
+		for version := this.init_version + 1; this.is_init_used(); version++ {
+			this.update_init_file(version)
+		}
+		fmt.Println("hls: init segment changed, use", this.init_uri, "stream=", this.req.stream)
+	}
+
+	if this.current != nil && !this.current.has_frame {
+		this.current.init_uri, this.current.init_path = this.init_uri, this.init_path
+	}
+
+	if err := this.storage.WriteFile(this.init_path, data); err != nil {
+		return err
+	}
+	this.init_data = data
+	return nil
+}
+
+/**
+* whether the current init segment is used by any segment with frames.
+*/
+func (this *SrsHlsMuxer) is_init_used() bool {
+	for i := 0; i < len(this.segments); i++ {
+		if this.segments[i].init_uri == this.init_uri {
+			return true
+		}
+	}
+	for i := 0; i < len(this.dvr_segments); i++ {
+		if this.dvr_segments[i].init_uri == this.init_uri {
+			return true
+		}
+	}
+	return this.current != nil && this.current.has_frame && this.current.init_uri == this.init_uri
+}
+
+/**
+* remove the init file of previous version, when it's not used by any segment.
+*/
+func (this *SrsHlsMuxer) remove_init(segment *SrsHlsSegment) {
+	if segment.init_path == "" || segment.init_uri == this.init_uri {
+		return
+	}
+
+	for i := 0; i < len(this.segments); i++ {
+		if this.segments[i].init_uri == segment.init_uri {
+			return
+		}
+	}
+	for i := 0; i < len(this.dvr_segments); i++ {
+		if this.dvr_segments[i].init_uri == segment.init_uri {
+			return
+		}
+	}
+	if this.current != nil && this.current.init_uri == segment.init_uri {
+		return
+	}
+
+	if err := this.storage.Remove(segment.init_path); err != nil && !os.IsNotExist(err) {
+		fmt.Println("hls: remove init file failed, err=", err)
+	}
+}
+
+func (this *SrsHlsMuxer) on_unpublish() {
+	// the event is end.
+	this.refresh_dvr_m3u8(true)
+
+	// continue the window when republish.
+	this.save_publish_state()
+
+	if this.live != nil {
+		this.live.on_unpublish()
+		this.live = nil
+	}
+
+	if this.master != nil {
+		this.master.on_unpublish(this.req.stream)
+	}
 }
 
 func (this *SrsHlsMuxer) flush_video(cache *SrsTsCache) error {
+	if this.current == nil {
+		return nil
+	}
+
 	if cache.video == nil || len(cache.video.payload) <= 0 {
 		return errors.New("the len of video must not be 0")
 	}
 
+	this.on_frame(cache.video.dts)
 	this.current.UpdateDuration(cache.video.dts)
 
+	if err := this.on_part_frame(cache.video.dts, true, cache.video.writePcr); err != nil {
+		return err
+	}
+
 	if err := this.current.WriteVideo(cache.video); err != nil {
 		return err
 	}
@@ -182,6 +490,11 @@ func (this *SrsHlsMuxer) flush_audio(cache *SrsTsCache) error {
 		return errors.New("error len of audio")
 	}
 
+	this.on_frame(cache.audio.dts)
+	if err := this.on_part_frame(cache.audio.dts, false, false); err != nil {
+		return err
+	}
+
 	if err := this.current.WriteAudio(cache.audio); err != nil {
 		return err
 	}
@@ -189,13 +502,66 @@ func (this *SrsHlsMuxer) flush_audio(cache *SrsTsCache) error {
 	return nil
 }
 
-func (this *SrsHlsMuxer) on_sequence_header() error {
-	// this.current.is_sequence_header = true
+/**
+* cut the part before write the frame when overflow.
+*/
+func (this *SrsHlsMuxer) on_part_frame(dts int64, video bool, keyframe bool) error {
+	if !this.hls_low_latency {
+		return nil
+	}
+
+	if this.current.is_part_overflow(dts, this.hls_part_target) {
+		if _, err := this.current.cut_part(dts, this.segment_uri); err != nil {
+			return err
+		}
+		this.refresh_live()
+	}
+
+	this.current.on_part_frame(video, keyframe)
+	return nil
+}
+
+/**
+* mark the next segment as discontinuity, the current segment is reaped
+* at the next keyframe, or the next audio frame for pure audio.
+*/
+func (this *SrsHlsMuxer) mark_discontinuity(reason string) {
+	fmt.Println("hls: discontinuity for", reason, ", stream=", this.req.stream)
+	this.discontinuity = true
+}
+
+func (this *SrsHlsMuxer) on_sequence_header(c *SrsAvcAacCodec) error {
+	// the codec changed when the sequence header is different from the previous one.
+	if this.avc_extra_data != nil && c.avcExtraData != nil && !bytes.Equal(this.avc_extra_data, c.avcExtraData) {
+		this.mark_discontinuity("sps/pps changed")
+	}
+	if this.aac_extra_data != nil && c.aacExtraData != nil && !bytes.Equal(this.aac_extra_data, c.aacExtraData) {
+		this.mark_discontinuity("AudioSpecificConfig changed")
+	}
+	if c.avcExtraData != nil {
+		this.avc_extra_data = append([]byte{}, c.avcExtraData...)
+	}
+	if c.aacExtraData != nil {
+		this.aac_extra_data = append([]byte{}, c.aacExtraData...)
+	}
+
+	if this.is_fmp4() {
+		if err := this.write_init_segment(c); err != nil {
+			return err
+		}
+	}
+
+	if this.master != nil {
+		this.master.on_sequence_header(this.req.stream, c)
+	}
 	return nil
 }
 
 func (this *SrsHlsMuxer) update_acodec(ac codec.SrsCodecAudio) error {
 	this.acodec = ac
+	if this.current == nil {
+		return nil
+	}
 	return this.current.muxer.UpdateACodec(ac)
 }
 
@@ -214,46 +580,74 @@ func (this *SrsHlsMuxer) SegmentOpen(segment_start_dts int64) error {
 	this._sequence_no++
 
 	this.current.segment_start_dts = segment_start_dts
+	this.current.fmp4_context = this.fmp4_context
+	if this.is_fmp4() {
+		this.current.init_uri, this.current.init_path = this.init_uri, this.init_path
+	}
+	this.current.is_sequence_header = this.discontinuity
+	this.discontinuity = false
 
-	//ts_file := this.hls_ts_file
-	//ts_file = utils.Srs_path_build_stream(ts_file, "aaa", "app", "test")
-
-	//if this.hls_ts_floor {
-	//	current_floor_ts := int64(((time.Now().UnixNano() / 1e6) / (1000 * 5)))
-	//
-	//	if this.accept_floor_ts == 0 {
-	//		this.accept_floor_ts = float64(current_floor_ts - 1)
-	//	} else {
-	//		this.accept_floor_ts++
-	//	}
-	//
-	//	if int64(this.accept_floor_ts - float64(current_floor_ts)) > SRS_JUMP_WHEN_PIECE_DEVIATION {
-     //       this.accept_floor_ts = float64(current_floor_ts - 1)
-	//	}
-	//
-	//	this.deviation_ts = (int)(this.accept_floor_ts - float64(current_floor_ts))
-	//
-	//	// dup/jmp detect for ts in floor mode.
-     //   if int64(this.previous_floor_ts) != 0 && int64(this.previous_floor_ts) != current_floor_ts - 1 {
-	//
-     //   }
-     //   this.previous_floor_ts = float64(current_floor_ts);
-	//	// we always ensure the piece is increase one by one.
-	//	//todo ts file name replace
-	//}
-	////todo tsfile append seq suffix
-	ts_file := strconv.FormatInt(int64(((time.Now().UnixNano() / 1e6) / (1000 * 5))), 10) + ".ts"
 	tsFile := utils.Srs_path_build_stream(this.hls_ts_file, this.req.vhost, this.req.app, this.req.stream)
-	tsFile = strings.Replace(tsFile, "[seq]", strconv.Itoa(this._sequence_no), -1)
+	if this.hls_ts_floor {
+		// accept the floor ts for the first piece.
+		current_floor_ts := time.Now().UnixNano() / int64(time.Millisecond) / int64(1000 * this.hls_fragment)
+		if this.accept_floor_ts == 0 {
+			this.accept_floor_ts = float64(current_floor_ts - 1)
+		} else {
+			this.accept_floor_ts++
+		}
+
+		// jump when deviation more than 10p
+		if int64(this.accept_floor_ts) - current_floor_ts > SRS_JUMP_WHEN_PIECE_DEVIATION {
+			this.accept_floor_ts = float64(current_floor_ts - 1)
+		}
+
+		// when reap ts, adjust the deviation.
+		this.deviation_ts = int(int64(this.accept_floor_ts) - current_floor_ts)
+
+		// dup/jmp detect for ts in floor mode.
+		if this.previous_floor_ts != 0 && int64(this.previous_floor_ts) != current_floor_ts - 1 {
+			fmt.Println("hls: dup or jmp for floor ts, previous=", int64(this.previous_floor_ts), "current=", current_floor_ts,
+				"accept=", int64(this.accept_floor_ts), "deviation=", this.deviation_ts)
+		}
+		this.previous_floor_ts = float64(current_floor_ts)
+
+		// we always ensure the piece is increase one by one, and the date variables use the
+		// accept floor time, so the servers generate the same name for the same piece.
+		tsFile = strings.Replace(tsFile, "[timestamp]", strconv.FormatInt(int64(this.accept_floor_ts), 10), -1)
+		floor_time := time.Unix(0, int64(this.accept_floor_ts * this.hls_fragment * float64(time.Second)))
+		tsFile = utils.Srs_path_build_timestamp(tsFile, floor_time)
+	} else {
+		tsFile = utils.Srs_path_build_timestamp(tsFile, time.Now())
+	}
+	tsFile = strings.Replace(tsFile, "[seq]", strconv.Itoa(this.current.sequence_no), -1)
+	// the fMP4 media segment use the m4s extension.
+	if this.is_fmp4() && strings.HasSuffix(tsFile, ".ts") {
+		tsFile = strings.TrimSuffix(tsFile, ".ts") + ".m4s"
+	}
 	this.current.full_path = this.hls_path + "/" + tsFile
 	//add prefix
-	if this.hls_entry_prefix != "" {
-		this.current.uri = this.hls_entry_prefix + "/" + tsFile
-	} else {
-		this.current.uri = ts_file
+	this.current.uri = this.segment_uri(tsFile)
+	this.current.file = tsFile
+	if this.hls_low_latency {
+		this.current.enable_parts()
+	}
+	if this.hls_keys {
+		key, err := this.fetch_key(this.current.sequence_no)
+		if err != nil {
+			return err
+		}
+		this.current.key = key
+		this.current.iv = srs_hls_segment_iv(this.current.sequence_no)
 	}
-	// open temp ts file.
+	// open temp ts file, the object of atomic storage is written in place,
+	// except the path has [duration] which is known when closed.
 	tmp_file := this.current.full_path + ".tmp";
+	if this.storage.Atomic() && !strings.Contains(this.current.full_path, "[duration]") {
+		tmp_file = this.current.full_path
+	}
+	this.current.tmp_path = tmp_file
+	this.current.storage = this.storage
 	if err := this.current.Open(tmp_file, default_acodec, default_vcodec); err != nil {
 		return err
 	}
@@ -261,6 +655,8 @@ func (this *SrsHlsMuxer) SegmentOpen(segment_start_dts int64) error {
 	if default_acodec != codec.SrsCodecAudioReserved1 {
 		this.current.muxer.UpdateACodec(default_acodec)
 	}
+	// update the preload hint to the first part.
+	this.refresh_live()
 	_ = tmp_file
 	//todo	
 	// if err := this.current.muxer.open(tmp_file); err != nil {
@@ -275,32 +671,99 @@ func (this *SrsHlsMuxer) refresh_m3u8() {
 		return
 	}
 
-	tempM3u8 := this.m3u8 + ".temp"
-	if err := this._refresh_m3u8(tempM3u8); err != nil {
+	fmt.Println("m3u8_file=", this.m3u8_file)
+	content := this.m3u8_content(this.segments, this.discontinuity_sequence, false, false, false)
+	if err := this.storage.WriteFile(this.m3u8, []byte(content)); err != nil {
+		fmt.Println("hls: write m3u8 failed, err=", err)
+	}
+}
+
+/**
+* write the dvr playlist,
+* @param ended whether the event is ended, append EXT-X-ENDLIST.
+*/
+func (this *SrsHlsMuxer) refresh_dvr_m3u8(ended bool) {
+	if this.dvr_m3u8 == "" || len(this.dvr_segments) == 0 {
 		return
 	}
 
-	os.Rename(tempM3u8, this.m3u8)
-	os.Remove(tempM3u8)
+	content := this.m3u8_content(this.dvr_segments, this.dvr_discontinuity_sequence, false, true, ended)
+	if err := this.storage.WriteFile(this.dvr_m3u8, []byte(content)); err != nil {
+		fmt.Println("hls: write dvr m3u8 failed, err=", err)
+	}
 }
 
-func (this *SrsHlsMuxer) _refresh_m3u8(m3u8_file string) error {
-	fmt.Println("m3u8_file=", this.m3u8_file)
-	f, err := os.OpenFile(m3u8_file, os.O_RDWR | os.O_CREATE, 0755)
-	if err != nil {
-		return err
+/**
+* update the playlist and parts of live state for LL-HLS.
+*/
+func (this *SrsHlsMuxer) refresh_live() {
+	if this.live == nil {
+		return
 	}
 
-	f.WriteString("#EXTM3U\n")
-	f.WriteString("#EXT-X-VERSION:3\n")
-	f.WriteString("#EXT-X-ALLOW-CACHE:YES\n")
+	msn, part, preload := this._sequence_no, 0, ""
+	if this.current != nil {
+		msn = this.current.sequence_no
+		part = len(this.current.parts)
+		preload = this.current.part_file(part)
+	}
 
-	segment := this.segments[0]
-	f.WriteString("#EXT-X-MEDIA-SEQUENCE:" + strconv.Itoa(segment.sequence_no) + "\n")
-	var targetDuration = 0
+	// only the parts of latest segments are kept.
+	parts := make(map[string][]byte)
 	for i := 0; i < len(this.segments); i++ {
-		if int(this.segments[i].duration) > targetDuration {
-			targetDuration = int(this.segments[i].duration)
+		if i < len(this.segments) - SRS_HLS_LIVE_PART_SEGMENTS {
+			this.segments[i].parts = nil
+		}
+		for _, p := range this.segments[i].parts {
+			parts[p.file] = p.data
+		}
+	}
+	if this.current != nil {
+		for _, p := range this.current.parts {
+			parts[p.file] = p.data
+		}
+	}
+
+	content := this.m3u8_content(this.segments, this.discontinuity_sequence, true, false, false)
+	this.live.update(content, msn, part, preload, parts)
+}
+
+/**
+* generate the media playlist,
+* @param segments the segments in playlist.
+* @param discontinuity_sequence the number of discontinuities removed from the playlist.
+* @param low_latency whether generate the LL-HLS playlist, with the parts and preload hint.
+* @param event whether the playlist is EVENT type, for the dvr playlist.
+* @param ended whether append the EXT-X-ENDLIST.
+*/
+func (this *SrsHlsMuxer) m3u8_content(segments []*SrsHlsSegment, discontinuity_sequence int, low_latency bool, event bool, ended bool) string {
+	var b strings.Builder
+
+	b.WriteString("#EXTM3U\n")
+	if this.is_fmp4() {
+		// the EXT-X-MAP for media playlists which not contain EXT-X-I-FRAMES-ONLY requires version 6,
+		// and the fMP4 segments requires version 7, @see: RFC8216, 7. Protocol Version Compatibility.
+		b.WriteString("#EXT-X-VERSION:7\n")
+	} else if low_latency {
+		b.WriteString("#EXT-X-VERSION:6\n")
+	} else {
+		b.WriteString("#EXT-X-VERSION:3\n")
+		// the EXT-X-ALLOW-CACHE is removed since version 7.
+		b.WriteString("#EXT-X-ALLOW-CACHE:YES\n")
+	}
+
+	sequence_no := this._sequence_no
+	if len(segments) > 0 {
+		sequence_no = segments[0].sequence_no
+	} else if this.current != nil {
+		sequence_no = this.current.sequence_no
+	}
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:" + strconv.Itoa(sequence_no) + "\n")
+	b.WriteString("#EXT-X-DISCONTINUITY-SEQUENCE:" + strconv.Itoa(discontinuity_sequence) + "\n")
+	var targetDuration = 0
+	for i := 0; i < len(segments); i++ {
+		if int(segments[i].duration) > targetDuration {
+			targetDuration = int(segments[i].duration)
 		}
 	}
 
@@ -308,17 +771,94 @@ func (this *SrsHlsMuxer) _refresh_m3u8(m3u8_file string) error {
 		targetDuration = this.max_td
 	}
 
-	f.WriteString("#EXT-X-TARGETDURATION:" + strconv.Itoa(targetDuration) + "\n")
-	for i := 0; i < len(this.segments); i++ {
-		if this.segments[i].is_sequence_header {
-			f.WriteString("#EXT-X-DISCONTINUITY\n")
+	b.WriteString("#EXT-X-TARGETDURATION:" + strconv.Itoa(targetDuration) + "\n")
+	if event {
+		// the player can seek in the whole playlist of EVENT type.
+		b.WriteString("#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	}
+	if low_latency {
+		// the PART-HOLD-BACK must be at least three times the part target.
+		b.WriteString("#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=" +
+			strconv.FormatFloat(3 * this.hls_part_target, 'f', 3, 64) + "\n")
+		b.WriteString("#EXT-X-PART-INF:PART-TARGET=" + strconv.FormatFloat(this.hls_part_target, 'f', 3, 64) + "\n")
+	}
+	// the EXT-X-MAP applies to the following segments, until the next one.
+	map_uri := ""
+	write_map := func(uri string) {
+		if uri == "" {
+			uri = this.init_uri
+		}
+		if this.is_fmp4() && uri != map_uri {
+			b.WriteString("#EXT-X-MAP:URI=\"" + uri + "\"\n")
+			map_uri = uri
+		}
+	}
+	if len(segments) == 0 && this.current == nil {
+		write_map(this.init_uri)
+	}
+	for i := 0; i < len(segments); i++ {
+		if segments[i].is_sequence_header {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		write_map(segments[i].init_uri)
+
+		if key := segments[i].key; key != nil {
+			b.WriteString("#EXT-X-KEY:METHOD=AES-128,URI=\"" + key.uri + "\",IV=" + srs_hls_iv_hex(segments[i].iv) + "\n")
 		}
 
-		f.WriteString("#EXTINF:" + strconv.FormatFloat(this.segments[i].duration, 'f',3, 64) + "\n")
-		f.WriteString(this.segments[i].uri + "\n")
+		if low_latency && i >= len(segments) - SRS_HLS_LIVE_PART_SEGMENTS {
+			write_parts(&b, segments[i].parts)
+		}
+		if this.is_program_date_time(segments, i) {
+			pdt := segments[i].program_date_time.UTC().Format("2006-01-02T15:04:05.000Z07:00")
+			b.WriteString("#EXT-X-PROGRAM-DATE-TIME:" + pdt + "\n")
+		}
+
+		b.WriteString("#EXTINF:" + strconv.FormatFloat(segments[i].duration, 'f',3, 64) + "\n")
+		b.WriteString(segments[i].uri + "\n")
+	}
+
+	if len(segments) == 0 && this.current != nil {
+		write_map(this.current.init_uri)
+	}
+
+	if low_latency && this.current != nil {
+		if this.current.is_sequence_header && len(segments) > 0 {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		write_map(this.current.init_uri)
+		write_parts(&b, this.current.parts)
+		preload := this.current.part_file(len(this.current.parts))
+		b.WriteString("#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"" + this.segment_uri(preload) + "\"\n")
+	}
+
+	if ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.String()
+}
+
+/**
+* whether emit EXT-X-PROGRAM-DATE-TIME for the index segment.
+*/
+func (this *SrsHlsMuxer) is_program_date_time(segments []*SrsHlsSegment, index int) bool {
+	switch this.hls_program_date_time {
+	case config.SRS_CONF_HLS_PROGRAM_DATE_TIME_ON:
+		return true
+	case config.SRS_CONF_HLS_PROGRAM_DATE_TIME_DISCONTINUITY:
+		return index == 0 || segments[index].is_sequence_header
+	}
+	return false
+}
+
+func write_parts(b *strings.Builder, parts []*SrsHlsPart) {
+	for _, p := range parts {
+		b.WriteString("#EXT-X-PART:DURATION=" + strconv.FormatFloat(p.duration, 'f', 3, 64) + ",URI=\"" + p.uri + "\"")
+		if p.independent {
+			b.WriteString(",INDEPENDENT=YES")
+		}
+		b.WriteString("\n")
 	}
-	f.Close()
-	return nil
 }
 
 func (this *SrsHlsMuxer) segment_close() error {
@@ -330,50 +870,213 @@ func (this *SrsHlsMuxer) segment_close() error {
 	// when too small, it maybe not enough data to play.
 	// when too large, it maybe timestamp corrupt.
 	// make the segment more acceptable, when in [min, max_td * 2], it's ok.
+	// the last part ends with the segment.
+	if this.hls_low_latency {
+		if _, err := this.current.cut_part(-1, this.segment_uri); err != nil {
+			return err
+		}
+	}
+
+	this.current.program_date_time = this.program_date_time(this.current.segment_start_dts)
+	if err := this.current.Close(); err != nil {
+		return err
+	}
+
 	if this.current.duration * 1000 >= 100 && this.current.duration <= float64(this.max_td*2){
 		this.segments = append(this.segments, this.current)
+		if this.dvr_m3u8 != "" {
+			this.dvr_segments = append(this.dvr_segments, this.current)
+		}
+		this.current.update_duration_variable()
 
-		full_path := this.current.full_path
+		segment := this.current
 		this.current = nil
 
-		tmp_file := full_path + ".tmp"
-		if err := os.Rename(tmp_file, full_path); err != nil {
-			return err
+		if segment.tmp_path != segment.full_path {
+			if err := this.storage.Rename(segment.tmp_path, segment.full_path); err != nil {
+				return err
+			}
 		}
+		this.on_hls(segment)
 	} else {
 		this._sequence_no--
-		tmp_file := this.current.full_path + ".tmp"
-		if err := os.Remove(tmp_file); err != nil {
+		if err := this.storage.Remove(this.current.tmp_path); err != nil {
 			return err
 		}
 	}
 	//这里主要限制hls的总时长，超过hls_window的话，就把前面部分文件删除掉，这一大堆代码就是干这个事情
 	//shrink the segments.
+	var segment_to_remove []*SrsHlsSegment
+	this.segments, segment_to_remove = shrink_segments(this.segments, this.hls_window, &this.discontinuity_sequence)
+
+	// the segments in dvr window is cleanup by the dvr window.
+	if this.hls_cleanup && this.dvr_m3u8 == "" {
+		if err := this.remove_segments(segment_to_remove); err != nil {
+			return err
+		}
+	}
+
+	if this.dvr_m3u8 != "" {
+		this.dvr_segments, segment_to_remove = shrink_segments(this.dvr_segments, this.hls_dvr_window, &this.dvr_discontinuity_sequence)
+		if this.hls_dvr_cleanup {
+			if err := this.remove_segments(segment_to_remove); err != nil {
+				return err
+			}
+		}
+		this.refresh_dvr_m3u8(false)
+	}
+
+	this.refresh_m3u8()
+	this.refresh_live()
+
+	if this.master != nil && len(this.segments) > 0 {
+		this.master.on_segment(this.req.stream, this.peak_bitrate(), this.average_bitrate())
+	}
+	return nil
+}
+
+/**
+* call the on_hls and on_hls_notify hooks for the reaped segment,
+* the hooks are called async, not to block the muxer.
+*/
+func (this *SrsHlsMuxer) on_hls(segment *SrsHlsSegment) {
+	vhost := config.GetInstance().GetVHost(this.req.vhost)
+	if vhost == nil || vhost.HttpHooks == nil || vhost.HttpHooks.Enabled != "on" {
+		return
+	}
+
+	req := *this.req
+	on_hls := vhost.HttpHooks.OnHls
+	on_hls_notify := vhost.HttpHooks.OnHlsNotify
+	nb_notify := config.GetHlsNbNotify(this.req.vhost)
+	m3u8, m3u8_url := this.m3u8, this.m3u8_url
+	go func() {
+		if on_hls != "" {
+			err := OnHls(on_hls, &req, segment.full_path, segment.uri, m3u8, m3u8_url, segment.sequence_no, segment.duration)
+			if err != nil {
+				fmt.Println("hls: http hook failed, err=", err)
+			}
+		}
+
+		if on_hls_notify != "" {
+			if err := OnHlsNotify(on_hls_notify, &req, segment.uri, nb_notify); err != nil {
+				fmt.Println("hls: http hook failed, err=", err)
+			}
+		}
+	}()
+}
+
+/**
+* remove the segments out of window, return the segments in window and removed,
+* @param discontinuity_sequence increased for each discontinuity removed.
+*/
+func shrink_segments(segments []*SrsHlsSegment, window float64, discontinuity_sequence *int) ([]*SrsHlsSegment, []*SrsHlsSegment) {
 	var duration float64 = 0
 	var removeIndex = 0
-	for i := len(this.segments) - 1; i >= 0; i-- {
-		duration += this.segments[i].duration
-		if duration > this.hls_window {
+	for i := len(segments) - 1; i >= 0; i-- {
+		duration += segments[i].duration
+		if duration > window {
 			removeIndex = i
 			break
 		}
 	}
 
 	segment_to_remove := make([]*SrsHlsSegment, 0)
-	for i := 0; i < removeIndex && i < len(this.segments); i++ {
-		segment_to_remove = append(segment_to_remove, this.segments[0])
-		this.segments = this.segments[1:]
+	for i := 0; i < removeIndex && i < len(segments); i++ {
+		// the discontinuity sequence is the number of discontinuities removed from playlist.
+		if segments[0].is_sequence_header {
+			*discontinuity_sequence++
+		}
+		segment_to_remove = append(segment_to_remove, segments[0])
+		segments = segments[1:]
 	}
+	return segments, segment_to_remove
+}
 
-	for i := 0; i < len(segment_to_remove); i++ {
-		if this.hls_cleanup {
-			if err := os.Remove(segment_to_remove[i].full_path); err != nil {
-				return err
-			}
+/**
+* remove the segment files and keys which are not used by any playlist.
+*/
+func (this *SrsHlsMuxer) remove_segments(segments []*SrsHlsSegment) error {
+	for i := 0; i < len(segments); i++ {
+		if this.is_segment_used(segments[i]) || segments[i].full_path == "" {
+			continue
 		}
-	}
 
-	this.refresh_m3u8()
+		// the segments recovered from m3u8 may be removed.
+		if err := this.storage.Remove(segments[i].full_path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		this.remove_key(segments[i].key)
+		this.remove_init(segments[i])
+	}
 	return nil
 }
 
+func (this *SrsHlsMuxer) is_segment_used(segment *SrsHlsSegment) bool {
+	for i := 0; i < len(this.segments); i++ {
+		if this.segments[i] == segment {
+			return true
+		}
+	}
+	for i := 0; i < len(this.dvr_segments); i++ {
+		if this.dvr_segments[i] == segment {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+* remove the key file when it's not used by any segment.
+*/
+func (this *SrsHlsMuxer) remove_key(key *SrsHlsKey) {
+	if key == nil || key.path == "" || key == this.key {
+		return
+	}
+
+	for i := 0; i < len(this.segments); i++ {
+		if this.segments[i].key == key {
+			return
+		}
+	}
+	for i := 0; i < len(this.dvr_segments); i++ {
+		if this.dvr_segments[i].key == key {
+			return
+		}
+	}
+
+	if err := this.storage.Remove(key.path); err != nil && !os.IsNotExist(err) {
+		fmt.Println("hls: remove key file failed, err=", err)
+	}
+}
+
+/**
+* the max bitrate of segments in window, for the BANDWIDTH of master playlist.
+*/
+func (this *SrsHlsMuxer) peak_bitrate() int {
+	peak := 0
+	for i := 0; i < len(this.segments); i++ {
+		if b := this.segments[i].bitrate(); b > peak {
+			peak = b
+		}
+	}
+	return peak
+}
+
+/**
+* the average bitrate of segments in window, for the AVERAGE-BANDWIDTH of master playlist.
+*/
+func (this *SrsHlsMuxer) average_bitrate() int {
+	var size int64 = 0
+	var duration float64 = 0
+	for i := 0; i < len(this.segments); i++ {
+		size += this.segments[i].size
+		duration += this.segments[i].duration
+	}
+
+	if duration <= 0 {
+		return 0
+	}
+	return int(float64(size * 8) / duration)
+}
+
@@ -0,0 +1,155 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 GOSRS(gosrs)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package app
+
+import (
+	"bytes"
+	"path"
+	"strconv"
+	"strings"
+)
+
+/**
+* the partial segment of LL-HLS,
+* @see: 4.4.4.9. EXT-X-PART, draft-pantos-hls-rfc8216bis.
+*/
+type SrsHlsPart struct {
+	duration    float64 // duration in seconds.
+	independent bool    // whether the part starts with a keyframe.
+	file        string  // the part file relative to hls_path, the key to serve it.
+	uri         string  // the part uri in m3u8.
+	data        []byte
+}
+
+/**
+* enable the partial segments, the bytes written to segment are
+* gathered and cut as parts.
+*/
+func (this *SrsHlsSegment) enable_parts() {
+	this.part_buffer = &bytes.Buffer{}
+	this.part_start_dts = this.segment_start_dts
+}
+
+/**
+* the file of part, for example, live/livestream-10.ts to live/livestream-10.2.ts
+*/
+func (this *SrsHlsSegment) part_file(index int) string {
+	ext := path.Ext(this.file)
+	return strings.TrimSuffix(this.file, ext) + "." + strconv.Itoa(index) + ext
+}
+
+/**
+* update the part state before write a frame.
+* @param video whether the frame is video.
+* @param keyframe whether the frame is video keyframe.
+*/
+func (this *SrsHlsSegment) on_part_frame(video bool, keyframe bool) {
+	if this.part_buffer == nil || !video || this.part_has_video {
+		return
+	}
+
+	this.part_has_video = true
+	this.part_independent = keyframe
+}
+
+/**
+* whether the part should be cut before the frame at dts, the duration of part
+* MUST not exceed the part target, so cut when the next frame will overflow.
+*/
+func (this *SrsHlsSegment) is_part_overflow(dts int64, part_target float64) bool {
+	if this.part_buffer == nil {
+		return false
+	}
+
+	var interval int64 = 0
+	if this.part_last_dts > 0 && dts > this.part_last_dts {
+		interval = dts - this.part_last_dts
+	}
+	this.part_last_dts = dts
+
+	if this.part_buffer.Len() == 0 && !this.has_pending_samples() {
+		return false
+	}
+
+	return float64(dts + interval - this.part_start_dts) / 90000.0 > part_target
+}
+
+func (this *SrsHlsSegment) has_pending_samples() bool {
+	if m, ok := this.muxer.(*SrsFmp4Muxer); ok {
+		return len(m.video) > 0 || len(m.audio) > 0
+	}
+	return false
+}
+
+/**
+* cut the bytes written since last part as a new part.
+* @param dts the dts of the part end, -1 to end with the segment.
+* @param uri_of the function to build the part uri from the part file.
+*/
+func (this *SrsHlsSegment) cut_part(dts int64, uri_of func(string) string) (*SrsHlsPart, error) {
+	if this.part_buffer == nil {
+		return nil, nil
+	}
+
+	// the fMP4 write a fragment for each part.
+	if err := this.muxer.Flush(); err != nil {
+		return nil, err
+	}
+
+	if this.part_buffer.Len() == 0 {
+		return nil, nil
+	}
+
+	var duration float64
+	if dts < 0 {
+		// the last part ends with the segment, use the left duration to
+		// make the sum of parts equal to segment.
+		duration = this.duration
+		for _, p := range this.parts {
+			duration -= p.duration
+		}
+		if duration < 0 {
+			duration = 0
+		}
+	} else {
+		duration = float64(dts - this.part_start_dts) / 90000.0
+		this.part_start_dts = dts
+	}
+
+	file := this.part_file(len(this.parts))
+	part := &SrsHlsPart{
+		duration:    duration,
+		independent: !this.part_has_video || this.part_independent,
+		file:        file,
+		uri:         uri_of(file),
+		data:        make([]byte, this.part_buffer.Len()),
+	}
+	copy(part.data, this.part_buffer.Bytes())
+	this.part_buffer.Reset()
+
+	this.part_has_video = false
+	this.part_independent = false
+	this.parts = append(this.parts, part)
+	return part, nil
+}
@@ -0,0 +1,311 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 GOSRS(gosrs)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+* the playlist parsed from the m3u8 file, to recover the hls state after restart.
+*/
+type SrsHlsRecoveredPlaylist struct {
+	sequence_no            int // the EXT-X-MEDIA-SEQUENCE.
+	discontinuity_sequence int // the EXT-X-DISCONTINUITY-SEQUENCE.
+	segments               []*SrsHlsSegment
+}
+
+/**
+* parse the media playlist written by muxer, only the tags we write are parsed.
+* @param resolve get the full path of uri.
+* @param keys the keys by uri, shared by segments of different playlists.
+*/
+func srs_hls_parse_m3u8(storage SrsStorage, file string, resolve func(string) string, keys map[string]*SrsHlsKey) (*SrsHlsRecoveredPlaylist, error) {
+	data, err := storage.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pl := &SrsHlsRecoveredPlaylist{}
+	// the state of next segment.
+	var duration float64
+	var discontinuity bool
+	var pdt time.Time
+	var key *SrsHlsKey
+	var iv []byte
+	var init_uri string
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			if pl.sequence_no, err = strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:")); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(line, "#EXT-X-DISCONTINUITY-SEQUENCE:"):
+			if pl.discontinuity_sequence, err = strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-DISCONTINUITY-SEQUENCE:")); err != nil {
+				return nil, err
+			}
+		case line == "#EXT-X-DISCONTINUITY":
+			discontinuity = true
+		case strings.HasPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:"):
+			pdt, _ = time.Parse(time.RFC3339Nano, strings.TrimPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:"))
+		case strings.HasPrefix(line, "#EXT-X-KEY:"):
+			attrs := srs_hls_parse_attributes(strings.TrimPrefix(line, "#EXT-X-KEY:"))
+			key, iv = nil, nil
+			if attrs["METHOD"] != "AES-128" {
+				break
+			}
+			uri := attrs["URI"]
+			if key = keys[uri]; key == nil {
+				key = &SrsHlsKey{uri: uri, path: resolve(uri)}
+				keys[uri] = key
+			}
+			iv, _ = hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(attrs["IV"], "0x"), "0X"))
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			init_uri = srs_hls_parse_attributes(strings.TrimPrefix(line, "#EXT-X-MAP:"))["URI"]
+		case strings.HasPrefix(line, "#EXTINF:"):
+			v := strings.TrimPrefix(line, "#EXTINF:")
+			if i := strings.Index(v, ","); i >= 0 {
+				v = v[:i]
+			}
+			if duration, err = strconv.ParseFloat(v, 64); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(line, "#"):
+		default:
+			var init_path string
+			if init_uri != "" {
+				init_path = resolve(init_uri)
+			}
+			pl.segments = append(pl.segments, &SrsHlsSegment{
+				duration:           duration,
+				sequence_no:        pl.sequence_no + len(pl.segments),
+				uri:                line,
+				full_path:          resolve(line),
+				is_sequence_header: discontinuity,
+				program_date_time:  pdt,
+				key:                key,
+				iv:                 iv,
+				init_uri:           init_uri,
+				init_path:          init_path,
+			})
+			duration, discontinuity, pdt = 0, false, time.Time{}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return pl, nil
+}
+
+/**
+* parse the attribute list, for example, METHOD=AES-128,URI="a.key",IV=0x01
+*/
+func srs_hls_parse_attributes(v string) map[string]string {
+	attrs := make(map[string]string)
+	for len(v) > 0 {
+		i := strings.Index(v, "=")
+		if i < 0 {
+			break
+		}
+		name := strings.TrimSpace(v[:i])
+		v = v[i+1:]
+
+		var value string
+		if strings.HasPrefix(v, "\"") {
+			j := strings.Index(v[1:], "\"")
+			if j < 0 {
+				value, v = v[1:], ""
+			} else {
+				value, v = v[1:j+1], v[j+2:]
+			}
+		} else if j := strings.Index(v, ","); j >= 0 {
+			value, v = v[:j], v[j:]
+		} else {
+			value, v = v, ""
+		}
+		attrs[name] = value
+		v = strings.TrimPrefix(v, ",")
+	}
+	return attrs
+}
+
+/**
+* the full path of uri in m3u8, empty if not a local file.
+*/
+func (this *SrsHlsMuxer) resolve_uri(uri string) string {
+	if this.hls_entry_prefix != "" && strings.HasPrefix(uri, this.hls_entry_prefix + "/") {
+		return this.hls_path + "/" + strings.TrimPrefix(uri, this.hls_entry_prefix + "/")
+	}
+
+	if strings.Contains(uri, "://") || strings.HasPrefix(uri, "/") {
+		return ""
+	}
+	return path.Join(this.m3u8_dir, uri)
+}
+
+/**
+* recover the state from the m3u8 files written before restart, continue the
+* sequence number and window, and the next segment is a discontinuity.
+*/
+func (this *SrsHlsMuxer) recover() error {
+	// only recover at the first publish in process.
+	if this._sequence_no != 0 || len(this.segments) > 0 {
+		return nil
+	}
+
+	keys := make(map[string]*SrsHlsKey)
+	var dvr *SrsHlsRecoveredPlaylist
+	if this.dvr_m3u8 != "" {
+		var err error
+		if dvr, err = srs_hls_parse_m3u8(this.storage, this.dvr_m3u8, this.resolve_uri, keys); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	pl, err := srs_hls_parse_m3u8(this.storage, this.m3u8, this.resolve_uri, keys)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// the segments in both playlists are the same object, for cleanup.
+	byUri := make(map[string]*SrsHlsSegment)
+	if dvr != nil {
+		this.dvr_segments = dvr.segments
+		this.dvr_discontinuity_sequence = dvr.discontinuity_sequence
+		for _, s := range dvr.segments {
+			byUri[s.uri] = s
+			if s.sequence_no + 1 > this._sequence_no {
+				this._sequence_no = s.sequence_no + 1
+			}
+		}
+	}
+
+	if pl != nil {
+		this.discontinuity_sequence = pl.discontinuity_sequence
+		for _, s := range pl.segments {
+			if d, ok := byUri[s.uri]; ok {
+				s = d
+			}
+			this.segments = append(this.segments, s)
+			if s.sequence_no + 1 > this._sequence_no {
+				this._sequence_no = s.sequence_no + 1
+			}
+		}
+	}
+
+	if len(this.segments) == 0 && len(this.dvr_segments) == 0 {
+		return nil
+	}
+
+	fmt.Println("hls: recover", len(this.segments), "segments, continue sequence", this._sequence_no, "stream=", this.req.stream)
+	this.mark_discontinuity("recover")
+	return nil
+}
+
+/**
+* the state of muxer when unpublish, the source and muxer are created for each
+* publish, so the state is kept to continue the window when republish in process.
+*/
+type SrsHlsPublishState struct {
+	sequence_no                int
+	segments                   []*SrsHlsSegment
+	discontinuity_sequence     int
+	dvr_segments               []*SrsHlsSegment
+	dvr_discontinuity_sequence int
+	key                        *SrsHlsKey
+	key_segments               int
+	init_version               int
+	init_data                  []byte
+}
+
+// the state of unpublished streams, the key is the full path of m3u8.
+var hlsPublishStatesMtx sync.Mutex
+var hlsPublishStates map[string]*SrsHlsPublishState
+
+func init() {
+	hlsPublishStates = make(map[string]*SrsHlsPublishState)
+}
+
+/**
+* keep the state when unpublish, for the next publish of stream.
+*/
+func (this *SrsHlsMuxer) save_publish_state() {
+	hlsPublishStatesMtx.Lock()
+	defer hlsPublishStatesMtx.Unlock()
+
+	hlsPublishStates[this.m3u8] = &SrsHlsPublishState{
+		sequence_no:                this._sequence_no,
+		segments:                   this.segments,
+		discontinuity_sequence:     this.discontinuity_sequence,
+		dvr_segments:               this.dvr_segments,
+		dvr_discontinuity_sequence: this.dvr_discontinuity_sequence,
+		key:                        this.key,
+		key_segments:               this.key_segments,
+		init_version:               this.init_version,
+		init_data:                  this.init_data,
+	}
+}
+
+/**
+* restore the state of the previous publish in process,
+* @return whether any segment is restored.
+*/
+func (this *SrsHlsMuxer) restore_publish_state() bool {
+	hlsPublishStatesMtx.Lock()
+	defer hlsPublishStatesMtx.Unlock()
+
+	st, ok := hlsPublishStates[this.m3u8]
+	if !ok {
+		return false
+	}
+	delete(hlsPublishStates, this.m3u8)
+
+	this._sequence_no = st.sequence_no
+	this.segments = st.segments
+	this.discontinuity_sequence = st.discontinuity_sequence
+	this.dvr_segments = st.dvr_segments
+	this.dvr_discontinuity_sequence = st.dvr_discontinuity_sequence
+	this.key, this.key_segments = st.key, st.key_segments
+	if this.is_fmp4() {
+		this.update_init_file(st.init_version)
+		this.init_data = st.init_data
+	}
+
+	fmt.Println("hls: restore", len(this.segments), "segments of previous publish, continue sequence", this._sequence_no, "stream=", this.req.stream)
+	return len(this.segments) > 0 || len(this.dvr_segments) > 0
+}
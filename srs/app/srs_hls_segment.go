@@ -23,9 +23,12 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 package app
 
 import (
-	"os"
+	"bytes"
 	"go_srs/srs/codec"
 	"io"
+	"strconv"
+	"strings"
+	"time"
 	"fmt"
 )
 
@@ -36,16 +39,46 @@ import (
 * The EXTINF tag specifies the duration of a media segment.
 */
 
+/**
+* the muxer of segment, which mux the ts messages to ts or fMP4.
+*/
+type SrsHlsSegmentMuxer interface {
+	WriteAudio(audio *SrsTsMessage) error
+	WriteVideo(video *SrsTsMessage) error
+	UpdateACodec(ac codec.SrsCodecAudio) error
+	Flush() error
+}
+
 type SrsHlsSegment struct {
 	duration           float64            // duration in seconds in m3u8.
 	sequence_no        int                // sequence number in m3u8.
 	uri                string             // ts uri in m3u8.
 	full_path          string             //ts full file to write.
+	tmp_path           string             //the file written before closed, the full_path for atomic storage.
+	file               string             //ts file relative to hls_path.
 	writer             io.Writer 		//the muxer to write ts.
-	muxer              *SrsTsMuxer
+	storage            SrsStorage       // the storage to write segment, local disk or s3.
+	f                  SrsStorageFile
+	muxer              SrsHlsSegmentMuxer
 	segment_start_dts  int64 // current segment start dts for m3u8
 	is_sequence_header bool  // whether current segement is sequence header.
+	size               int64 // the bytes of ts file, set when closed.
 	context				*SrsTsContext
+	fmp4_context		*SrsFmp4Context // not nil when segment is fMP4.
+	// the partial segments for LL-HLS, the bytes since last part is in part_buffer.
+	parts              []*SrsHlsPart
+	part_buffer        *bytes.Buffer // nil when partial segment disabled.
+	part_start_dts     int64
+	part_last_dts      int64
+	part_has_video     bool
+	part_independent   bool
+	program_date_time  time.Time // the UTC time of the first sample in segment.
+	key                *SrsHlsKey // the key to encrypt the segment, nil if not encrypted.
+	iv                 []byte
+	encryptor          *SrsHlsAesWriter
+	init_uri           string // the uri of fMP4 init segment, versioned for discontinuity.
+	init_path          string
+	has_frame          bool   // whether any frame is written.
 }
 
 const SRS_AUTO_HLS_SEGMENT_TIMESTAMP_JUMP_MS = 300
@@ -68,28 +101,91 @@ func (this *SrsHlsSegment) UpdateDuration(currentFrameDts int64) {
 
 func (this *SrsHlsSegment) Open(path string, ac codec.SrsCodecAudio, vc codec.SrsCodecVideo) error {
 	var err error
-	this.writer, err = os.OpenFile(path, os.O_RDWR | os.O_CREATE, 0755)
+	if this.storage == nil {
+		this.storage = NewSrsLocalStorage()
+	}
+
+	this.f, err = this.storage.Create(path)
 	if err != nil {
 		fmt.Println("open full path failed, ", this.full_path)
 		return err
 	}
 
+	this.writer = this.f
+	if this.key != nil {
+		if this.encryptor, err = NewSrsHlsAesWriter(this.f, this.key.key, this.iv); err != nil {
+			this.f.Close()
+			return err
+		}
+		this.writer = this.encryptor
+	}
+	if this.part_buffer != nil {
+		this.writer = io.MultiWriter(this.f, this.part_buffer)
+	}
+
 	fmt.Println("open segment path succeed:", this.full_path)
-	this.muxer = NewSrsTsMuxer(this.writer, this.context, ac, vc)
+	if this.fmp4_context != nil {
+		this.muxer = NewSrsFmp4Muxer(this.writer, this.fmp4_context, ac)
+	} else {
+		this.muxer = NewSrsTsMuxer(this.writer, this.context, ac, vc)
+	}
 	return nil
 }
 
 func (this *SrsHlsSegment) Close() error {
-	if this.writer != nil {
-		this.writer.(*os.File).Close()
+	if this.writer == nil {
+		return nil
 	}
-	return nil
+
+	// write the gathered samples, for fMP4.
+	err := this.muxer.Flush()
+	if this.encryptor != nil {
+		if eerr := this.encryptor.Close(); err == nil {
+			err = eerr
+		}
+		this.encryptor = nil
+	}
+
+	f := this.f
+	this.f = nil
+	this.writer = nil
+	if off, err := f.Seek(0, 1); err == nil {//SEEK_CUR
+		this.size = off
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+/**
+* replace the [duration] in the segment path by the duration in ms,
+* which is known when segment closed.
+*/
+func (this *SrsHlsSegment) update_duration_variable() {
+	duration := strconv.Itoa(int(this.duration * 1000))
+	this.full_path = strings.Replace(this.full_path, "[duration]", duration, -1)
+	this.uri = strings.Replace(this.uri, "[duration]", duration, -1)
+	this.file = strings.Replace(this.file, "[duration]", duration, -1)
+}
+
+/**
+* the bitrate of segment in bits per second.
+*/
+func (this *SrsHlsSegment) bitrate() int {
+	if this.duration <= 0 {
+		return 0
+	}
+	return int(float64(this.size * 8) / this.duration)
 }
 
 func (this *SrsHlsSegment) WriteAudio(audio *SrsTsMessage) error {
+	this.has_frame = true
 	return this.muxer.WriteAudio(audio)
 }
 
 func (this *SrsHlsSegment) WriteVideo(video *SrsTsMessage) error {
+	this.has_frame = true
 	return this.muxer.WriteVideo(video)
 }
\ No newline at end of file
@@ -23,6 +23,32 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 
 package app
 
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"go_srs/srs/utils"
+)
+
+const SRS_HTTP_HOOKS_TIMEOUT = 30 * time.Second
+
+// the retries of on_dvr, the interval is doubled for each retry,
+// so the recording is not lost for a short outage of hook server.
+const SRS_HTTP_HOOKS_DVR_RETRIES = 5
+const SRS_HTTP_HOOKS_RETRY_INTERVAL = 1 * time.Second
+
+var httpHooksClient = &http.Client{
+	Timeout: SRS_HTTP_HOOKS_TIMEOUT,
+}
+
 func OnPublish(url string, req *SrsRequest) error {
 	return nil
 }
@@ -38,3 +64,174 @@ func OnPlay(url string, req *SrsRequest) error {
 func OnStop(url string, req *SrsRequest) error {
 	return nil
 }
+
+/**
+* the data of on_hls, posted when a segment is reaped.
+*/
+type SrsHttpHooksHlsData struct {
+	Action   string  `json:"action"`
+	Ip       string  `json:"ip"`
+	Vhost    string  `json:"vhost"`
+	App      string  `json:"app"`
+	Stream   string  `json:"stream"`
+	Param    string  `json:"param"`
+	Duration float64 `json:"duration"` // the segment duration in seconds.
+	Cwd      string  `json:"cwd"`
+	File     string  `json:"file"`     // the segment file path.
+	Url      string  `json:"url"`      // the segment url in m3u8.
+	M3u8     string  `json:"m3u8"`     // the m3u8 file path.
+	M3u8Url  string  `json:"m3u8_url"` // the m3u8 url.
+	SeqNo    int     `json:"seq_no"`
+}
+
+func OnHls(url string, req *SrsRequest, file string, ts_url string, m3u8 string, m3u8_url string, seq_no int, duration float64) error {
+	cwd, _ := os.Getwd()
+	data := &SrsHttpHooksHlsData{
+		Action:   "on_hls",
+		Ip:       req.ip,
+		Vhost:    req.vhost,
+		App:      req.app,
+		Stream:   req.stream,
+		Param:    req.param,
+		Duration: duration,
+		Cwd:      cwd,
+		File:     file,
+		Url:      ts_url,
+		M3u8:     m3u8,
+		M3u8Url:  m3u8_url,
+		SeqNo:    seq_no,
+	}
+
+	if err := do_post(url, data); err != nil {
+		return fmt.Errorf("on_hls failed, url=%s, err=%v", url, err)
+	}
+	return nil
+}
+
+/**
+* the data of on_dvr, posted when a dvr file is closed and renamed.
+*/
+type SrsHttpHooksDvrData struct {
+	Action    string  `json:"action"`
+	Ip        string  `json:"ip"`
+	Vhost     string  `json:"vhost"`
+	App       string  `json:"app"`
+	Stream    string  `json:"stream"`
+	Param     string  `json:"param"`
+	Cwd       string  `json:"cwd"`
+	File      string  `json:"file"`       // the final path of dvr file.
+	Duration  float64 `json:"duration"`   // the duration in seconds.
+	Size      int64   `json:"size"`       // the file size in bytes.
+	StartTime int64   `json:"start_time"` // the wall clock in ms when file opened.
+	EndTime   int64   `json:"end_time"`   // the wall clock in ms when file closed.
+}
+
+func OnDvr(url string, req *SrsRequest, file string, duration float64, size int64, start_time int64, end_time int64) error {
+	cwd, _ := os.Getwd()
+	data := &SrsHttpHooksDvrData{
+		Action:    "on_dvr",
+		Ip:        req.ip,
+		Vhost:     req.vhost,
+		App:       req.app,
+		Stream:    req.stream,
+		Param:     req.param,
+		Cwd:       cwd,
+		File:      file,
+		Duration:  duration,
+		Size:      size,
+		StartTime: start_time,
+		EndTime:   end_time,
+	}
+
+	if err := do_post_retry(url, data, SRS_HTTP_HOOKS_DVR_RETRIES); err != nil {
+		return fmt.Errorf("on_dvr failed, url=%s, err=%v", url, err)
+	}
+	return nil
+}
+
+/**
+* notify the cdn by GET the url, which is templated by [ts_url], [app] and [stream],
+* the response is read at most nb_notify bytes.
+*/
+func OnHlsNotify(url string, req *SrsRequest, ts_url string, nb_notify int) error {
+	url = utils.Srs_path_build_stream(url, req.vhost, req.app, req.stream)
+	url = strings.Replace(url, "[ts_url]", ts_url, -1)
+	url = strings.Replace(url, "[param]", req.param, -1)
+
+	res, err := httpHooksClient.Get(url)
+	if err != nil {
+		return fmt.Errorf("on_hls_notify failed, url=%s, err=%v", url, err)
+	}
+	defer res.Body.Close()
+
+	n, err := io.CopyN(ioutil.Discard, res.Body, int64(nb_notify))
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("on_hls_notify read failed, url=%s, err=%v", url, err)
+	}
+
+	fmt.Println("http hook on_hls_notify ok, url=", url, "status=", res.StatusCode, "read=", n)
+	return nil
+}
+
+/**
+* post the data to the hook, retry when failed, the interval is doubled for each retry.
+*/
+func do_post_retry(url string, data interface{}, retries int) error {
+	interval := SRS_HTTP_HOOKS_RETRY_INTERVAL
+
+	var err error
+	for i := 0; i <= retries; i++ {
+		if i > 0 {
+			fmt.Println("http hook retry, url=", url, "retry=", i, "err=", err)
+			time.Sleep(interval)
+			interval *= 2
+		}
+
+		if err = do_post(url, data); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+/**
+* post the data as json to the hook, the hook should respond with
+* http status 200 and the body is 0 or {"code": 0}.
+*/
+func do_post(url string, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	res, err := httpHooksClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return errors.New("http status " + strconv.Itoa(res.StatusCode))
+	}
+
+	v := strings.TrimSpace(string(b))
+	if v == "0" {
+		return nil
+	}
+
+	var r struct {
+		Code *int `json:"code"`
+	}
+	if err := json.Unmarshal([]byte(v), &r); err != nil || r.Code == nil {
+		return errors.New("invalid response " + v)
+	}
+	if *r.Code != 0 {
+		return errors.New("response code " + strconv.Itoa(*r.Code))
+	}
+	return nil
+}
@@ -72,6 +72,7 @@ const (
 	// ISO/IEC 11172 Video
 	// ITU-T Rec. H.262 | ISO/IEC 13818-2 Video or ISO/IEC 11172-2 constrained parameter video stream
 	// ISO/IEC 11172 Audio
+	SrsTsStreamAudioMpeg1 = 0x03
 	// ISO/IEC 13818-3 Audio
 	SrsTsStreamAudioMp3 = 0x04
 	// ITU-T Rec. H.222.0 | ISO/IEC 13818-1 private_sections
@@ -106,7 +107,7 @@ func srs_ts_stream2string(stream SrsTsStream) string {
 	switch stream {
 	case SrsTsStreamReserved:
 		return "Reserved"
-	case SrsTsStreamAudioMp3:
+	case SrsTsStreamAudioMpeg1, SrsTsStreamAudioMp3:
 		return "MP3"
 	case SrsTsStreamAudioAAC:
 		return "AAC"
@@ -0,0 +1,569 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 GOSRS(gosrs)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package app
+
+import (
+	"encoding/binary"
+	"go_srs/srs/codec"
+	"go_srs/srs/utils"
+)
+
+/**
+* the ISO base media file format boxes, for fMP4/CMAF segments.
+* @see: ISO_IEC_14496-12-base-format-2012.pdf
+* @see: ISO_IEC_14496-15-AVC-format-2012.pdf, 5.3.4 AVC Video Stream Definition
+* @see: ISO_IEC_14496-14-MP4-2003.pdf, 5.6 Sample Description Boxes
+*/
+
+// the track id of video and audio, in init and media segments.
+const SRS_MP4_VIDEO_TRACK_ID = 1
+const SRS_MP4_AUDIO_TRACK_ID = 2
+
+// all tracks use the tbn of ts, so the dts/pts of SrsTsMessage is used directly.
+const SRS_MP4_TIMESCALE = 90000
+
+// sample_flags, 8.8.3.1 Track Extends Box, the sample_depends_on and sample_is_non_sync_sample.
+const SRS_MP4_SAMPLE_FLAGS_SYNC = 0x02000000
+const SRS_MP4_SAMPLE_FLAGS_NON_SYNC = 0x01010000
+
+// the flags of tfhd and trun, 8.8.7 Track Fragment Header Box, 8.8.8 Track Fragment Run Box.
+const (
+	SRS_MP4_TFHD_DEFAULT_BASE_IS_MOOF = 0x020000
+
+	SRS_MP4_TRUN_DATA_OFFSET    = 0x000001
+	SRS_MP4_TRUN_FIRST_SAMPLE_FLAGS = 0x000004
+	SRS_MP4_TRUN_SAMPLE_DURATION = 0x000100
+	SRS_MP4_TRUN_SAMPLE_SIZE     = 0x000200
+	SRS_MP4_TRUN_SAMPLE_FLAGS    = 0x000400
+	SRS_MP4_TRUN_SAMPLE_CTS      = 0x000800
+)
+
+/**
+* a sample of track, in timescale SRS_MP4_TIMESCALE.
+*/
+type SrsMp4Sample struct {
+	dts      int64
+	pts      int64
+	duration uint32
+	keyframe bool
+	data     []byte
+	size     uint32 // the size of data, for the index of sample without data.
+}
+
+func mp4_box(typ string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+
+	stream := utils.NewSrsStream([]byte{})
+	stream.WriteInt32(int32(size), binary.BigEndian)
+	stream.WriteString(typ)
+	for _, p := range payloads {
+		stream.WriteBytes(p)
+	}
+	return stream.Data()
+}
+
+func mp4_full_box(typ string, version uint8, flags uint32, payloads ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4_box(typ, append([][]byte{header}, payloads...)...)
+}
+
+func mp4_u16(v uint16) []byte {
+	return []byte{byte(v >> 8), byte(v)}
+}
+
+func mp4_u32(v uint32) []byte {
+	return []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+func mp4_u64(v uint64) []byte {
+	return append(mp4_u32(uint32(v >> 32)), mp4_u32(uint32(v))...)
+}
+
+// the unity matrix of mvhd and tkhd.
+var mp4_matrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+func mp4_ftyp() []byte {
+	return mp4_box("ftyp", []byte("iso6"), mp4_u32(0), []byte("iso6cmfcisommp41"))
+}
+
+func mp4_mvhd(duration uint64) []byte {
+	stream := utils.NewSrsStream([]byte{})
+	stream.WriteBytes(mp4_u32(0))            // creation_time
+	stream.WriteBytes(mp4_u32(0))            // modification_time
+	stream.WriteBytes(mp4_u32(SRS_MP4_TIMESCALE))
+	stream.WriteBytes(mp4_u32(uint32(duration)))
+	stream.WriteBytes(mp4_u32(0x00010000))   // rate
+	stream.WriteBytes(mp4_u16(0x0100))       // volume
+	stream.WriteBytes(make([]byte, 10))      // reserved
+	for _, v := range mp4_matrix {
+		stream.WriteBytes(mp4_u32(v))
+	}
+	stream.WriteBytes(make([]byte, 24))      // pre_defined
+	stream.WriteBytes(mp4_u32(SRS_MP4_AUDIO_TRACK_ID + 1)) // next_track_ID
+	return mp4_full_box("mvhd", 0, 0, stream.Data())
+}
+
+func mp4_tkhd(track_id uint32, duration uint64, volume uint16, width int, height int) []byte {
+	stream := utils.NewSrsStream([]byte{})
+	stream.WriteBytes(mp4_u32(0))            // creation_time
+	stream.WriteBytes(mp4_u32(0))            // modification_time
+	stream.WriteBytes(mp4_u32(track_id))
+	stream.WriteBytes(mp4_u32(0))            // reserved
+	stream.WriteBytes(mp4_u32(uint32(duration)))
+	stream.WriteBytes(make([]byte, 8))       // reserved
+	stream.WriteBytes(mp4_u16(0))            // layer
+	stream.WriteBytes(mp4_u16(0))            // alternate_group
+	stream.WriteBytes(mp4_u16(volume))
+	stream.WriteBytes(mp4_u16(0))            // reserved
+	for _, v := range mp4_matrix {
+		stream.WriteBytes(mp4_u32(v))
+	}
+	stream.WriteBytes(mp4_u32(uint32(width) << 16))
+	stream.WriteBytes(mp4_u32(uint32(height) << 16))
+	// track_enabled | track_in_movie
+	return mp4_full_box("tkhd", 0, 0x03, stream.Data())
+}
+
+func mp4_mdhd(duration uint64) []byte {
+	stream := utils.NewSrsStream([]byte{})
+	stream.WriteBytes(mp4_u32(0))            // creation_time
+	stream.WriteBytes(mp4_u32(0))            // modification_time
+	stream.WriteBytes(mp4_u32(SRS_MP4_TIMESCALE))
+	stream.WriteBytes(mp4_u32(uint32(duration)))
+	stream.WriteBytes(mp4_u16(0x55c4))       // language, und
+	stream.WriteBytes(mp4_u16(0))            // pre_defined
+	return mp4_full_box("mdhd", 0, 0, stream.Data())
+}
+
+func mp4_hdlr(handler string, name string) []byte {
+	stream := utils.NewSrsStream([]byte{})
+	stream.WriteBytes(mp4_u32(0))            // pre_defined
+	stream.WriteString(handler)
+	stream.WriteBytes(make([]byte, 12))      // reserved
+	stream.WriteString(name)
+	stream.WriteByte(0)
+	return mp4_full_box("hdlr", 0, 0, stream.Data())
+}
+
+func mp4_dinf() []byte {
+	url := mp4_full_box("url ", 0, 0x01)
+	dref := mp4_full_box("dref", 0, 0, mp4_u32(1), url)
+	return mp4_box("dinf", dref)
+}
+
+/**
+* the visual sample entry with avcC, the avcC is the AVCDecoderConfigurationRecord
+* which is exactly the avc sequence header of flv.
+*/
+func mp4_avc1(c *SrsAvcAacCodec) []byte {
+	stream := utils.NewSrsStream([]byte{})
+	stream.WriteBytes(make([]byte, 6))       // reserved
+	stream.WriteBytes(mp4_u16(1))            // data_reference_index
+	stream.WriteBytes(make([]byte, 16))      // pre_defined and reserved
+	stream.WriteBytes(mp4_u16(uint16(c.width)))
+	stream.WriteBytes(mp4_u16(uint16(c.height)))
+	stream.WriteBytes(mp4_u32(0x00480000))   // horizresolution, 72 dpi
+	stream.WriteBytes(mp4_u32(0x00480000))   // vertresolution, 72 dpi
+	stream.WriteBytes(mp4_u32(0))            // reserved
+	stream.WriteBytes(mp4_u16(1))            // frame_count
+	stream.WriteBytes(make([]byte, 32))      // compressorname
+	stream.WriteBytes(mp4_u16(0x0018))       // depth
+	stream.WriteBytes(mp4_u16(0xffff))       // pre_defined
+	stream.WriteBytes(mp4_box("avcC", c.avcExtraData))
+	return mp4_box("avc1", stream.Data())
+}
+
+/**
+* the descriptor of esds, use the 4bytes size for simple.
+* @see: ISO_IEC_14496-1-System-2010.pdf, 8.3.3 Expandable classes.
+*/
+func mp4_descriptor(tag byte, payload []byte) []byte {
+	size := len(payload)
+	d := []byte{tag, byte(0x80 | ((size >> 21) & 0x7f)), byte(0x80 | ((size >> 14) & 0x7f)), byte(0x80 | ((size >> 7) & 0x7f)), byte(size & 0x7f)}
+	return append(d, payload...)
+}
+
+/**
+* the audio sample entry with esds, the DecoderSpecificInfo of aac is the
+* AudioSpecificConfig, which is exactly the aac sequence header of flv.
+*/
+func mp4_mp4a(c *SrsAvcAacCodec) []byte {
+	// 0x40, Audio ISO/IEC 14496-3; 0x6B, Audio ISO/IEC 11172-3.
+	var objectTypeIndication byte = 0x40
+	if c.audioCodecId == codec.SrsCodecAudioMP3 {
+		objectTypeIndication = 0x6B
+	}
+
+	dcd := utils.NewSrsStream([]byte{})
+	dcd.WriteByte(objectTypeIndication)
+	dcd.WriteByte(0x15)                      // streamType AudioStream(0x05)<<2 | upStream(0)<<1 | reserved(1)
+	dcd.WriteBytes([]byte{0, 0, 0})          // bufferSizeDB
+	dcd.WriteBytes(mp4_u32(0))               // maxBitrate
+	dcd.WriteBytes(mp4_u32(0))               // avgBitrate
+	if len(c.aacExtraData) > 0 && c.audioCodecId == codec.SrsCodecAudioAAC {
+		dcd.WriteBytes(mp4_descriptor(0x05, c.aacExtraData))
+	}
+
+	es := utils.NewSrsStream([]byte{})
+	es.WriteBytes(mp4_u16(SRS_MP4_AUDIO_TRACK_ID)) // ES_ID
+	es.WriteByte(0)                          // flags
+	es.WriteBytes(mp4_descriptor(0x04, dcd.Data()))
+	es.WriteBytes(mp4_descriptor(0x06, []byte{0x02}))
+	esds := mp4_full_box("esds", 0, 0, mp4_descriptor(0x03, es.Data()))
+
+	channels := int(c.aacChannels)
+	sampleRate := c.aac_sample_rate()
+	if c.audioCodecId == codec.SrsCodecAudioMP3 {
+		channels, sampleRate = c.mp3Channels, c.mp3SampleRate
+	}
+	if channels <= 0 {
+		channels = 2
+	}
+	if sampleRate <= 0 {
+		sampleRate = 44100
+	}
+
+	stream := utils.NewSrsStream([]byte{})
+	stream.WriteBytes(make([]byte, 6))       // reserved
+	stream.WriteBytes(mp4_u16(1))            // data_reference_index
+	stream.WriteBytes(make([]byte, 8))       // reserved
+	stream.WriteBytes(mp4_u16(uint16(channels)))
+	stream.WriteBytes(mp4_u16(16))           // samplesize
+	stream.WriteBytes(mp4_u32(0))            // pre_defined and reserved
+	stream.WriteBytes(mp4_u32(uint32(sampleRate) << 16))
+	stream.WriteBytes(esds)
+	return mp4_box("mp4a", stream.Data())
+}
+
+/**
+* the empty sample tables for fragmented mp4, the samples are in moof.
+*/
+func mp4_empty_stbl(sample_entry []byte) []byte {
+	stsd := mp4_full_box("stsd", 0, 0, mp4_u32(1), sample_entry)
+	stts := mp4_full_box("stts", 0, 0, mp4_u32(0))
+	stsc := mp4_full_box("stsc", 0, 0, mp4_u32(0))
+	stsz := mp4_full_box("stsz", 0, 0, mp4_u32(0), mp4_u32(0))
+	stco := mp4_full_box("stco", 0, 0, mp4_u32(0))
+	return mp4_box("stbl", stsd, stts, stsc, stsz, stco)
+}
+
+func mp4_video_trak(c *SrsAvcAacCodec, duration uint64, stbl []byte) []byte {
+	vmhd := mp4_full_box("vmhd", 0, 0x01, make([]byte, 8))
+	minf := mp4_box("minf", vmhd, mp4_dinf(), stbl)
+	mdia := mp4_box("mdia", mp4_mdhd(duration), mp4_hdlr("vide", "VideoHandler"), minf)
+	return mp4_box("trak", mp4_tkhd(SRS_MP4_VIDEO_TRACK_ID, duration, 0, c.width, c.height), mdia)
+}
+
+func mp4_audio_trak(c *SrsAvcAacCodec, duration uint64, stbl []byte) []byte {
+	smhd := mp4_full_box("smhd", 0, 0, make([]byte, 4))
+	minf := mp4_box("minf", smhd, mp4_dinf(), stbl)
+	mdia := mp4_box("mdia", mp4_mdhd(duration), mp4_hdlr("soun", "SoundHandler"), minf)
+	return mp4_box("trak", mp4_tkhd(SRS_MP4_AUDIO_TRACK_ID, duration, 0x0100, 0, 0), mdia)
+}
+
+func mp4_trex(track_id uint32) []byte {
+	return mp4_full_box("trex", 0, 0, mp4_u32(track_id), mp4_u32(1), mp4_u32(0), mp4_u32(0), mp4_u32(0))
+}
+
+/**
+* the init segment of fMP4, the ftyp and moov with mvex,
+* only the track with sequence header is written.
+*/
+func mp4_init_segment(c *SrsAvcAacCodec, video bool, audio bool) []byte {
+	video = video && c.is_avc_codec_ok()
+	audio = audio && (c.is_aac_codec_ok() || c.audioCodecId == codec.SrsCodecAudioMP3)
+
+	boxes := [][]byte{mp4_mvhd(0)}
+	mvex := make([][]byte, 0)
+	if video {
+		boxes = append(boxes, mp4_video_trak(c, 0, mp4_empty_stbl(mp4_avc1(c))))
+		mvex = append(mvex, mp4_trex(SRS_MP4_VIDEO_TRACK_ID))
+	}
+	if audio {
+		boxes = append(boxes, mp4_audio_trak(c, 0, mp4_empty_stbl(mp4_mp4a(c))))
+		mvex = append(mvex, mp4_trex(SRS_MP4_AUDIO_TRACK_ID))
+	}
+	boxes = append(boxes, mp4_box("mvex", mvex...))
+
+	return append(mp4_ftyp(), mp4_box("moov", boxes...)...)
+}
+
+func mp4_traf(track_id uint32, samples []*SrsMp4Sample, data_offset uint32) []byte {
+	tfhd := mp4_full_box("tfhd", 0, SRS_MP4_TFHD_DEFAULT_BASE_IS_MOOF, mp4_u32(track_id))
+	tfdt := mp4_full_box("tfdt", 1, 0, mp4_u64(uint64(samples[0].dts)))
+
+	stream := utils.NewSrsStream([]byte{})
+	stream.WriteBytes(mp4_u32(uint32(len(samples))))
+	stream.WriteBytes(mp4_u32(data_offset))
+	for _, s := range samples {
+		flags := uint32(SRS_MP4_SAMPLE_FLAGS_NON_SYNC)
+		if s.keyframe {
+			flags = SRS_MP4_SAMPLE_FLAGS_SYNC
+		}
+		stream.WriteBytes(mp4_u32(s.duration))
+		stream.WriteBytes(mp4_u32(uint32(len(s.data))))
+		stream.WriteBytes(mp4_u32(flags))
+		// version 1, the signed composition time offset.
+		stream.WriteBytes(mp4_u32(uint32(int32(s.pts - s.dts))))
+	}
+	trunFlags := uint32(SRS_MP4_TRUN_DATA_OFFSET | SRS_MP4_TRUN_SAMPLE_DURATION | SRS_MP4_TRUN_SAMPLE_SIZE | SRS_MP4_TRUN_SAMPLE_FLAGS | SRS_MP4_TRUN_SAMPLE_CTS)
+	trun := mp4_full_box("trun", 1, trunFlags, stream.Data())
+
+	return mp4_box("traf", tfhd, tfdt, trun)
+}
+
+/**
+* the media fragment of fMP4, a moof and a mdat, the track without samples is ignored.
+* @param sequence the sequence_number of mfhd, increase for each fragment.
+*/
+func mp4_fragment(sequence uint32, video []*SrsMp4Sample, audio []*SrsMp4Sample) []byte {
+	build := func(offsets []uint32) []byte {
+		boxes := [][]byte{mp4_full_box("mfhd", 0, 0, mp4_u32(sequence))}
+		if len(video) > 0 {
+			boxes = append(boxes, mp4_traf(SRS_MP4_VIDEO_TRACK_ID, video, offsets[0]))
+		}
+		if len(audio) > 0 {
+			boxes = append(boxes, mp4_traf(SRS_MP4_AUDIO_TRACK_ID, audio, offsets[1]))
+		}
+		return mp4_box("moof", boxes...)
+	}
+
+	mdat := make([]byte, 0)
+	for _, s := range video {
+		mdat = append(mdat, s.data...)
+	}
+	videoSize := len(mdat)
+	for _, s := range audio {
+		mdat = append(mdat, s.data...)
+	}
+
+	// the size of moof never changes with the data offset,
+	// so build it twice to get the offset relative to the moof.
+	moofSize := len(build([]uint32{0, 0}))
+	moof := build([]uint32{uint32(moofSize + 8), uint32(moofSize + 8 + videoSize)})
+	return append(moof, mp4_box("mdat", mdat)...)
+}
+
+/**
+* the payloads of child boxes of the type.
+*/
+func srs_mp4_children(data []byte, typ string) [][]byte {
+	children := make([][]byte, 0)
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			break
+		}
+		if string(data[4:8]) == typ {
+			children = append(children, data[8:size])
+		}
+		data = data[size:]
+	}
+	return children
+}
+
+/**
+* the decode time of the first sample and after the last sample of traf, by tfdt and trun.
+*/
+func srs_mp4_traf_time(traf []byte) (int64, int64, bool) {
+	tfdts, truns := srs_mp4_children(traf, "tfdt"), srs_mp4_children(traf, "trun")
+	if len(tfdts) == 0 || len(tfdts[0]) < 8 {
+		return 0, 0, false
+	}
+
+	tfdt := tfdts[0]
+	from := int64(binary.BigEndian.Uint32(tfdt[4:]))
+	if tfdt[0] == 1 && len(tfdt) >= 12 {
+		from = int64(binary.BigEndian.Uint64(tfdt[4:]))
+	}
+
+	to := from
+	for _, trun := range truns {
+		if len(trun) < 8 {
+			continue
+		}
+		flags := binary.BigEndian.Uint32(trun) & 0xffffff
+		count := int(binary.BigEndian.Uint32(trun[4:]))
+		p := trun[8:]
+		for _, flag := range []uint32{SRS_MP4_TRUN_DATA_OFFSET, SRS_MP4_TRUN_FIRST_SAMPLE_FLAGS} {
+			if flags & flag != 0 && len(p) >= 4 {
+				p = p[4:]
+			}
+		}
+
+		sample_size := 0
+		for _, flag := range []uint32{SRS_MP4_TRUN_SAMPLE_DURATION, SRS_MP4_TRUN_SAMPLE_SIZE, SRS_MP4_TRUN_SAMPLE_FLAGS, SRS_MP4_TRUN_SAMPLE_CTS} {
+			if flags & flag != 0 {
+				sample_size += 4
+			}
+		}
+		// the duration is the first field of sample, the default duration of tfhd is never written.
+		for i := 0; i < count && flags & SRS_MP4_TRUN_SAMPLE_DURATION != 0 && len(p) >= sample_size; i++ {
+			to += int64(binary.BigEndian.Uint32(p))
+			p = p[sample_size:]
+		}
+	}
+	return from, to, true
+}
+
+/**
+* the ftyp of progressive mp4, which is not fragmented.
+*/
+func mp4_ftyp_progressive() []byte {
+	return mp4_box("ftyp", []byte("isom"), mp4_u32(0x200), []byte("isomiso2avc1mp41"))
+}
+
+/**
+* the chunk of progressive mp4, the continuous samples of a track in mdat.
+*/
+type SrsMp4Chunk struct {
+	offset int64
+	count  int
+}
+
+/**
+* the sample tables of progressive mp4.
+* @param samples the samples of track, the size is used and the data is ignored.
+* @param chunks the chunks of track, the offset is in the file.
+*/
+func mp4_stbl(sample_entry []byte, samples []*SrsMp4Sample, chunks []*SrsMp4Chunk) []byte {
+	stsd := mp4_full_box("stsd", 0, 0, mp4_u32(1), sample_entry)
+	boxes := [][]byte{stsd}
+
+	// 8.6.1.2 Decoding Time to Sample Box, run-length of durations.
+	stts := utils.NewSrsStream([]byte{})
+	entries := 0
+	for i := 0; i < len(samples); {
+		j := i
+		for j < len(samples) && samples[j].duration == samples[i].duration {
+			j++
+		}
+		stts.WriteBytes(mp4_u32(uint32(j - i)))
+		stts.WriteBytes(mp4_u32(samples[i].duration))
+		entries++
+		i = j
+	}
+	boxes = append(boxes, mp4_full_box("stts", 0, 0, mp4_u32(uint32(entries)), stts.Data()))
+
+	// 8.6.1.3 Composition Time to Sample Box, only when pts is not dts.
+	has_cts := false
+	for _, s := range samples {
+		if s.pts != s.dts {
+			has_cts = true
+			break
+		}
+	}
+	if has_cts {
+		ctts := utils.NewSrsStream([]byte{})
+		for _, s := range samples {
+			ctts.WriteBytes(mp4_u32(1))
+			ctts.WriteBytes(mp4_u32(uint32(int32(s.pts - s.dts))))
+		}
+		boxes = append(boxes, mp4_full_box("ctts", 1, 0, mp4_u32(uint32(len(samples))), ctts.Data()))
+	}
+
+	// 8.6.2 Sync Sample Box, absent means all samples are sync.
+	stss := utils.NewSrsStream([]byte{})
+	syncs := 0
+	for i, s := range samples {
+		if s.keyframe {
+			stss.WriteBytes(mp4_u32(uint32(i + 1)))
+			syncs++
+		}
+	}
+	if syncs != len(samples) {
+		boxes = append(boxes, mp4_full_box("stss", 0, 0, mp4_u32(uint32(syncs)), stss.Data()))
+	}
+
+	stsc := utils.NewSrsStream([]byte{})
+	stco := utils.NewSrsStream([]byte{})
+	large := false
+	for _, c := range chunks {
+		if c.offset > 0xffffffff {
+			large = true
+		}
+	}
+	entries = 0
+	for i, c := range chunks {
+		if i == 0 || chunks[i-1].count != c.count {
+			stsc.WriteBytes(mp4_u32(uint32(i + 1))) // first_chunk
+			stsc.WriteBytes(mp4_u32(uint32(c.count)))
+			stsc.WriteBytes(mp4_u32(1))             // sample_description_index
+			entries++
+		}
+		if large {
+			stco.WriteBytes(mp4_u64(uint64(c.offset)))
+		} else {
+			stco.WriteBytes(mp4_u32(uint32(c.offset)))
+		}
+	}
+	boxes = append(boxes, mp4_full_box("stsc", 0, 0, mp4_u32(uint32(entries)), stsc.Data()))
+
+	stsz := utils.NewSrsStream([]byte{})
+	for _, s := range samples {
+		stsz.WriteBytes(mp4_u32(s.size))
+	}
+	boxes = append(boxes, mp4_full_box("stsz", 0, 0, mp4_u32(0), mp4_u32(uint32(len(samples))), stsz.Data()))
+
+	if large {
+		boxes = append(boxes, mp4_full_box("co64", 0, 0, mp4_u32(uint32(len(chunks))), stco.Data()))
+	} else {
+		boxes = append(boxes, mp4_full_box("stco", 0, 0, mp4_u32(uint32(len(chunks))), stco.Data()))
+	}
+	return mp4_box("stbl", boxes...)
+}
+
+/**
+* the header of mdat, use the largesize when the data exceed 4GB.
+*/
+func mp4_mdat_header(size int64) []byte {
+	if size + 8 > 0xffffffff {
+		return append(append(mp4_u32(1), []byte("mdat")...), mp4_u64(uint64(size + 16))...)
+	}
+	return append(mp4_u32(uint32(size + 8)), []byte("mdat")...)
+}
+
+/**
+* the data of avc sample in mdat, the nalus prefixed by 4bytes length,
+* the sps/pps/aud is in the avcC of sample entry so it's ignored.
+*/
+func mp4_avcc_sample(sample *SrsCodecSample) []byte {
+	data := make([]byte, 0)
+	for _, nalu := range sample.SampleUnits {
+		if len(nalu) == 0 {
+			continue
+		}
+
+		naluType := codec.SrsAvcNaluType(nalu[0] & 0x1f)
+		if naluType == codec.SrsAvcNaluTypeAccessUnitDelimiter || naluType == codec.SrsAvcNaluTypeSPS || naluType == codec.SrsAvcNaluTypePPS {
+			continue
+		}
+		data = append(data, mp4_u32(uint32(len(nalu)))...)
+		data = append(data, nalu...)
+	}
+	return data
+}
@@ -0,0 +1,502 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 GOSRS(gosrs)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package app
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"go_srs/srs/app/config"
+	"go_srs/srs/codec"
+	"go_srs/srs/protocol/rtmp"
+)
+
+// the max duration in ms of fragment for pure audio,
+// the fragment of stream with video is reaped at keyframe.
+const SRS_DVR_MP4_AUDIO_FRAGMENT = 1000
+// the suffix of the progressive mp4 being rewritten, renamed to the path when done.
+const SRS_DVR_MP4_FASTSTART_SUFFIX = ".faststart.tmp"
+
+/**
+* the samples of track in the fragmented mp4, and where the samples
+* are in the fragmented file, to rewrite to faststart mp4.
+*/
+type SrsMp4Run struct {
+	from	int64 // the offset in the fragmented file.
+	size	int64
+	chunk	*SrsMp4Chunk
+}
+
+/**
+* the mp4 segment of dvr, write the fragmented mp4 when recording,
+* and rewrite to the progressive mp4 with moov in front when closed,
+* if dvr_mp4_faststart is on.
+*/
+type SrsMp4Segment struct {
+	path			string
+	req				*SrsRequest
+	tmpFile			string
+	faststart		bool
+	jitter			*SrsRtmpJitter
+	jitterAlgorithm	SrsRtmpJitterAlgorithm // the time_jitter of dvr.
+	file			SrsStorageFile
+	storage			SrsStorage // the storage of mp4, local disk or s3.
+	openTime		time.Time // the wall clock when file opened.
+	fileSize		int64 // the size of file, set when closed.
+	offset			int64 // the size written to file.
+	syncer			*SrsDvrSyncer
+
+	codec			*SrsAvcAacCodec
+	sample			*SrsCodecSample
+	// the moov is written at the first sample, with the tracks which got sequence header.
+	initialized		bool
+	hasVideo		bool
+	hasAudio		bool
+	sequence		uint32 // the sequence of moof.
+	// the samples of current fragment.
+	video			*SrsDashTrack
+	audio			*SrsDashTrack
+	// the index of samples and runs, for faststart.
+	videoSamples	[]*SrsMp4Sample
+	audioSamples	[]*SrsMp4Sample
+	videoChunks		[]*SrsMp4Chunk
+	audioChunks		[]*SrsMp4Chunk
+	runs			[]*SrsMp4Run
+	// the dts in ms of the first and last sample, for duration.
+	startTime		int64
+	lastTime		int64
+}
+
+func NewSrsMp4Segment(r *SrsRequest) *SrsMp4Segment {
+	return &SrsMp4Segment{
+		req:r,
+		storage:NewSrsStorage(r.vhost),
+		syncer:NewSrsDvrSyncer(r.vhost),
+		jitterAlgorithm:SrsTimeJitterString2Int(config.GetDvrTimeJitter(r.vhost)),
+		faststart:config.GetDvrMp4Faststart(r.vhost),
+	}
+}
+
+func (this *SrsMp4Segment) Open(useTmpFile bool) error {
+	if this.file != nil {
+		return nil
+	}
+
+	this.path = srs_dvr_generate_path(this.storage, this.req, ".mp4")
+	fmt.Println("dvr: open file=", this.path)
+
+	// the fragmented mp4 is rewritten to the path for faststart.
+	if useTmpFile || this.faststart {
+		this.tmpFile = this.path + ".tmp"
+	} else {
+		this.tmpFile = this.path
+	}
+
+	var err error
+	if this.file, err = this.storage.Create(this.tmpFile); err != nil {
+		return err
+	}
+	// never deleted by the janitor until closed.
+	srs_dvr_writing_add(this.path)
+
+	this.jitter = NewSrsRtmpJitter()
+	this.codec = NewSrsAvcAacCodec()
+	this.sample = NewSrsCodecSample()
+	this.video = NewSrsDashTrack(SRS_DASH_TRACK_VIDEO, SRS_MP4_VIDEO_TRACK_ID, SRS_FMP4_DEFAULT_VIDEO_DURATION)
+	this.audio = NewSrsDashTrack(SRS_DASH_TRACK_AUDIO, SRS_MP4_AUDIO_TRACK_ID, SRS_FMP4_DEFAULT_AUDIO_DURATION)
+	this.initialized, this.hasVideo, this.hasAudio = false, false, false
+	this.sequence = 1
+	this.offset = 0
+	this.videoSamples, this.audioSamples = nil, nil
+	this.videoChunks, this.audioChunks, this.runs = nil, nil, nil
+	this.startTime, this.lastTime = -1, -1
+	this.openTime = time.Now()
+	return nil
+}
+
+func (this *SrsMp4Segment) Path() string {
+	return this.path
+}
+
+func (this *SrsMp4Segment) Close() error {
+	if this.file == nil {
+		return nil
+	}
+	defer srs_dvr_writing_remove(this.path)
+
+	if err := this.flush(); err != nil {
+		return err
+	}
+
+	var err error
+	if this.faststart && this.initialized {
+		if err = this.rewrite(); err != nil {
+			this.file.Close()
+			this.file = nil
+			return err
+		}
+
+		if err = this.file.Close(); err != nil {
+			return err
+		}
+		this.file = nil
+
+		if err = this.storage.Remove(this.tmpFile); err != nil {
+			return err
+		}
+	} else {
+		this.fileSize = this.offset
+		if err = this.syncer.on_close(this.file); err != nil {
+			return err
+		}
+
+		if err = this.file.Close(); err != nil {
+			return err
+		}
+		this.file = nil
+
+		if this.tmpFile != this.path {
+			if err = this.storage.Rename(this.tmpFile, this.path); err != nil {
+				return err
+			}
+		}
+	}
+
+	srs_dvr_on_dvr(this.req, this.path, this.duration(), this.fileSize, this.openTime)
+	return nil
+}
+
+/**
+* the duration in ms of the samples written.
+*/
+func (this *SrsMp4Segment) duration() int64 {
+	if this.startTime < 0 {
+		return 0
+	}
+	return this.lastTime - this.startTime
+}
+
+func (this *SrsMp4Segment) IsOverflow(maxDuration int64) bool {
+	return this.duration() > maxDuration
+}
+
+/**
+* the metadata is ignored, the mp4 describes the stream by moov.
+*/
+func (this *SrsMp4Segment) WriteMetaData(msg *rtmp.SrsRtmpMessage) error {
+	return nil
+}
+
+func (this *SrsMp4Segment) WriteVideo(msg *rtmp.SrsRtmpMessage) error {
+	if this.file == nil {
+		return errors.New("dvr: mp4 file is not opened")
+	}
+
+	timestamp := this.jitter.CorrectTimestamp(msg.GetHeader().GetTimestamp(), this.jitterAlgorithm)
+
+	this.sample.Clear()
+	if err := this.codec.video_avc_demux(msg.GetPayload(), this.sample); err != nil {
+		return err
+	}
+
+	if this.codec.videoCodecId != codec.SrsCodecVideoAVC || this.sample.FrameType == codec.SrsCodecVideoAVCFrameVideoInfoFrame {
+		return nil
+	}
+
+	// the sequence header is written in moov, it can't be changed after moov written.
+	if this.sample.AvcPacketType == codec.SrsCodecVideoAVCTypeSequenceHeader {
+		return nil
+	}
+
+	keyframe := this.sample.FrameType == codec.SrsCodecVideoAVCFrameKeyFrame
+	if !this.initialized {
+		// the mp4 always starts at keyframe.
+		if !keyframe {
+			return nil
+		}
+		if err := this.initialize(); err != nil {
+			return err
+		}
+	}
+
+	if !this.hasVideo {
+		return nil
+	}
+
+	data := mp4_avcc_sample(this.sample)
+	if len(data) == 0 {
+		return nil
+	}
+
+	if keyframe && len(this.video.samples) > 0 {
+		if err := this.flush(); err != nil {
+			return err
+		}
+	}
+
+	dts := timestamp * 90
+	this.video.write_sample(&SrsMp4Sample{
+		dts:      dts,
+		pts:      dts + int64(this.sample.Cts)*90,
+		keyframe: keyframe,
+		data:     data,
+	})
+	this.onUpdateDuration(timestamp)
+	return nil
+}
+
+func (this *SrsMp4Segment) WriteAudio(msg *rtmp.SrsRtmpMessage) error {
+	if this.file == nil {
+		return errors.New("dvr: mp4 file is not opened")
+	}
+
+	timestamp := this.jitter.CorrectTimestamp(msg.GetHeader().GetTimestamp(), this.jitterAlgorithm)
+
+	this.sample.Clear()
+	if err := this.codec.audio_aac_demux(msg.GetPayload(), this.sample); err != nil {
+		return err
+	}
+
+	// only aac is supported by mp4 dvr.
+	if codec.SrsCodecAudio(this.codec.audioCodecId) != codec.SrsCodecAudioAAC {
+		return nil
+	}
+
+	if this.sample.AacPacketType == codec.SrsCodecAudioTypeSequenceHeader {
+		return nil
+	}
+
+	if !this.initialized {
+		// for stream with video, wait for the keyframe to write moov.
+		if this.codec.is_avc_codec_ok() {
+			return nil
+		}
+		if err := this.initialize(); err != nil {
+			return err
+		}
+	}
+
+	if !this.hasAudio {
+		return nil
+	}
+
+	data := make([]byte, 0)
+	for _, frame := range this.sample.SampleUnits {
+		data = append(data, frame...)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	if !this.hasVideo && this.audio.duration() >= SRS_DVR_MP4_AUDIO_FRAGMENT * 90 {
+		if err := this.flush(); err != nil {
+			return err
+		}
+	}
+
+	dts := timestamp * 90
+	this.audio.write_sample(&SrsMp4Sample{
+		dts:      dts,
+		pts:      dts,
+		keyframe: true,
+		data:     data,
+	})
+	this.onUpdateDuration(timestamp)
+	return nil
+}
+
+func (this *SrsMp4Segment) onUpdateDuration(timestamp int64) {
+	if this.startTime < 0 {
+		this.startTime = timestamp
+	}
+	if timestamp > this.lastTime {
+		this.lastTime = timestamp
+	}
+}
+
+/**
+* write the ftyp and moov of fragmented mp4, with the tracks got sequence header.
+*/
+func (this *SrsMp4Segment) initialize() error {
+	this.hasVideo = this.codec.is_avc_codec_ok()
+	this.hasAudio = this.codec.is_aac_codec_ok()
+	this.initialized = true
+
+	return this.write(mp4_init_segment(this.codec, this.hasVideo, this.hasAudio))
+}
+
+func (this *SrsMp4Segment) write(data []byte) error {
+	if this.file == nil {
+		return errors.New("dvr: mp4 file is not opened")
+	}
+
+	if _, err := this.file.Write(data); err != nil {
+		return err
+	}
+	this.offset += int64(len(data))
+	return this.syncer.on_write(this.file)
+}
+
+/**
+* write the samples of tracks as a fragment, and index the samples for faststart.
+*/
+func (this *SrsMp4Segment) flush() error {
+	if this.file == nil {
+		return errors.New("dvr: mp4 file is not opened")
+	}
+
+	if len(this.video.samples) == 0 && len(this.audio.samples) == 0 {
+		return nil
+	}
+
+	fragment := mp4_fragment(this.sequence, this.video.samples, this.audio.samples)
+	this.sequence++
+
+	// the samples in mdat, video then audio, the header of mdat is 8bytes.
+	from := this.offset + int64(binary.BigEndian.Uint32(fragment)) + 8
+	index := func(samples []*SrsMp4Sample, indexes *[]*SrsMp4Sample, chunks *[]*SrsMp4Chunk) {
+		if len(samples) == 0 {
+			return
+		}
+
+		var size int64
+		for _, s := range samples {
+			size += int64(len(s.data))
+			*indexes = append(*indexes, &SrsMp4Sample{dts:s.dts, pts:s.pts, duration:s.duration, keyframe:s.keyframe, size:uint32(len(s.data))})
+		}
+
+		chunk := &SrsMp4Chunk{count:len(samples)}
+		*chunks = append(*chunks, chunk)
+		this.runs = append(this.runs, &SrsMp4Run{from:from, size:size, chunk:chunk})
+		from += size
+	}
+	index(this.video.samples, &this.videoSamples, &this.videoChunks)
+	index(this.audio.samples, &this.audioSamples, &this.audioChunks)
+
+	this.video.samples = nil
+	this.audio.samples = nil
+	return this.write(fragment)
+}
+
+/**
+* rewrite the fragmented mp4 to the progressive mp4, the ftyp, moov then mdat.
+*/
+func (this *SrsMp4Segment) rewrite() error {
+	var size int64
+	for _, r := range this.runs {
+		size += r.size
+	}
+
+	// the size of moov changes when stco changed to co64, so build until it's stable.
+	ftyp, mdat := mp4_ftyp_progressive(), mp4_mdat_header(size)
+	moov := this.moov()
+	for {
+		base := int64(len(ftyp) + len(moov) + len(mdat))
+		for _, r := range this.runs {
+			r.chunk.offset = base
+			base += r.size
+		}
+
+		nb := len(moov)
+		if moov = this.moov(); len(moov) == nb {
+			break
+		}
+	}
+
+	// never write to the path, which is visible only when completed.
+	tmpFile := this.path + SRS_DVR_MP4_FASTSTART_SUFFIX
+	f, err := this.storage.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+
+	written, err := this.rewriteTo(f, [][]byte{ftyp, moov, mdat})
+	if err == nil {
+		err = this.syncer.on_close(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		this.storage.Remove(tmpFile)
+		return err
+	}
+
+	this.fileSize = written
+	return this.storage.Rename(tmpFile, this.path)
+}
+
+/**
+* write the boxes then the samples of runs in order.
+*/
+func (this *SrsMp4Segment) rewriteTo(f SrsStorageFile, boxes [][]byte) (int64, error) {
+	written := int64(0)
+	for _, data := range boxes {
+		if _, err := f.Write(data); err != nil {
+			return written, err
+		}
+		written += int64(len(data))
+	}
+
+	for _, r := range this.runs {
+		if _, err := io.Copy(f, io.NewSectionReader(this.file, r.from, r.size)); err != nil {
+			return written, err
+		}
+		written += r.size
+	}
+	return written, nil
+}
+
+/**
+* the moov of progressive mp4, by the index of samples.
+*/
+func (this *SrsMp4Segment) moov() []byte {
+	track_duration := func(samples []*SrsMp4Sample) uint64 {
+		var d uint64
+		for _, s := range samples {
+			d += uint64(s.duration)
+		}
+		return d
+	}
+
+	var duration uint64
+	boxes := [][]byte{}
+	if this.hasVideo && len(this.videoSamples) > 0 {
+		d := track_duration(this.videoSamples)
+		if d > duration {
+			duration = d
+		}
+		boxes = append(boxes, mp4_video_trak(this.codec, d, mp4_stbl(mp4_avc1(this.codec), this.videoSamples, this.videoChunks)))
+	}
+	if this.hasAudio && len(this.audioSamples) > 0 {
+		d := track_duration(this.audioSamples)
+		if d > duration {
+			duration = d
+		}
+		boxes = append(boxes, mp4_audio_trak(this.codec, d, mp4_stbl(mp4_mp4a(this.codec), this.audioSamples, this.audioChunks)))
+	}
+
+	return mp4_box("moov", append([][]byte{mp4_mvhd(duration)}, boxes...)...)
+}
@@ -1,6 +1,7 @@
 package app
 
 import (
+	"go_srs/srs/app/config"
 	"go_srs/srs/protocol/rtmp"
 )
 
@@ -16,37 +17,71 @@ const CONST_MAX_JITTER_MS_NEG 	= -250
 const CONST_MAX_JITTER_MS 		= 250
 const DEFAULT_FRAME_TIME_MS		= 10
 
+// the rollover of 32bits timestamp of rtmp, about 49.7 days.
+const SRS_RTMP_TIMESTAMP_ROLLOVER = int64(1) << 32
+
 type SrsRtmpJitter struct {
 	lastPktTime			int64
 	lastPktCorrectTime	int64
+	lastRawTime			int64 // the previous 32bits timestamp, -1 for the first packet.
+	rollover			int64 // the offset of 32bits timestamp rollover.
+	lastTime			int64 // the previous unwrapped timestamp.
+	delta				int64 // the delta of original timestamp of last packet.
+	base				int64 // the corrected timestamp to continue from, for dvr append.
 }
 
 func NewSrsRtmpJitter() *SrsRtmpJitter {
 	return &SrsRtmpJitter{
 		lastPktCorrectTime:-1,
 		lastPktTime:0,
+		lastRawTime:-1,
+	}
+}
+
+/**
+* convert the time_jitter config to algorithm.
+*/
+func SrsTimeJitterString2Int(time_jitter string) SrsRtmpJitterAlgorithm {
+	switch time_jitter {
+	case config.SRS_CONF_TIME_JITTER_ZERO:
+		return SrsRtmpJitterAlgorithmZERO
+	case config.SRS_CONF_TIME_JITTER_OFF:
+		return SrsRtmpJitterAlgorithmOFF
+	default:
+		return SrsRtmpJitterAlgorithmFULL
 	}
 }
 
 func (this *SrsRtmpJitter) Correct(msg *rtmp.SrsRtmpMessage, ag SrsRtmpJitterAlgorithm) error {
+	// the timestamp of metadata and other messages is zero for full.
+	if ag == SrsRtmpJitterAlgorithmFULL && !msg.GetHeader().IsAV() {
+		msg.GetHeader().SetTimestamp(0)
+		return nil
+	}
+
+	msg.GetHeader().SetTimestamp(this.CorrectTimestamp(msg.GetHeader().GetTimestamp(), ag))
+	return nil
+}
+
+/**
+* correct the timestamp of audio or video, without modify the message,
+* for the consumer which shares the message with others.
+*/
+func (this *SrsRtmpJitter) CorrectTimestamp(timestamp int64, ag SrsRtmpJitterAlgorithm) int64 {
+	timestamp = this.unwrap(timestamp)
+
 	if ag != SrsRtmpJitterAlgorithmFULL {
-		if ag == SrsRtmpJitterAlgorithmOFF {
-			return nil
+		if ag == SrsRtmpJitterAlgorithmOFF && this.base <= 0 {
+			return timestamp
 		}
-		// start at zero, but donot ensure monotonically increasing.
-		if ag == SrsRtmpJitterAlgorithmZERO {
+		// start at zero, or continue from base for off, but donot ensure monotonically increasing.
+		if ag == SrsRtmpJitterAlgorithmZERO || ag == SrsRtmpJitterAlgorithmOFF {
 			if this.lastPktCorrectTime == -1 {
-				this.lastPktCorrectTime = msg.GetHeader().GetTimestamp()
+				this.lastPktCorrectTime = timestamp
 			}
-			msg.GetHeader().SetTimestamp(msg.GetHeader().GetTimestamp() - this.lastPktCorrectTime)
-			return nil
+			return this.base + timestamp - this.lastPktCorrectTime
 		}
-		return nil
-	}
-
-	if msg.GetHeader().IsAV() {
-		msg.GetHeader().SetTimestamp(0)
-		return nil
+		return timestamp
 	}
 
 	/**
@@ -60,7 +95,10 @@ func (this *SrsRtmpJitter) Correct(msg *rtmp.SrsRtmpMessage, ag SrsRtmpJitterAlg
 	*     and enforce the time monotonically.
 	*/
 
-	timestamp := msg.GetHeader().GetTimestamp()
+	if this.base > 0 && this.lastPktCorrectTime < this.base {
+		this.lastPktCorrectTime = this.base
+	}
+
 	delta := timestamp - this.lastPktTime
 	if delta < CONST_MAX_JITTER_MS_NEG || delta > CONST_MAX_JITTER_MS {
 		delta = DEFAULT_FRAME_TIME_MS
@@ -68,10 +106,46 @@ func (this *SrsRtmpJitter) Correct(msg *rtmp.SrsRtmpMessage, ag SrsRtmpJitterAlg
 
 	if this.lastPktCorrectTime + delta > 0 {
 		this.lastPktCorrectTime = this.lastPktCorrectTime + delta
+	} else {
+		this.lastPktCorrectTime = 0
 	}
-	msg.GetHeader().SetTimestamp(this.lastPktCorrectTime)
 	this.lastPktTime = timestamp
-	return nil
+	return this.lastPktCorrectTime
+}
+
+/**
+* continue the corrected timestamp from base, for example, the last timestamp
+* of the flv to append, the off algorithm keeps the delta of original timestamp.
+*/
+func (this *SrsRtmpJitter) Continue(base int64) {
+	this.base = base
+}
+
+/**
+* unwrap the 32bits timestamp of rtmp to 64bits, and update the delta.
+*/
+func (this *SrsRtmpJitter) unwrap(timestamp int64) int64 {
+	if this.lastRawTime >= 0 {
+		diff := timestamp - this.lastRawTime
+		if diff < -SRS_RTMP_TIMESTAMP_ROLLOVER / 2 {
+			this.rollover += SRS_RTMP_TIMESTAMP_ROLLOVER
+		} else if diff > SRS_RTMP_TIMESTAMP_ROLLOVER / 2 && this.rollover > 0 {
+			// the late packet before rollover.
+			this.rollover -= SRS_RTMP_TIMESTAMP_ROLLOVER
+		}
+		this.delta = timestamp + this.rollover - this.lastTime
+	}
+	this.lastRawTime = timestamp
+	this.lastTime = timestamp + this.rollover
+	return this.lastTime
+}
+
+/**
+* the delta of original timestamp of the last corrected packet, after rollover,
+* used to detect the timestamp jump of encoder.
+*/
+func (this *SrsRtmpJitter) Delta() int64 {
+	return this.delta
 }
 
 func (this *SrsRtmpJitter) GetTime() int64 {
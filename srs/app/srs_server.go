@@ -68,6 +68,10 @@ func (this *SrsServer) AddConn(c *SrsRtmpConn) {
 }
 
 func (this *SrsServer) StartProcess(port uint32) error {
+	// before accept any stream, all tmp files of dvr are orphaned.
+	SrsDvrRecover()
+	SrsDvrJanitorStart()
+
 	ln, err := net.Listen("tcp", ":"+strconv.Itoa(int(port)))
 	if err != nil {
 		return err
@@ -75,7 +79,9 @@ func (this *SrsServer) StartProcess(port uint32) error {
 
 	go func() {
 		http.Handle("/", this.flvServer)
-		http.Handle("/hls/", http.StripPrefix("/hls/", http.FileServer(http.Dir("./html"))))
+		http.Handle("/api/v1/dvr", NewSrsDvrApiServer())
+		http.Handle("/api/v1/vhosts", NewSrsStatisticApiServer())
+		http.Handle("/hls/", http.StripPrefix("/hls/", NewSrsHlsLiveServer(http.FileServer(http.Dir("./html")))))
 		http.ListenAndServe(":8080", nil)
 	}()
 
@@ -1 +1,151 @@
-package app
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 GOSRS(gosrs)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/**
+* the dvr usage of vhost, updated by the janitor.
+*/
+type SrsStatisticDvr struct {
+	Files			int		`json:"files"`
+	Bytes			int64	`json:"bytes"`
+	MaxAge			int64	`json:"max_age"` // in seconds
+	MaxBytes		int64	`json:"max_bytes"`
+	DeletedFiles	int64	`json:"deleted_files"` // total deleted since started.
+	DeletedBytes	int64	`json:"deleted_bytes"`
+	UpdateTime		int64	`json:"update_time"` // in ms
+}
+
+type SrsStatisticVhost struct {
+	Name	string				`json:"name"`
+	Dvr		*SrsStatisticDvr	`json:"dvr,omitempty"`
+}
+
+/**
+* the statistic of server, exposed by http api.
+*/
+type SrsStatistic struct {
+	vhosts	map[string]*SrsStatisticVhost
+	mtx		sync.Mutex
+}
+
+var statistic *SrsStatistic = &SrsStatistic{vhosts:make(map[string]*SrsStatisticVhost)}
+
+func GetSrsStatistic() *SrsStatistic {
+	return statistic
+}
+
+func (this *SrsStatistic) findVhost(vhost string) *SrsStatisticVhost {
+	v, ok := this.vhosts[vhost]
+	if !ok {
+		v = &SrsStatisticVhost{Name:vhost}
+		this.vhosts[vhost] = v
+	}
+	return v
+}
+
+/**
+* update the dvr usage of vhost,
+* @param deleted the files deleted this time, accumulated to the total.
+*/
+func (this *SrsStatistic) OnDvrUsage(vhost string, files int, bytes int64, deleted int, deletedBytes int64) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	v := this.findVhost(vhost)
+	if v.Dvr == nil {
+		v.Dvr = &SrsStatisticDvr{}
+	}
+	v.Dvr.Files, v.Dvr.Bytes = files, bytes
+	v.Dvr.DeletedFiles += int64(deleted)
+	v.Dvr.DeletedBytes += deletedBytes
+	v.Dvr.UpdateTime = time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+/**
+* set the dvr quota of vhost, when the janitor started.
+*/
+func (this *SrsStatistic) OnDvrQuota(vhost string, maxAge time.Duration, maxBytes int64) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	v := this.findVhost(vhost)
+	if v.Dvr == nil {
+		v.Dvr = &SrsStatisticDvr{}
+	}
+	v.Dvr.MaxAge, v.Dvr.MaxBytes = int64(maxAge / time.Second), maxBytes
+}
+
+/**
+* dump the vhosts, sorted by name.
+*/
+func (this *SrsStatistic) DumpVhosts() []SrsStatisticVhost {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	vhosts := make([]SrsStatisticVhost, 0, len(this.vhosts))
+	for _, v := range this.vhosts {
+		c := SrsStatisticVhost{Name:v.Name}
+		if v.Dvr != nil {
+			dvr := *v.Dvr
+			c.Dvr = &dvr
+		}
+		vhosts = append(vhosts, c)
+	}
+	sort.Slice(vhosts, func(i, j int) bool {
+		return vhosts[i].Name < vhosts[j].Name
+	})
+	return vhosts
+}
+
+type SrsStatisticApiResponse struct {
+	Code	int					`json:"code"`
+	Vhosts	[]SrsStatisticVhost	`json:"vhosts"`
+}
+
+/**
+* the http api of statistic, GET /api/v1/vhosts
+*/
+type SrsStatisticApiServer struct {
+}
+
+func NewSrsStatisticApiServer() *SrsStatisticApiServer {
+	return &SrsStatisticApiServer{}
+}
+
+func (this *SrsStatisticApiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(&SrsStatisticApiResponse{Code:http.StatusMethodNotAllowed})
+		return
+	}
+	json.NewEncoder(w).Encode(&SrsStatisticApiResponse{Vhosts:GetSrsStatistic().DumpVhosts()})
+}
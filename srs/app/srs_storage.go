@@ -0,0 +1,144 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 GOSRS(gosrs)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package app
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"go_srs/srs/app/config"
+)
+
+/**
+* the file opened by storage to write, the WriteAt and Seek is required by dvr
+* to update the metadata of flv, and ReadAt to rewrite the mp4 to faststart.
+*/
+type SrsStorageFile interface {
+	io.Writer
+	io.WriterAt
+	io.ReaderAt
+	io.Seeker
+	// flush the file to disk, for the fsync policy of dvr.
+	Sync() error
+	// drop the partial data at the end, for dvr to recover or append the flv.
+	Truncate(size int64) error
+	Close() error
+}
+
+/**
+* the storage backend of hls and dvr writers, local disk or object storage.
+* the error of not exists file is checked by os.IsNotExist.
+*/
+type SrsStorage interface {
+	// create or truncate the file to write.
+	Create(file string) (SrsStorageFile, error)
+	// open the exists file to append.
+	Append(file string) (SrsStorageFile, error)
+	// get the size of file.
+	Stat(file string) (int64, error)
+	// read the whole file, for m3u8 to recover.
+	ReadFile(file string) ([]byte, error)
+	// write the whole file atomically, for m3u8 and keys.
+	WriteFile(file string, data []byte) error
+	Rename(from string, to string) error
+	Remove(file string) error
+	// whether the file is visible only when closed, so no temp file to rename is required.
+	Atomic() bool
+}
+
+/**
+* get the storage of vhost, local disk when not configured.
+*/
+func NewSrsStorage(vhost string) SrsStorage {
+	if conf := config.GetStorage(vhost); conf != nil {
+		return NewSrsS3Storage(conf)
+	}
+	return NewSrsLocalStorage()
+}
+
+/**
+* the local disk storage.
+*/
+type SrsLocalStorage struct {
+}
+
+func NewSrsLocalStorage() *SrsLocalStorage {
+	return &SrsLocalStorage{}
+}
+
+func (this *SrsLocalStorage) Create(file string) (SrsStorageFile, error) {
+	if err := os.MkdirAll(path.Dir(file), os.ModePerm); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(file, os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0755)
+}
+
+func (this *SrsLocalStorage) Append(file string) (SrsStorageFile, error) {
+	f, err := os.OpenFile(file, os.O_RDWR, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(0, 2); err != nil {//SEEK_END
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (this *SrsLocalStorage) Stat(file string) (int64, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (this *SrsLocalStorage) ReadFile(file string) ([]byte, error) {
+	return ioutil.ReadFile(file)
+}
+
+func (this *SrsLocalStorage) WriteFile(file string, data []byte) error {
+	if err := os.MkdirAll(path.Dir(file), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp_file := file + ".tmp"
+	if err := ioutil.WriteFile(tmp_file, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp_file, file)
+}
+
+func (this *SrsLocalStorage) Rename(from string, to string) error {
+	return os.Rename(from, to)
+}
+
+func (this *SrsLocalStorage) Remove(file string) error {
+	return os.Remove(file)
+}
+
+func (this *SrsLocalStorage) Atomic() bool {
+	return false
+}
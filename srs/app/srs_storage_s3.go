@@ -0,0 +1,619 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 GOSRS(gosrs)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package app
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"go_srs/srs/app/config"
+)
+
+// the interval to retry the failed request, increased by retries.
+const SRS_S3_RETRY_INTERVAL = 200 * time.Millisecond
+
+// the max size of object to copy by a request, the larger object is copied by parts.
+const SRS_S3_MAX_COPY_SIZE = 5 * 1024 * 1024 * 1024
+// the max number of parts of a multipart upload.
+const SRS_S3_MAX_PARTS = 10000
+
+var s3Client = &http.Client{Timeout: 60 * time.Second}
+// the client to download the large object, no timeout for the body.
+var s3StreamClient = &http.Client{Transport: &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	ResponseHeaderTimeout: 60 * time.Second,
+}}
+
+/**
+* the S3-compatible object storage, for example, AWS S3 or MinIO,
+* the request is signed by AWS Signature Version 4, and the path-style url is used.
+* the file is spooled to a local temp file, and uploaded when closed,
+* by a PUT or by multipart upload for the large file like dvr.
+*/
+type SrsS3Storage struct {
+	conf *config.StorageConf
+}
+
+func NewSrsS3Storage(conf *config.StorageConf) *SrsS3Storage {
+	return &SrsS3Storage{
+		conf: conf,
+	}
+}
+
+/**
+* the object key of file, ./html/live/livestream-1.ts is [prefix]/html/live/livestream-1.ts
+*/
+func (this *SrsS3Storage) object_key(file string) string {
+	key := path.Clean("/" + filepath.ToSlash(file))
+	if prefix := strings.Trim(this.conf.Prefix, "/"); prefix != "" {
+		key = "/" + prefix + key
+	}
+	return key[1:]
+}
+
+/**
+* the file of s3 storage, which is written to the spool file, and uploaded when closed.
+*/
+type SrsS3File struct {
+	*os.File
+	storage *SrsS3Storage
+	key     string
+}
+
+func (this *SrsS3Storage) spool(key string) (*SrsS3File, error) {
+	f, err := ioutil.TempFile("", "srs-s3-")
+	if err != nil {
+		return nil, err
+	}
+	return &SrsS3File{File: f, storage: this, key: key}, nil
+}
+
+func (this *SrsS3File) Close() error {
+	defer os.Remove(this.File.Name())
+	defer this.File.Close()
+
+	size, err := this.File.Seek(0, 2)//SEEK_END
+	if err != nil {
+		return err
+	}
+
+	if size >= this.storage.multipart_size() {
+		return this.storage.upload_multipart(this.key, this.File, size)
+	}
+
+	data := make([]byte, size)
+	if _, err := this.File.ReadAt(data, 0); err != nil && err != io.EOF {
+		return err
+	}
+	return this.storage.put_object(this.key, data)
+}
+
+func (this *SrsS3Storage) Create(file string) (SrsStorageFile, error) {
+	return this.spool(this.object_key(file))
+}
+
+/**
+* download the object to the spool file to append, the object is streamed to
+* the file for the large file like dvr.
+*/
+func (this *SrsS3Storage) Append(file string) (SrsStorageFile, error) {
+	f, err := this.spool(this.object_key(file))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := this.download(f.key, f.File); err != nil {
+		f.File.Close()
+		os.Remove(f.File.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+func (this *SrsS3Storage) Stat(file string) (int64, error) {
+	key := this.object_key(file)
+	res, err := this.request("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	if err := res.check("stat", key); err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(res.header.Get("Content-Length"), 10, 64)
+}
+
+func (this *SrsS3Storage) ReadFile(file string) ([]byte, error) {
+	key := this.object_key(file)
+	res, err := this.request("GET", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := res.check("get", key); err != nil {
+		return nil, err
+	}
+	return res.body, nil
+}
+
+func (this *SrsS3Storage) WriteFile(file string, data []byte) error {
+	return this.put_object(this.object_key(file), data)
+}
+
+/**
+* rename the object by copy and delete, the object larger than 5GB is copied by parts.
+*/
+func (this *SrsS3Storage) Rename(from string, to string) error {
+	src, dst := this.object_key(from), this.object_key(to)
+
+	size, err := this.Stat(from)
+	if err != nil {
+		return err
+	}
+
+	if size > SRS_S3_MAX_COPY_SIZE {
+		err = this.multipart(dst, func(upload_id string) ([]SrsS3Part, error) {
+			return this.copy_parts(src, dst, upload_id, size)
+		})
+	} else {
+		var res *SrsS3Response
+		if res, err = this.request("PUT", dst, nil, this.copy_source(src), nil); err == nil {
+			err = res.check("copy", src)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return this.Remove(from)
+}
+
+func (this *SrsS3Storage) Remove(file string) error {
+	key := this.object_key(file)
+	res, err := this.request("DELETE", key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return res.check("remove", key)
+}
+
+func (this *SrsS3Storage) Atomic() bool {
+	return true
+}
+
+func (this *SrsS3Storage) multipart_size() int64 {
+	return int64(this.conf.MultipartSize) * 1024 * 1024
+}
+
+/**
+* the size of part for the object, enlarged when the parts exceed the max number.
+*/
+func (this *SrsS3Storage) part_size(size int64) int64 {
+	part_size := this.multipart_size()
+	if min := (size + SRS_S3_MAX_PARTS - 1) / SRS_S3_MAX_PARTS; part_size < min {
+		part_size = min
+	}
+	return part_size
+}
+
+func (this *SrsS3Storage) copy_source(key string) http.Header {
+	header := http.Header{}
+	header.Set("x-amz-copy-source", "/" + srs_s3_escape(this.conf.Bucket, false) + "/" + srs_s3_escape(key, false))
+	return header
+}
+
+func (this *SrsS3Storage) put_object(key string, data []byte) error {
+	res, err := this.request("PUT", key, nil, nil, data)
+	if err != nil {
+		return err
+	}
+	return res.check("put", key)
+}
+
+type SrsS3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (this *SrsS3Storage) upload_multipart(key string, f io.ReaderAt, size int64) error {
+	return this.multipart(key, func(upload_id string) ([]SrsS3Part, error) {
+		return this.upload_parts(key, upload_id, f, size)
+	})
+}
+
+/**
+* do the multipart upload, the parts are uploaded or copied by the callback,
+* abort the upload when failed.
+*/
+func (this *SrsS3Storage) multipart(key string, parts func(upload_id string) ([]SrsS3Part, error)) error {
+	res, err := this.request("POST", key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := res.check("multipart", key); err != nil {
+		return err
+	}
+
+	var upload struct {
+		UploadId string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(res.body, &upload); err != nil {
+		return err
+	}
+	if upload.UploadId == "" {
+		return errors.New("s3: no upload id of " + key)
+	}
+
+	if err := this.complete_multipart(key, upload.UploadId, parts); err != nil {
+		if res, aerr := this.request("DELETE", key, url.Values{"uploadId": {upload.UploadId}}, nil, nil); aerr != nil || res.check("abort", key) != nil {
+			fmt.Println("s3: abort multipart failed, key=", key)
+		}
+		return err
+	}
+	return nil
+}
+
+func (this *SrsS3Storage) complete_multipart(key string, upload_id string, parts func(upload_id string) ([]SrsS3Part, error)) error {
+	var complete struct {
+		XMLName xml.Name    `xml:"CompleteMultipartUpload"`
+		Parts   []SrsS3Part `xml:"Part"`
+	}
+
+	var err error
+	if complete.Parts, err = parts(upload_id); err != nil {
+		return err
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+
+	res, err := this.request("POST", key, url.Values{"uploadId": {upload_id}}, nil, body)
+	if err != nil {
+		return err
+	}
+	if err := res.check("complete", key); err != nil {
+		return err
+	}
+	// the complete may response 200 with error.
+	if bytes.Contains(res.body, []byte("<Error>")) {
+		return errors.New("s3: complete multipart failed, key=" + key + ", body=" + string(res.body))
+	}
+	return nil
+}
+
+func (this *SrsS3Storage) upload_parts(key string, upload_id string, f io.ReaderAt, size int64) ([]SrsS3Part, error) {
+	var parts []SrsS3Part
+
+	part_size := this.part_size(size)
+	buf := make([]byte, part_size)
+	for off, number := int64(0), 1; off < size; off, number = off+part_size, number+1 {
+		n, err := f.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {upload_id}}
+		res, err := this.request("PUT", key, query, nil, buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		if err := res.check("part", key); err != nil {
+			return nil, err
+		}
+		parts = append(parts, SrsS3Part{PartNumber: number, ETag: res.header.Get("ETag")})
+	}
+	return parts, nil
+}
+
+/**
+* copy the object by parts, for the object larger than 5GB.
+* @see https://docs.aws.amazon.com/AmazonS3/latest/API/API_UploadPartCopy.html
+*/
+func (this *SrsS3Storage) copy_parts(src string, key string, upload_id string, size int64) ([]SrsS3Part, error) {
+	var parts []SrsS3Part
+
+	part_size := this.part_size(size)
+	if part_size > SRS_S3_MAX_COPY_SIZE {
+		part_size = SRS_S3_MAX_COPY_SIZE
+	}
+	for off, number := int64(0), 1; off < size; off, number = off+part_size, number+1 {
+		end := off + part_size
+		if end > size {
+			end = size
+		}
+
+		header := this.copy_source(src)
+		header.Set("x-amz-copy-source-range", "bytes=" + strconv.FormatInt(off, 10) + "-" + strconv.FormatInt(end - 1, 10))
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {upload_id}}
+		res, err := this.request("PUT", key, query, header, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := res.check("part copy", src); err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			ETag string `xml:"ETag"`
+		}
+		if err := xml.Unmarshal(res.body, &result); err != nil {
+			return nil, err
+		}
+		parts = append(parts, SrsS3Part{PartNumber: number, ETag: result.ETag})
+	}
+	return parts, nil
+}
+
+type SrsS3Response struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+/**
+* check the status of response, the 404 is the error of os.ErrNotExist.
+*/
+func (this *SrsS3Response) check(op string, key string) error {
+	if this.status >= 200 && this.status < 300 {
+		return nil
+	}
+
+	if this.status == http.StatusNotFound {
+		return &os.PathError{Op: op, Path: key, Err: os.ErrNotExist}
+	}
+	return fmt.Errorf("s3: %s %s failed, status=%d, body=%s", op, key, this.status, string(this.body))
+}
+
+/**
+* send the request to s3, retry when network error or server error.
+*/
+func (this *SrsS3Storage) request(method string, key string, query url.Values, header http.Header, body []byte) (*SrsS3Response, error) {
+	var err error
+	for i := 0; i <= this.conf.Retries; i++ {
+		if i > 0 {
+			fmt.Println("s3: retry", method, key, "retry=", i, "err=", err)
+			time.Sleep(time.Duration(i) * SRS_S3_RETRY_INTERVAL)
+		}
+
+		var res *SrsS3Response
+		if res, err = this.do_request(method, key, query, header, body); err != nil {
+			continue
+		}
+
+		if res.status >= 500 || res.status == http.StatusTooManyRequests {
+			err = fmt.Errorf("s3: %s %s failed, status=%d", method, key, res.status)
+			continue
+		}
+		return res, nil
+	}
+	return nil, err
+}
+
+func (this *SrsS3Storage) do_request(method string, key string, query url.Values, header http.Header, body []byte) (*SrsS3Response, error) {
+	req, err := this.new_request(method, key, query, header, body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s3Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &SrsS3Response{status: resp.StatusCode, header: resp.Header, body: data}, nil
+}
+
+func (this *SrsS3Storage) new_request(method string, key string, query url.Values, header http.Header, body []byte) (*http.Request, error) {
+	canonical_uri := "/" + srs_s3_escape(this.conf.Bucket, false) + "/" + srs_s3_escape(key, false)
+	canonical_query := srs_s3_canonical_query(query)
+
+	u := strings.TrimSuffix(this.conf.Endpoint, "/") + canonical_uri
+	if canonical_query != "" {
+		u += "?" + canonical_query
+	}
+
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	this.sign(req, canonical_uri, canonical_query, body)
+	return req, nil
+}
+
+/**
+* download the object to file, the body is streamed to file without buffered
+* in memory, retry the same as request.
+*/
+func (this *SrsS3Storage) download(key string, f *os.File) error {
+	var err error
+	for i := 0; i <= this.conf.Retries; i++ {
+		if i > 0 {
+			fmt.Println("s3: retry GET", key, "retry=", i, "err=", err)
+			time.Sleep(time.Duration(i) * SRS_S3_RETRY_INTERVAL)
+		}
+
+		// drop the partial body of previous try.
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, 0); err != nil {//SEEK_SET
+			return err
+		}
+
+		var retry bool
+		if retry, err = this.do_download(key, f); err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+/**
+* download the object once, return whether to retry when failed.
+*/
+func (this *SrsS3Storage) do_download(key string, w io.Writer) (bool, error) {
+	req, err := this.new_request("GET", key, nil, nil, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := s3StreamClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		res := &SrsS3Response{status: resp.StatusCode, header: resp.Header, body: data}
+		return res.status >= 500 || res.status == http.StatusTooManyRequests, res.check("get", key)
+	}
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return true, err
+	}
+	return false, nil
+}
+
+/**
+* sign the request by AWS Signature Version 4, anonymous when no access key.
+* @see https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+*/
+func (this *SrsS3Storage) sign(req *http.Request, canonical_uri string, canonical_query string, body []byte) {
+	now := time.Now().UTC()
+	amz_date := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payload_hash := sha256.Sum256(body)
+	req.Header.Set("x-amz-date", amz_date)
+	req.Header.Set("x-amz-content-sha256", hex.EncodeToString(payload_hash[:]))
+	if this.conf.AccessKey == "" {
+		return
+	}
+
+	// the signed headers, the host and x-amz-* headers.
+	names := []string{"host"}
+	for k := range req.Header {
+		if name := strings.ToLower(k); strings.HasPrefix(name, "x-amz-") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var headers strings.Builder
+	for _, name := range names {
+		value := req.URL.Host
+		if name != "host" {
+			value = strings.TrimSpace(req.Header.Get(name))
+		}
+		headers.WriteString(name + ":" + value + "\n")
+	}
+	signed_headers := strings.Join(names, ";")
+
+	canonical_request := strings.Join([]string{
+		req.Method,
+		canonical_uri,
+		canonical_query,
+		headers.String(),
+		signed_headers,
+		hex.EncodeToString(payload_hash[:]),
+	}, "\n")
+	request_hash := sha256.Sum256([]byte(canonical_request))
+
+	scope := date + "/" + this.conf.Region + "/s3/aws4_request"
+	string_to_sign := "AWS4-HMAC-SHA256\n" + amz_date + "\n" + scope + "\n" + hex.EncodeToString(request_hash[:])
+
+	k := srs_s3_hmac([]byte("AWS4" + this.conf.SecretKey), date)
+	k = srs_s3_hmac(k, this.conf.Region)
+	k = srs_s3_hmac(k, "s3")
+	k = srs_s3_hmac(k, "aws4_request")
+	signature := hex.EncodeToString(srs_s3_hmac(k, string_to_sign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=" + this.conf.AccessKey + "/" + scope +
+		", SignedHeaders=" + signed_headers + ", Signature=" + signature)
+}
+
+func srs_s3_hmac(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+/**
+* the uri encode of AWS, all bytes except the unreserved characters are escaped,
+* @param slash whether escape the slash, which is kept in path.
+*/
+func srs_s3_escape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !slash) {
+			b.WriteByte(c)
+		} else {
+			b.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return b.String()
+}
+
+func srs_s3_canonical_query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	params := make([]string, 0)
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, srs_s3_escape(k, true) + "=" + srs_s3_escape(v, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
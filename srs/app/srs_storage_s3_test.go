@@ -0,0 +1,334 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 GOSRS(gosrs)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package app
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"go_srs/srs/app/config"
+)
+
+/**
+* the fake s3 server in memory, which supports the requests of SrsS3Storage.
+*/
+type fakeS3Server struct {
+	mtx      sync.Mutex
+	objects  map[string][]byte
+	uploads  map[string]map[int][]byte
+	fails    int // the number of requests to response 503.
+	requests map[string]int // the number of requests by method and operation.
+}
+
+func newFakeS3Server() *fakeS3Server {
+	return &fakeS3Server{
+		objects:  make(map[string][]byte),
+		uploads:  make(map[string]map[int][]byte),
+		requests: make(map[string]int),
+	}
+}
+
+func (this *fakeS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	query := r.URL.Query()
+	copy_source := strings.TrimPrefix(r.Header.Get("x-amz-copy-source"), "/bucket/")
+
+	op := r.Method
+	if _, ok := query["uploads"]; ok {
+		op += " uploads"
+	} else if query.Get("partNumber") != "" {
+		op += " part"
+	} else if query.Get("uploadId") != "" {
+		op += " complete"
+	}
+	if copy_source != "" {
+		op += " copy"
+	}
+	this.requests[op]++
+
+	if this.fails > 0 {
+		this.fails--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	switch op {
+	case "PUT":
+		this.objects[key] = body
+		w.Header().Set("ETag", "\"" + strconv.Itoa(len(body)) + "\"")
+	case "PUT copy":
+		src, ok := this.objects[copy_source]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		this.objects[key] = append([]byte{}, src...)
+		w.Write([]byte("<CopyObjectResult><ETag>\"0\"</ETag></CopyObjectResult>"))
+	case "POST uploads":
+		id := strconv.Itoa(len(this.uploads) + 1)
+		this.uploads[id] = make(map[int][]byte)
+		w.Write([]byte("<InitiateMultipartUploadResult><UploadId>" + id + "</UploadId></InitiateMultipartUploadResult>"))
+	case "PUT part", "PUT part copy":
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		parts, ok := this.uploads[query.Get("uploadId")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		etag := "\"" + strconv.Itoa(number) + "\""
+		if copy_source == "" {
+			parts[number] = body
+			w.Header().Set("ETag", etag)
+			return
+		}
+
+		var start, end int
+		r := strings.TrimPrefix(r.Header.Get("x-amz-copy-source-range"), "bytes=")
+		if i := strings.Index(r, "-"); i > 0 {
+			start, _ = strconv.Atoi(r[:i])
+			end, _ = strconv.Atoi(r[i+1:])
+		}
+		parts[number] = append([]byte{}, this.objects[copy_source][start:end+1]...)
+		w.Write([]byte("<CopyPartResult><ETag>" + etag + "</ETag></CopyPartResult>"))
+	case "POST complete":
+		parts, ok := this.uploads[query.Get("uploadId")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var complete struct {
+			Parts []SrsS3Part `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var data []byte
+		for i, p := range complete.Parts {
+			if p.PartNumber != i + 1 || p.ETag != "\"" + strconv.Itoa(p.PartNumber) + "\"" {
+				w.Write([]byte("<Error><Code>InvalidPart</Code></Error>"))
+				return
+			}
+			data = append(data, parts[p.PartNumber]...)
+		}
+		this.objects[key] = data
+		delete(this.uploads, query.Get("uploadId"))
+	case "DELETE complete":
+		delete(this.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case "GET", "HEAD":
+		data, ok := this.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+	case "DELETE":
+		delete(this.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func newTestS3Storage(t *testing.T, retries int, multipart_size int) (*SrsS3Storage, *fakeS3Server) {
+	s := newFakeS3Server()
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	storage := NewSrsS3Storage(&config.StorageConf{
+		Type:          "s3",
+		Endpoint:      ts.URL,
+		Bucket:        "bucket",
+		Region:        "us-east-1",
+		AccessKey:     "access",
+		SecretKey:     "secret",
+		Retries:       retries,
+		MultipartSize: multipart_size,
+	})
+	return storage, s
+}
+
+func testS3Data(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func TestS3StoragePutRetry(t *testing.T) {
+	storage, s := newTestS3Storage(t, 3, 8)
+
+	s.fails = 2
+	if err := storage.WriteFile("./html/live/livestream.m3u8", []byte("#EXTM3U\n")); err != nil {
+		t.Fatal("put with retries failed, err=", err)
+	}
+	if n := s.requests["PUT"]; n != 3 {
+		t.Error("expect 3 puts, actual", n)
+	}
+	if data := s.objects["html/live/livestream.m3u8"]; string(data) != "#EXTM3U\n" {
+		t.Error("invalid object", string(data))
+	}
+
+	// give up when the retries is exhausted.
+	s.fails = 4
+	if err := storage.WriteFile("./html/live/livestream.m3u8", []byte("#EXTM3U\n")); err == nil {
+		t.Error("expect error when retries exhausted")
+	}
+}
+
+func TestS3StorageMultipart(t *testing.T) {
+	storage, s := newTestS3Storage(t, 0, 1)
+
+	data := testS3Data(2 * 1024 * 1024 + 512 * 1024)
+	f, err := storage.Create("./objs/dvr/livestream.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal("multipart upload failed, err=", err)
+	}
+
+	if n := s.requests["PUT part"]; n != 3 {
+		t.Error("expect 3 parts, actual", n)
+	}
+	if n := s.requests["PUT"]; n != 0 {
+		t.Error("expect no single put, actual", n)
+	}
+	if !bytes.Equal(s.objects["objs/dvr/livestream.flv"], data) {
+		t.Error("invalid object of multipart upload")
+	}
+
+	// the object under the multipart size is a single put.
+	f, err = storage.Create("./objs/dvr/small.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(data[:1024])
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.requests["PUT"]; n != 1 {
+		t.Error("expect a single put, actual", n)
+	}
+}
+
+func TestS3StorageAppend(t *testing.T) {
+	storage, s := newTestS3Storage(t, 1, 8)
+
+	s.objects["objs/dvr/livestream.flv"] = []byte("hello")
+	s.fails = 1
+	f, err := storage.Append("./objs/dvr/livestream.flv")
+	if err != nil {
+		t.Fatal("append failed, err=", err)
+	}
+	f.Write([]byte(" world"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data := string(s.objects["objs/dvr/livestream.flv"]); data != "hello world" {
+		t.Error("invalid appended object", data)
+	}
+
+	if _, err := storage.Append("./objs/dvr/none.flv"); !os.IsNotExist(err) {
+		t.Error("expect not exists, err=", err)
+	}
+}
+
+func TestS3StorageRename(t *testing.T) {
+	storage, s := newTestS3Storage(t, 0, 1)
+
+	s.objects["objs/dvr/livestream.flv.tmp"] = []byte("flv")
+	if err := storage.Rename("./objs/dvr/livestream.flv.tmp", "./objs/dvr/livestream.flv"); err != nil {
+		t.Fatal("rename failed, err=", err)
+	}
+	if data := string(s.objects["objs/dvr/livestream.flv"]); data != "flv" {
+		t.Error("invalid renamed object", data)
+	}
+	if _, err := storage.Stat("./objs/dvr/livestream.flv.tmp"); !os.IsNotExist(err) {
+		t.Error("expect source removed, err=", err)
+	}
+
+	if err := storage.Rename("./objs/dvr/none.flv.tmp", "./objs/dvr/none.flv"); !os.IsNotExist(err) {
+		t.Error("expect not exists, err=", err)
+	}
+}
+
+func TestS3StorageCopyParts(t *testing.T) {
+	storage, s := newTestS3Storage(t, 0, 1)
+
+	// the object larger than 5GB is copied by parts, the same as the small one.
+	data := testS3Data(2 * 1024 * 1024 + 100)
+	s.objects["objs/dvr/livestream.flv.tmp"] = data
+	err := storage.multipart("objs/dvr/livestream.flv", func(upload_id string) ([]SrsS3Part, error) {
+		return storage.copy_parts("objs/dvr/livestream.flv.tmp", "objs/dvr/livestream.flv", upload_id, int64(len(data)))
+	})
+	if err != nil {
+		t.Fatal("copy parts failed, err=", err)
+	}
+	if n := s.requests["PUT part copy"]; n != 3 {
+		t.Error("expect 3 part copies, actual", n)
+	}
+	if !bytes.Equal(s.objects["objs/dvr/livestream.flv"], data) {
+		t.Error("invalid object of copy parts")
+	}
+
+	if size := storage.part_size(100 * 1024 * 1024 * 1024); size * SRS_S3_MAX_PARTS < 100 * 1024 * 1024 * 1024 {
+		t.Error("too many parts, part size", size)
+	}
+}
+
+func TestS3StorageRemove(t *testing.T) {
+	storage, s := newTestS3Storage(t, 0, 8)
+
+	s.objects["html/live/livestream-0.ts"] = []byte("ts")
+	if err := storage.Remove("./html/live/livestream-0.ts"); err != nil {
+		t.Fatal("remove failed, err=", err)
+	}
+	if _, ok := s.objects["html/live/livestream-0.ts"]; ok {
+		t.Error("object not removed")
+	}
+
+	// remove the not exists object is ok, the same as s3.
+	if err := storage.Remove("./html/live/livestream-0.ts"); err != nil {
+		t.Error("remove not exists failed, err=", err)
+	}
+}
@@ -40,17 +40,23 @@ func (this *SrsTsCache) cache_audio(c *SrsAvcAacCodec, dts int64, sample *SrsCod
 	if this.audio == nil {
 		this.audio = NewSrsTsMessage()
 		this.audio.writePcr = false
-		this.audio.dts = dts
-		this.audio.pts = dts
 		this.audio.startPts = dts
 	}
 
+	// the audio is flushed for each frame, so always use the dts of current frame.
+	this.audio.dts = dts
+	this.audio.pts = dts
+
 	this.audio.sid = SrsTsPESStreamIdAudioCommon //used in ts stream_id field
 	acodec := codec.SrsCodecAudio(c.audioCodecId)
 	if acodec == codec.SrsCodecAudioAAC {
 		if err := this.do_cache_aac(c, sample); err != nil {
 			return err
 		}
+	} else if acodec == codec.SrsCodecAudioMP3 {
+		if err := this.do_cache_mp3(c, sample); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -58,14 +64,12 @@ func (this *SrsTsCache) cache_audio(c *SrsAvcAacCodec, dts int64, sample *SrsCod
 func (this *SrsTsCache) cache_video(c *SrsAvcAacCodec, dts int64, sample *SrsCodecSample) error {
 	if this.video == nil {
 		this.video = NewSrsTsMessage()
-		if sample.FrameType == codec.SrsCodecVideoAVCFrameKeyFrame {
-			this.video.writePcr = true
-		} else {
-			this.video.writePcr = false
-		}
 		this.video.startPts = dts
 	}
 
+	// write pcr for each keyframe, which is also the hint of independent part for LL-HLS.
+	this.video.writePcr = sample.FrameType == codec.SrsCodecVideoAVCFrameKeyFrame
+
 	this.video.dts = dts
 	this.video.pts = this.video.dts + int64(sample.Cts)*90
 	this.video.sid = SrsTsPESStreamIdVideoCommon //this is the hint to judge the SrsTsMessage is audio or video
@@ -189,11 +193,11 @@ func (this *SrsTsCache) do_cache_aac(c *SrsAvcAacCodec, sample *SrsCodecSample)
 
 func (this *SrsTsCache) do_cache_mp3(c *SrsAvcAacCodec, sample *SrsCodecSample) error {
 	// for mp3, directly write to cache.
-	// TODO: FIXME: implements the ts jitter.
 	p := make([]byte, 0)
 	for i := 0; i < len(sample.SampleUnits); i++ {
 		p = append(p, sample.SampleUnits[i]...)
 	}
 
+	this.audio.payload = p
 	return nil
 }
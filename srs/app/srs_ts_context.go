@@ -37,6 +37,9 @@ type SrsTsContext struct {
 	vcodec     codec.SrsCodecVideo
 	acodec     codec.SrsCodecAudio
 	writer     io.Writer
+	// the stream type of mp3 detected from frame header, MPEG-1 or MPEG-2 audio,
+	// kept for the next segments of hls.
+	mp3_stream SrsTsStream
 }
 
 func NewSrsTsContext() *SrsTsContext {
@@ -60,6 +63,20 @@ func (this *SrsTsContext) Get(pid int) *SrsTsChannel {
 	return nil
 }
 
+/**
+* continue the continuity counter of pid from the last packet,
+* for the ts to append, so the next packet of pid is continuous.
+*/
+func (this *SrsTsContext) Continue(pid int, cc uint8) {
+	c, ok := this.pids[pid]
+	if !ok {
+		c = NewSrsTsChannel()
+		c.pid = pid
+		this.pids[pid] = c
+	}
+	c.continuityCounter = (cc + 1) & 0x0f
+}
+
 func (this *SrsTsContext) Set(pid int, applyPid SrsTsPidApply, stream SrsTsStream) {
 	c, ok := this.pids[pid]
 	if ok {
@@ -56,6 +56,15 @@ func NewSrsTsEncoder(w io.Writer) *SrsTsEncoder {
 	}
 }
 
+/**
+* continue the continuity counters of pids, for the ts to append.
+*/
+func (this *SrsTsEncoder) Continue(counters map[int]uint8) {
+	for pid, cc := range counters {
+		this.context.Continue(pid, cc)
+	}
+}
+
 func (this *SrsTsEncoder) WriteHeader() error {
 	return nil
 }
@@ -63,10 +72,7 @@ func (this *SrsTsEncoder) WriteHeader() error {
 func (this *SrsTsEncoder) WriteAudio(timestamp uint32, data []byte) (uint32, error) {
 	this.sample.Clear()
 	if err := this.codec.audio_aac_demux(data, this.sample); err != nil {
-		//if err := this.codec.audio_mp3_demux(data, this.sample); err != nil {
-		//	return 0, err
-		//}
-		fmt.Println("demux aac error", err)
+		fmt.Println("demux audio error", err)
 		return 0, err
 	}
 
@@ -81,7 +87,7 @@ func (this *SrsTsEncoder) WriteAudio(timestamp uint32, data []byte) (uint32, err
 		return 0, nil	//ignore aac sequence header
 	}
 
-	dts := int64(timestamp * 90)
+	dts := int64(timestamp) * 90
 	if err := this.tsCache.cache_audio(this.codec, dts, this.sample); err != nil {
 		return 0, err
 	}
@@ -112,7 +118,7 @@ func (this *SrsTsEncoder) WriteVideo(timestamp uint32, data []byte) (uint32, err
 		return 0, nil
 	}
 
-	dts := int64(timestamp * 90)
+	dts := int64(timestamp) * 90
 	if err := this.tsCache.cache_video(this.codec, dts, this.sample); err != nil {
 		return 0, nil
 	}
@@ -66,6 +66,9 @@ func (this *SrsTsMuxer) convertACodecToTsStream(ac codec.SrsCodecAudio) {
 		this.audioPid = TS_AUDIO_AAC_PID
 	case codec.SrsCodecAudioMP3:
 		astream = SrsTsStreamAudioMp3
+		if this.context.mp3_stream != SrsTsStreamReserved {
+			astream = this.context.mp3_stream
+		}
 		this.audioPid = TS_AUDIO_MP3_PID
 	default:
 		astream = SrsTsStreamReserved
@@ -110,6 +113,13 @@ func (this *SrsTsMuxer) WriteVideo(video *SrsTsMessage) error {
 	return nil
 }
 
+/**
+* the ts packets are written when encoded, nothing to flush.
+*/
+func (this *SrsTsMuxer) Flush() error {
+	return nil
+}
+
 func (this *SrsTsMuxer) UpdateACodec(ac codec.SrsCodecAudio) error {
 	this.convertACodecToTsStream(ac)
 	return nil
@@ -120,6 +130,10 @@ func (this *SrsTsMuxer) Encode(msg *SrsTsMessage) error {
 		return errors.New("not support as or vs")
 	}
 
+	if msg.IsAudio() && this.is_mp3() {
+		this.update_mp3_stream(msg.payload)
+	}
+
 	if !this.wrotePatPmt {
 		err := this.encodePatPmt()
 		if err != nil {
@@ -141,8 +155,34 @@ func (this *SrsTsMuxer) Encode(msg *SrsTsMessage) error {
 	return nil
 }
 
+func (this *SrsTsMuxer) is_mp3() bool {
+	return this.as == SrsTsStreamAudioMpeg1 || this.as == SrsTsStreamAudioMp3
+}
+
+/**
+* select the stream type of mp3 by the version of frame header,
+* 0x03 for MPEG-1 audio, and 0x04 for MPEG-2 and MPEG-2.5 audio.
+*/
+func (this *SrsTsMuxer) update_mp3_stream(payload []byte) {
+	version, _, _, ok := srs_mp3_parse_header(payload)
+	if !ok {
+		return
+	}
+
+	astream := SrsTsStream(SrsTsStreamAudioMp3)
+	if version == SRS_MP3_VERSION_MPEG1 {
+		astream = SrsTsStreamAudioMpeg1
+	}
+	this.context.mp3_stream = astream
+
+	if astream != this.as {
+		this.as = astream
+		this.wrotePatPmt = false 	//rewrite pat pmt
+	}
+}
+
 func (this *SrsTsMuxer) encodePatPmt() error {
-	if this.vs != SrsTsStreamVideoH264 && this.as != SrsTsStreamAudioAAC && this.as != SrsTsStreamAudioMp3 {
+	if this.vs != SrsTsStreamVideoH264 && this.as != SrsTsStreamAudioAAC && !this.is_mp3() {
 		return errors.New("invalid video stream or audio stream type")
 	}
 
@@ -176,7 +216,7 @@ func (this *SrsTsMuxer) encodePes(msg *SrsTsMessage, pid int16, sid SrsTsStream,
 		return errors.New("msg length must not be zero")
 	}
 
-	if sid != SrsTsStreamVideoH264 && sid != SrsTsStreamAudioMp3 && sid != SrsTsStreamAudioAAC {
+	if sid != SrsTsStreamVideoH264 && sid != SrsTsStreamAudioMpeg1 && sid != SrsTsStreamAudioMp3 && sid != SrsTsStreamAudioAAC {
 		return errors.New("ts: ignore the unknown stream")
 	}
 
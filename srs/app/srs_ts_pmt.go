@@ -186,7 +186,7 @@ func (this *SrsTsPayloadPMT) Encode(stream *utils.SrsStream) {
 		switch this.infoes[i].streamType {
 		case SrsTsStreamVideoH264, SrsTsStreamVideoMpeg4:
 			this.context.Set(int(this.infoes[i].elementaryPID), SrsTsPidApplyVideo, this.infoes[i].streamType)
-		case SrsTsStreamAudioAAC, SrsTsStreamAudioAC3, SrsTsStreamAudioDTS, SrsTsStreamAudioMp3:
+		case SrsTsStreamAudioAAC, SrsTsStreamAudioAC3, SrsTsStreamAudioDTS, SrsTsStreamAudioMpeg1, SrsTsStreamAudioMp3:
 			this.context.Set(int(this.infoes[i].elementaryPID), SrsTsPidApplyAudio, this.infoes[i].streamType)
 		}
 	}
@@ -241,7 +241,7 @@ func CreatePMT(context *SrsTsContext, pmtNumber int16, pmtPid int16, vpid int16,
 	pmt.sectionNumber = 0
 	pmt.lastSectionNumber = 0
 	pmt.programInfoLength = 0
-	if as == SrsTsStreamAudioAAC || as == SrsTsStreamAudioMp3 {
+	if as == SrsTsStreamAudioAAC || as == SrsTsStreamAudioMpeg1 || as == SrsTsStreamAudioMp3 {
 		pmt.PCR_PID = apid
 		pmt.infoes = append(pmt.infoes, NewSrsTsPayloadPMTESInfo(as, apid))
 	}
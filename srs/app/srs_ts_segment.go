@@ -0,0 +1,357 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2013-2015 GOSRS(gosrs)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package app
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"go_srs/srs/app/config"
+	"go_srs/srs/protocol/rtmp"
+)
+
+// the max bytes at the end of ts to scan for the last timestamp, to append.
+const SRS_DVR_TS_SCAN_MAX = 4 * 1024 * 1024
+
+/**
+* the writer of ts segment, count the bytes and keep the first error,
+* for the ts muxer ignores the error of writer.
+*/
+type SrsTsSegmentWriter struct {
+	file	SrsStorageFile
+	size	int64
+	err		error
+}
+
+func (this *SrsTsSegmentWriter) Write(p []byte) (int, error) {
+	if this.err != nil {
+		return 0, this.err
+	}
+
+	n, err := this.file.Write(p)
+	this.size += int64(n)
+	this.err = err
+	return n, err
+}
+
+/**
+* the ts segmenter of dvr, write the stream to ts by the ts encoder of
+* http-ts and hls, continuous for session and append plan, or pieces for segment plan.
+*/
+type SrsTsSegment struct {
+	req				*SrsRequest
+	path			string
+	tmpFile			string
+	storage			SrsStorage
+	file			SrsStorageFile
+	writer			*SrsTsSegmentWriter
+	encoder			*SrsTsEncoder
+	jitter			*SrsRtmpJitter
+	jitterAlgorithm	SrsRtmpJitterAlgorithm
+	startTime		int64
+	previousPktTime	int64
+	duration		int64
+	openTime		time.Time
+	syncer			*SrsDvrSyncer
+	// whether reopen the exists file to append, for the append plan.
+	appendable		bool
+	// the last continuity counter of pids in the exists file to append.
+	counters		map[int]uint8
+}
+
+func NewSrsTsSegment(r *SrsRequest) *SrsTsSegment {
+	return &SrsTsSegment{
+		req:r,
+		storage:NewSrsStorage(r.vhost),
+		syncer:NewSrsDvrSyncer(r.vhost),
+		jitterAlgorithm:SrsTimeJitterString2Int(config.GetDvrTimeJitter(r.vhost)),
+	}
+}
+
+func (this *SrsTsSegment) Open(useTmpFile bool) error {
+	if this.file != nil {
+		return nil
+	}
+
+	if this.appendable {
+		this.path = srs_dvr_generate_append_path(this.req, ".ts")
+	} else {
+		this.path = srs_dvr_generate_path(this.storage, this.req, ".ts")
+	}
+	fmt.Println("dvr: open file=", this.path)
+
+	freshTsFile := true
+	if _, err := this.storage.Stat(this.path); err == nil && this.appendable {
+		freshTsFile = false
+	}
+
+	if !freshTsFile || !useTmpFile {
+		this.tmpFile = this.path
+	} else {
+		this.tmpFile = this.path + ".tmp"
+	}
+
+	this.jitter = NewSrsRtmpJitter()
+	this.startTime, this.previousPktTime, this.duration = -1, -1, 0
+	this.counters = nil
+	this.openTime = time.Now()
+
+	var err error
+	if !freshTsFile {
+		if this.file, err = this.storage.Append(this.tmpFile); err != nil {
+			return err
+		}
+		if err = this.reopen(); err != nil {
+			this.file.Close()
+			this.file = nil
+			return err
+		}
+	} else {
+		if this.file, err = this.storage.Create(this.tmpFile); err != nil {
+			return err
+		}
+	}
+	// never deleted by the janitor until closed.
+	srs_dvr_writing_add(this.path)
+
+	// the pat and pmt are written by the new encoder, so each piece is independently playable.
+	this.writer = &SrsTsSegmentWriter{file:this.file}
+	this.encoder = NewSrsTsEncoder(this.writer)
+	this.encoder.Continue(this.counters)
+	return this.encoder.WriteHeader()
+}
+
+/**
+* load the exists ts to append, drop the partial packet at the end,
+* continue the timestamp and continuity counters from the last packets,
+* and count the duration of exists file.
+*/
+func (this *SrsTsSegment) reopen() error {
+	size, err := this.file.Seek(0, 2)//SEEK_END
+	if err != nil {
+		return err
+	}
+
+	end := size - size % SRS_TS_PACKET_SIZE
+	if end < size {
+		fmt.Println("dvr: append truncate file=", this.path, "from", size, "to", end)
+		if err := this.file.Truncate(end); err != nil {
+			return err
+		}
+		if _, err := this.file.Seek(end, 0); err != nil {
+			return err
+		}
+	}
+
+	lastTime := this.scan(end)
+	if lastTime >= 0 {
+		this.jitter.Continue(lastTime)
+		this.previousPktTime = lastTime
+		if firstTime := this.scanFirst(end); firstTime >= 0 && firstTime <= lastTime {
+			this.duration = lastTime - firstTime
+		}
+	}
+	this.counters = this.scanCounters(end)
+	fmt.Println("dvr: append file=", this.path, "size=", end, "last timestamp=", lastTime, "duration=", this.duration)
+	return nil
+}
+
+/**
+* scan the ts packets backward for the last pes with pts,
+* @return the dts of pes in ms, or -1 if not found.
+*/
+func (this *SrsTsSegment) scan(size int64) int64 {
+	pkt := make([]byte, SRS_TS_PACKET_SIZE)
+	for off := size - SRS_TS_PACKET_SIZE; off >= 0 && size - off <= SRS_DVR_TS_SCAN_MAX; off -= SRS_TS_PACKET_SIZE {
+		if _, err := this.file.ReadAt(pkt, off); err != nil {
+			return -1
+		}
+		if dts, err := srs_ts_packet_dts(pkt); err == nil {
+			return dts / 90
+		}
+	}
+	return -1
+}
+
+/**
+* scan the ts packets forward for the first pes with pts,
+* @return the dts of pes in ms, or -1 if not found.
+*/
+func (this *SrsTsSegment) scanFirst(size int64) int64 {
+	pkt := make([]byte, SRS_TS_PACKET_SIZE)
+	for off := int64(0); off + SRS_TS_PACKET_SIZE <= size && off < SRS_DVR_TS_SCAN_MAX; off += SRS_TS_PACKET_SIZE {
+		if _, err := this.file.ReadAt(pkt, off); err != nil {
+			return -1
+		}
+		if dts, err := srs_ts_packet_dts(pkt); err == nil {
+			return dts / 90
+		}
+	}
+	return -1
+}
+
+/**
+* scan the ts packets backward for the last continuity counter of each pid,
+* ignore the packets without payload, whose counter is not incremented.
+*/
+func (this *SrsTsSegment) scanCounters(size int64) map[int]uint8 {
+	counters := make(map[int]uint8)
+	pkt := make([]byte, SRS_TS_PACKET_SIZE)
+	for off := size - SRS_TS_PACKET_SIZE; off >= 0 && size - off <= SRS_DVR_TS_SCAN_MAX; off -= SRS_TS_PACKET_SIZE {
+		if _, err := this.file.ReadAt(pkt, off); err != nil {
+			break
+		}
+		if pkt[0] != 0x47 || (pkt[3] >> 4) & 0x01 == 0 {
+			continue
+		}
+		pid := int(pkt[1] & 0x1f) << 8 | int(pkt[2])
+		if _, ok := counters[pid]; !ok {
+			counters[pid] = pkt[3] & 0x0f
+		}
+	}
+	return counters
+}
+
+/**
+* parse the dts of pes in ts packet, the pts if no dts.
+*/
+func srs_ts_packet_dts(pkt []byte) (int64, error) {
+	// sync byte and payload_unit_start_indicator.
+	if pkt[0] != 0x47 || pkt[1] & 0x40 == 0 {
+		return 0, errors.New("not pes start")
+	}
+
+	p := pkt[4:]
+	// adaptation_field_control, with adaptation field.
+	if afc := (pkt[3] >> 4) & 0x03; afc == 0x02 || afc == 0x03 {
+		if len(p) < 1 || int(p[0]) + 1 > len(p) {
+			return 0, errors.New("invalid adaptation field")
+		}
+		p = p[int(p[0]) + 1:]
+	}
+
+	// packet_start_code_prefix, stream_id, PES_packet_length, flags and PES_header_data_length.
+	if len(p) < 9 + 5 || p[0] != 0 || p[1] != 0 || p[2] != 1 {
+		return 0, errors.New("not pes")
+	}
+	flags := p[7] >> 6
+	if flags & 0x02 == 0 {
+		return 0, errors.New("no pts")
+	}
+
+	v := p[9:14]
+	if flags == 0x03 && len(p) >= 9 + 10 {
+		v = p[14:19]
+	}
+	ts := int64(v[0] >> 1 & 0x07) << 30 | int64(v[1]) << 22 | int64(v[2] >> 1) << 15 | int64(v[3]) << 7 | int64(v[4] >> 1)
+	return ts, nil
+}
+
+func (this *SrsTsSegment) Close() error {
+	if this.file == nil {
+		return nil
+	}
+	defer srs_dvr_writing_remove(this.path)
+
+	var err error
+	if err = this.syncer.on_close(this.file); err != nil {
+		return err
+	}
+
+	size, err := this.file.Seek(0, 2)//SEEK_END
+	if err != nil {
+		return err
+	}
+
+	if err = this.file.Close(); err != nil {
+		return err
+	}
+	this.file = nil
+
+	if this.tmpFile != this.path {
+		if err = this.storage.Rename(this.tmpFile, this.path); err != nil {
+			return err
+		}
+	}
+
+	srs_dvr_on_dvr(this.req, this.path, this.duration, size, this.openTime)
+	return nil
+}
+
+/**
+* the metadata is not written to ts.
+*/
+func (this *SrsTsSegment) WriteMetaData(msg *rtmp.SrsRtmpMessage) error {
+	return nil
+}
+
+func (this *SrsTsSegment) WriteVideo(msg *rtmp.SrsRtmpMessage) error {
+	if this.file == nil {
+		return errors.New("dvr: ts file is not opened")
+	}
+
+	timestamp := this.jitter.CorrectTimestamp(msg.GetHeader().GetTimestamp(), this.jitterAlgorithm)
+	this.encoder.WriteVideo(uint32(timestamp), msg.GetPayload())
+	if this.writer.err != nil {
+		return this.writer.err
+	}
+	this.onUpdateDuration(timestamp)
+	return this.syncer.on_write(this.file)
+}
+
+func (this *SrsTsSegment) WriteAudio(msg *rtmp.SrsRtmpMessage) error {
+	if this.file == nil {
+		return errors.New("dvr: ts file is not opened")
+	}
+
+	timestamp := this.jitter.CorrectTimestamp(msg.GetHeader().GetTimestamp(), this.jitterAlgorithm)
+	this.encoder.WriteAudio(uint32(timestamp), msg.GetPayload())
+	if this.writer.err != nil {
+		return this.writer.err
+	}
+	this.onUpdateDuration(timestamp)
+	return this.syncer.on_write(this.file)
+}
+
+/**
+* update the duration by the corrected timestamp of message.
+*/
+func (this *SrsTsSegment) onUpdateDuration(timestamp int64) {
+	if this.startTime < 0 {
+		this.startTime = timestamp
+	}
+
+	if this.previousPktTime < 0 || this.previousPktTime > timestamp {
+		this.previousPktTime = timestamp
+	}
+	this.duration += timestamp - this.previousPktTime
+	this.previousPktTime = timestamp
+}
+
+func (this *SrsTsSegment) IsOverflow(maxDuration int64) bool {
+	return this.duration > maxDuration
+}
+
+func (this *SrsTsSegment) Path() string {
+	return this.path
+}
@@ -108,7 +108,7 @@ func VideoIsAcceptable(data []byte) bool {
 const (
 	AudioTagType	=	0x08
 	VideoTagType	= 	0x09
-	MetaDataTagType	= 	0x18
+	MetaDataTagType	= 	0x12
 )
 
 const (
@@ -49,6 +49,8 @@ func GenerateSrsAmf0Any(marker byte) SrsAmf0Any {
 		return &SrsAmf0Undefined{}
 	case RTMP_AMF0_EcmaArray:
 		return &SrsAmf0EcmaArray{}
+	case RTMP_AMF0_StrictArray:
+		return &SrsAmf0StrictArray{}
 	default:
 		return nil
 	}
@@ -125,6 +125,16 @@ func (this *SrsAmf0EcmaArray) Decode(stream *utils.SrsStream) error {
 				v = &SrsAmf0Object{}
 				err = v.Decode(stream)
 			}
+		case RTMP_AMF0_EcmaArray:
+			{
+				v = NewSrsAmf0EcmaArray()
+				err = v.Decode(stream)
+			}
+		case RTMP_AMF0_StrictArray:
+			{
+				v = NewSrsAmf0StrictArray()
+				err = v.Decode(stream)
+			}
 		case RTMP_AMF0_Null:
 			{
 				v = &SrsAmf0Null{}
@@ -200,6 +210,16 @@ func (this *SrsAmf0EcmaArray) Set(name string, value interface{}) {
 			Name:  SrsAmf0Utf8{Value: name},
 			Value: &SrsAmf0Number{Value: value.(float64)},
 		}
+	case *SrsAmf0Object:
+		p = &SrsValuePair{
+			Name:  SrsAmf0Utf8{Value: name},
+			Value: value.(*SrsAmf0Object),
+		}
+	case *SrsAmf0StrictArray:
+		p = &SrsValuePair{
+			Name:  SrsAmf0Utf8{Value: name},
+			Value: value.(*SrsAmf0StrictArray),
+		}
 	}
 	this.Properties = append(this.Properties, *p)
 }
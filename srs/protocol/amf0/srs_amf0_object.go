@@ -94,6 +94,16 @@ func (this *SrsAmf0Object) Decode(stream *utils.SrsStream) error {
 				v = &SrsAmf0Object{}
 				err = v.Decode(stream)
 			}
+		case RTMP_AMF0_EcmaArray:
+			{
+				v = NewSrsAmf0EcmaArray()
+				err = v.Decode(stream)
+			}
+		case RTMP_AMF0_StrictArray:
+			{
+				v = NewSrsAmf0StrictArray()
+				err = v.Decode(stream)
+			}
 		case RTMP_AMF0_Null:
 			{
 				v = &SrsAmf0Null{}
@@ -170,6 +180,11 @@ func (this *SrsAmf0Object) Set(name string, value interface{}) {
 			Name:  SrsAmf0Utf8{Value: name},
 			Value: value.(*SrsAmf0EcmaArray),
 		}
+	case *SrsAmf0StrictArray:
+		p = &SrsValuePair{
+			Name:  SrsAmf0Utf8{Value: name},
+			Value: value.(*SrsAmf0StrictArray),
+		}
 	}
 
 	this.Properties = append(this.Properties, *p)
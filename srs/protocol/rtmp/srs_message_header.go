@@ -131,6 +131,10 @@ func (this *SrsMessageHeader) SetLength(len int32) {
 	this.payloadLength = len
 }
 
+func (this *SrsMessageHeader) SetMessageType(t int8) {
+	this.messageType = t
+}
+
 func (this *SrsMessageHeader) IsAV() bool {
 	return this.IsVideo() || this.IsAudio()
 }
@@ -209,6 +209,29 @@ func Srs_path_build_stream(template_path string, vhost string, app string, strea
 	return path
 }
 
+/**
+* replace the date and time variables of template path by t,
+* the variables are [2006], [01], [02], [15], [04], [05], [999] for
+* year, month, day, hour, minute, second and millisecond,
+* and [timestamp] for the unix time in ms.
+*/
+func Srs_path_build_timestamp(template_path string, t time.Time) string {
+	path := template_path
+	if !strings.Contains(path, "[") {
+		return path
+	}
+
+	path = strings.Replace(path, "[2006]", fmt.Sprintf("%04d", t.Year()), -1)
+	path = strings.Replace(path, "[01]", fmt.Sprintf("%02d", int(t.Month())), -1)
+	path = strings.Replace(path, "[02]", fmt.Sprintf("%02d", t.Day()), -1)
+	path = strings.Replace(path, "[15]", fmt.Sprintf("%02d", t.Hour()), -1)
+	path = strings.Replace(path, "[04]", fmt.Sprintf("%02d", t.Minute()), -1)
+	path = strings.Replace(path, "[05]", fmt.Sprintf("%02d", t.Second()), -1)
+	path = strings.Replace(path, "[999]", fmt.Sprintf("%03d", t.Nanosecond() / int(time.Millisecond)), -1)
+	path = strings.Replace(path, "[timestamp]", fmt.Sprintf("%d", t.UnixNano() / int64(time.Millisecond)), -1)
+	return path
+}
+
 var CRCTable = [256]uint32{
 	0x00000000, 0x04c11db7, 0x09823b6e, 0x0d4326d9, 0x130476dc, 0x17c56b6b,
 	0x1a864db2, 0x1e475005, 0x2608edb8, 0x22c9f00f, 0x2f8ad6d6, 0x2b4bcb61,